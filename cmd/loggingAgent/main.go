@@ -1,33 +1,291 @@
 package main
 
 import (
+	"crypto/tls"
+	"crypto/x509"
 	"flag"
+	"fmt"
+	"io/ioutil"
+	"net/http"
 	"os"
 	"os/signal"
+	"path/filepath"
+	"reflect"
+	"regexp"
 	"strconv"
+	"strings"
 	"syscall"
+	"time"
 
 	"code.cloudfoundry.org/cflager"
+	"code.cloudfoundry.org/lager"
 
+	"github.com/cf-furnace/loggingAgent/config"
+	"github.com/cf-furnace/loggingAgent/kube"
+	"github.com/cf-furnace/loggingAgent/loggregator"
+	"github.com/cf-furnace/loggingAgent/notify"
 	"github.com/cf-furnace/loggingAgent/proxy"
+	"github.com/cf-furnace/loggingAgent/retriever"
+	"github.com/cf-furnace/loggingAgent/sink"
+	"github.com/cf-furnace/loggingAgent/status"
 	"github.com/cf-furnace/loggingAgent/watcher"
 	"github.com/cloudfoundry/dropsonde"
+	"github.com/cloudfoundry/dropsonde/emitter"
+	"github.com/cloudfoundry/dropsonde/metrics"
+	"github.com/cloudfoundry/sonde-go/events"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/clientcmd"
 )
 
 const (
 	dropsondeOrigin = "loggingAgent"
 )
 
+var configFile = flag.String(
+	"config",
+	"",
+	"YAML or JSON file holding the agent's settings; flags given on the command line override it. Rate limits, source rules, unmatched containers, the operator destination, sinks, drains and the shutdown timeout are reloaded on SIGHUP and when the file changes; a reload changing any other setting is rejected",
+)
 var logsDir = flag.String(
 	"logsDir",
 	"/var/log/containers",
 	"directory containing the kubernetes' container logs",
 )
+var watchRoots watchRootList
+
+func init() {
+	flag.Var(
+		&watchRoots,
+		"watchRoot",
+		"directory watched for logs as <dir>[,pattern=<glob>][,format=<format>][,metadata=kube|names|node][,names=<regexp>]; names reads the pod, namespace, container and container_id from the log names through named groups and, as it may hold commas, comes last; with recursive, roots may not lie within each other; replaces logsDir (repeatable)",
+	)
+}
+
+var recursive = flag.Bool(
+	"recursive",
+	false,
+	"watch subdirectories of the logs directory",
+)
+var followSymlinks = flag.Bool(
+	"followSymlinks",
+	true,
+	"resolve symlinked logs and watch the directories they point into",
+)
+var fileEvents = flag.String(
+	"fileEvents",
+	"auto",
+	"how file changes are detected: inotify, poll, or auto to poll only when inotify limits are exhausted",
+)
+var pollInterval = flag.Duration(
+	"pollInterval",
+	notify.DefaultPollInterval,
+	"how often files are checked for changes when polling",
+)
 var dropsondePort = flag.Int(
 	"dropsondePort",
 	3457,
 	"port the local metron agent is listening on",
 )
+var loggregatorAddress = flag.String(
+	"loggregatorAddress",
+	"",
+	"host:port of a loggregator agent's v2 gRPC ingress; logs are sent to the metron agent over UDP when empty",
+)
+var loggregatorCA = flag.String(
+	"loggregatorCA",
+	"",
+	"path to the CA certificate of the loggregator agent",
+)
+var loggregatorCert = flag.String(
+	"loggregatorCert",
+	"",
+	"path to the client certificate presented to the loggregator agent",
+)
+var loggregatorKey = flag.String(
+	"loggregatorKey",
+	"",
+	"path to the key of the client certificate",
+)
+var loggregatorServerName = flag.String(
+	"loggregatorServerName",
+	loggregator.DefaultServerName,
+	"name in the certificate of the loggregator agent",
+)
+var sinkURLs stringList
+
+func init() {
+	flag.Var(
+		&sinkURLs,
+		"sink",
+		"destination of the logs: loggregator, stdout, file:///<path>, syslog://<host>:<port> or syslog-tls://<host>:<port>; loggregator when not given (repeatable)",
+	)
+}
+
+var syslogCA = flag.String(
+	"syslogCA",
+	"",
+	"path to the CA certificate trusted by syslog-tls sinks and TLS drains; the system's CAs are used when empty",
+)
+var drainsFile = flag.String(
+	"drainsFile",
+	"",
+	"JSON file mapping app GUIDs to the syslog drain URLs their logs are forwarded to",
+)
+var drainBufferSize = flag.Int(
+	"drainBufferSize",
+	sink.DefaultDrainBufferSize,
+	"number of messages held for each syslog drain while it cannot be reached",
+)
+var batchWindow = flag.Duration(
+	"batchWindow",
+	0,
+	"how long envelopes sent to loggregator are held to be emitted together; disabled when 0",
+)
+var batchSize = flag.Int(
+	"batchSize",
+	proxy.DefaultBatchSize,
+	"bytes of envelopes after which a batch is emitted without waiting for the window",
+)
+var logFormat = flag.String(
+	"logFormat",
+	"auto",
+	"format of the container logs: json, cri, or auto to detect it per file",
+)
+var maxMessageSize = flag.Int(
+	"maxMessageSize",
+	60*1024,
+	"maximum size in bytes of a log message; longer lines are truncated (0 for no limit)",
+)
+var truncationMarker = flag.String(
+	"truncationMarker",
+	" [truncated]",
+	"text appended to truncated log messages",
+)
+var backpressure = flag.String(
+	"backpressure",
+	"block",
+	"what a reader does when its queue or the memory budget is full: block, drop-oldest or drop-newest",
+)
+var queueSize = flag.Int(
+	"queueSize",
+	retriever.DefaultQueueSize,
+	"number of messages each reader queues for the emitter",
+)
+var memoryBudget = flag.Int64(
+	"memoryBudget",
+	64*1024*1024,
+	"bytes of queued messages shared by all readers (0 for no limit)",
+)
+var rateLimitLines = flag.Float64(
+	"rateLimitLines",
+	0,
+	"log lines per second emitted for each app (0 for no limit)",
+)
+var rateLimitLineBurst = flag.Float64(
+	"rateLimitLineBurst",
+	0,
+	"log lines an app may emit at once above its rate; one second's worth when 0",
+)
+var rateLimitBytes = flag.Float64(
+	"rateLimitBytes",
+	0,
+	"log bytes per second emitted for each app (0 for no limit)",
+)
+var rateLimitByteBurst = flag.Float64(
+	"rateLimitByteBurst",
+	0,
+	"log bytes an app may emit at once above its rate; one second's worth when 0",
+)
+var multilinePattern = flag.String(
+	"multilinePattern",
+	"",
+	"regular expression matching lines that continue the previous log message; disabled when empty",
+)
+var multilineTimeout = flag.Duration(
+	"multilineTimeout",
+	time.Second,
+	"how long a multiline message waits for continuation lines",
+)
+var multilineApps = appPatterns{}
+
+func init() {
+	flag.Var(
+		multilineApps,
+		"multilineApp",
+		"per-app multiline pattern as <app-guid>=<regexp>; an empty pattern disables joining (repeatable)",
+	)
+}
+
+var sourceRules sourceRuleList
+
+func init() {
+	flag.Var(
+		&sourceRules,
+		"sourceRule",
+		"container name rule as prefix:<prefix>=<SOURCE> or regexp:<pattern>=<SOURCE>; replaces the default rules (repeatable)",
+	)
+}
+
+var unmatchedContainers = flag.String(
+	"unmatchedContainers",
+	"drop",
+	"what to do with containers no source rule matches: drop, default or operator",
+)
+var defaultSource = flag.String(
+	"defaultSource",
+	"OPS",
+	"source type given to unmatched containers that are forwarded",
+)
+var operatorDestination = flag.String(
+	"operatorDestination",
+	"",
+	"host:port receiving the logs of unmatched containers under the operator policy; the metron agent is used when empty",
+)
+
+var kubeMetadata = flag.Bool(
+	"kubeMetadata",
+	false,
+	"resolve app metadata from pod labels and annotations through the kubernetes API",
+)
+var kubeconfig = flag.String(
+	"kubeconfig",
+	"",
+	"kubeconfig used to reach the kubernetes API; the in-cluster config is used when empty",
+)
+var nodeName = flag.String(
+	"nodeName",
+	os.Getenv("NODE_NAME"),
+	"name of the node the agent runs on; only its pods are cached",
+)
+
+var checkpointFile = flag.String(
+	"checkpointFile",
+	"",
+	"file used to persist read offsets across restarts; disabled when empty",
+)
+var checkpointInterval = flag.Duration(
+	"checkpointInterval",
+	5*time.Second,
+	"how often read offsets are written to the checkpoint file",
+)
+var metricsInterval = flag.Duration(
+	"metricsInterval",
+	30*time.Second,
+	"how often the agent's own metrics are sent through dropsonde; disabled when 0",
+)
+
+var statusAddress = flag.String(
+	"statusAddress",
+	"",
+	"address serving /metrics for Prometheus and /healthz for probes; disabled when empty",
+)
+
+var shutdownTimeout = flag.Duration(
+	"shutdownTimeout",
+	10*time.Second,
+	"how long to wait on exit for the logs already read to be emitted",
+)
 
 func main() {
 	cflager.AddFlags(flag.CommandLine)
@@ -35,6 +293,23 @@ func main() {
 
 	logger, _ := cflager.New("logging-agent")
 
+	flag.Visit(func(f *flag.Flag) {
+		commandLineFlags[f.Name] = true
+	})
+
+	var cfg *config.Config
+	if *configFile != "" {
+		var err error
+		cfg, err = config.Load(*configFile)
+		if err == nil {
+			err = applyConfig(cfg, nil)
+		}
+		if err != nil {
+			logger.Error("invalid-config", err)
+			os.Exit(1)
+		}
+	}
+
 	destination := "127.0.0.1:" + strconv.Itoa(*dropsondePort)
 	err := dropsonde.Initialize(destination, dropsondeOrigin)
 	if err != nil {
@@ -42,27 +317,716 @@ func main() {
 		os.Exit(1)
 	}
 
-	watchEvents, err := watcher.Watch(logger, *logsDir)
+	format, err := retriever.ParseFormat(*logFormat)
+	if err != nil {
+		logger.Error("invalid-log-format", err)
+		os.Exit(1)
+	}
+
+	backend, err := notify.ParseBackend(*fileEvents)
+	if err != nil {
+		logger.Error("invalid-file-events", err)
+		os.Exit(1)
+	}
+	notifyOptions := notify.Options{Backend: backend, PollInterval: *pollInterval}
+
+	policy, err := retriever.ParsePolicy(*backpressure)
+	if err != nil {
+		logger.Error("invalid-backpressure", err)
+		os.Exit(1)
+	}
+
+	var budget *retriever.Budget
+	if *memoryBudget > 0 {
+		budget = retriever.NewBudget(*memoryBudget)
+	}
+
+	multiline, appMultiline, err := multilineRules()
+	if err != nil {
+		logger.Error("invalid-multiline-pattern", err)
+		os.Exit(1)
+	}
+
+	var logEmitter dropsonde.EventEmitter = dropsonde.AutowiredEmitter()
+	var loggregatorEmitter *loggregator.Emitter
+	if *loggregatorAddress != "" {
+		tlsConfig, err := loggregator.NewTLSConfig(*loggregatorCA, *loggregatorCert, *loggregatorKey, *loggregatorServerName)
+		if err != nil {
+			logger.Error("invalid-loggregator-tls", err)
+			os.Exit(1)
+		}
+
+		loggregatorEmitter, err = loggregator.New(logger, *loggregatorAddress, tlsConfig, dropsondeOrigin)
+		if err != nil {
+			logger.Error("failed-to-initialize-loggregator-emitter", err)
+			os.Exit(1)
+		}
+		logEmitter = loggregatorEmitter
+	}
+
+	// only the loggregator emitter takes whole batches; the UDP emitter
+	// would send their envelopes one by one anyway.
+	var logProxy *proxy.Proxy
+	var logBatcher *proxy.BatchingEmitter
+	if *batchWindow > 0 && loggregatorEmitter != nil {
+		logBatcher = proxy.NewBatchingEmitter(logger, loggregatorEmitter, proxy.BatchOptions{
+			Size:   *batchSize,
+			Window: *batchWindow,
+			Failed: func(envelopes []*events.Envelope) {
+				logProxy.EmitFailed(envelopes)
+			},
+		})
+		logEmitter = logBatcher
+	}
+	loggregatorSink := proxy.NewEmitterSink(logEmitter)
+
+	out, err := newOutputs(logger, loggregatorSink, cfg)
+	if err != nil {
+		os.Exit(1)
+	}
+
+	mux, err := notify.NewMux(notifyOptions)
+	if err != nil {
+		logger.Error("failed-to-initialize-file-events", err)
+		os.Exit(1)
+	}
+
+	var checkpoints *retriever.Checkpoints
+	var checkpointTicks <-chan time.Time
+	if *checkpointFile != "" {
+		checkpoints, err = retriever.LoadCheckpoints(*checkpointFile)
+		if err != nil {
+			logger.Error("failed-to-load-checkpoints", err)
+			os.Exit(1)
+		}
+
+		ticker := time.NewTicker(*checkpointInterval)
+		defer ticker.Stop()
+		checkpointTicks = ticker.C
+	}
+
+	roots := watchRoots
+	if len(roots) == 0 {
+		roots = watchRootList{{Root: watcher.Root{Dir: filepath.Clean(*logsDir)}}}
+	}
+	// a log below two recursive roots would be read twice.
+	if *recursive {
+		if err := roots.checkOverlap(); err != nil {
+			logger.Error("invalid-watch-roots", err)
+			os.Exit(1)
+		}
+	}
+
+	// events name the Dir of the root they were found in, which is unique.
+	var watcherRoots []watcher.Root
+	logOptions := map[string]proxy.LogOptions{}
+	for _, root := range roots {
+		root.Recursive = *recursive
+		root.FollowSymlinks = *followSymlinks
+		root.Notify = notifyOptions
+		watcherRoots = append(watcherRoots, root.Root)
+		logOptions[root.Root.Dir] = root.options
+	}
+
+	logWatcher, err := watcher.WatchRoots(logger, watcherRoots)
 	if err != nil {
 		logger.Error("failed-to-initialize-watcher", err)
 		os.Exit(1)
 	}
 
-	logProxy := proxy.New(logger, dropsonde.AutowiredEmitter())
+	var resolver proxy.MetadataResolver
+	if *kubeMetadata {
+		kubeResolver, err := newKubeResolver()
+		if err != nil {
+			logger.Error("failed-to-initialize-kube-resolver", err)
+			os.Exit(1)
+		}
+		go func() {
+			if !kubeResolver.Start(nil) {
+				logger.Error("kube-resolver-cache-not-synced", nil)
+			}
+		}()
+		resolver = kubeResolver
+	}
+
+	proxyConfig := out.config
+	proxyConfig.Checkpoints = checkpoints
+	proxyConfig.Format = format
+	proxyConfig.Mux = mux
+	proxyConfig.MaxMessageSize = *maxMessageSize
+	proxyConfig.TruncationMarker = *truncationMarker
+	proxyConfig.QueueSize = *queueSize
+	proxyConfig.Policy = policy
+	proxyConfig.Budget = budget
+	proxyConfig.Multiline = multiline
+	proxyConfig.AppMultiline = appMultiline
+	proxyConfig.MetadataResolver = resolver
+	if logBatcher != nil {
+		proxyConfig.Flush = logBatcher.Flush
+	}
+
+	logProxy = proxy.New(logger, out.sink, proxyConfig)
+
+	// reload applies the configuration file again. Unless force is set,
+	// nothing is done when the file has not changed.
+	reload := func(force bool) {
+		next, err := config.Load(*configFile)
+		if err != nil {
+			logger.Error("failed-to-reload-config", err)
+			return
+		}
+		if !force && reflect.DeepEqual(next, cfg) {
+			return
+		}
+		if changed := next.Unreloadable(cfg); len(changed) > 0 {
+			logger.Error("failed-to-reload-config", fmt.Errorf("%s only take effect on restart", strings.Join(changed, ", ")))
+			return
+		}
+
+		err = applyConfig(next, cfg)
+		var nextOut *outputs
+		if err == nil {
+			nextOut, err = newOutputs(logger, loggregatorSink, next)
+		}
+		if err != nil {
+			logger.Error("failed-to-reload-config", err)
+			if err := applyConfig(cfg, next); err != nil {
+				logger.Error("failed-to-restore-config", err)
+			}
+			return
+		}
+
+		// nothing is sent to the old outputs once Reconfigure returns.
+		logProxy.Reconfigure(nextOut.sink, nextOut.config)
+		out.Close(logger)
+		cfg, out = next, nextOut
+		logger.Info("reloaded-config")
+	}
+
+	reloadSignals := make(chan os.Signal, 1)
+	var configWatcher notify.Watcher
+	var configEvents <-chan notify.Event
+	var configErrors <-chan error
+	if *configFile != "" {
+		signal.Notify(reloadSignals, syscall.SIGHUP)
+
+		// the directory is watched as well as the file, which may be
+		// replaced rather than written to, as kubernetes does with mounted
+		// ConfigMaps.
+		configWatcher, err = notify.New(notifyOptions)
+		if err == nil {
+			err = configWatcher.Add(filepath.Dir(*configFile))
+		}
+		if err == nil {
+			err = configWatcher.Add(*configFile)
+		}
+		if err != nil {
+			logger.Error("failed-to-watch-config", err)
+			os.Exit(1)
+		}
+		configEvents = configWatcher.Events()
+		configErrors = configWatcher.Errors()
+	}
+
+	stopMetrics := make(chan struct{})
+	if *metricsInterval > 0 {
+		go logProxy.ReportMetrics(dropsondeMetrics{}, *metricsInterval, stopMetrics)
+	}
+
+	if *statusAddress != "" {
+		go func() {
+			err := http.ListenAndServe(*statusAddress, status.NewHandler(logger, logProxy, logWatcher))
+			logger.Error("status-server-failed", err)
+		}()
+	}
 
 	osSignals := make(chan os.Signal, 5)
 	signal.Notify(osSignals, syscall.SIGINT, syscall.SIGTERM)
 
+	exitCode := 0
+
 DONE:
 	for {
 		select {
-		case event := <-watchEvents:
-			logProxy.Add(event.Pod, event.Container, event.Path, event.Info != nil)
+		case event := <-logWatcher.Events:
+			logProxy.AddWithOptions(event.Pod, event.Namespace, event.Container, event.RealPath, event.Info != nil, logOptions[event.Root])
+		case <-reloadSignals:
+			reload(true)
+		case <-configEvents:
+			// watch the file again in case it was replaced.
+			configWatcher.Add(*configFile)
+			reload(false)
+		case err := <-configErrors:
+			logger.Error("failed-to-watch-config", err)
+		case <-checkpointTicks:
+			// errors are logged by the proxy.
+			logProxy.SaveCheckpoints()
+		case <-logWatcher.Done():
+			logger.Error("watcher-stopped", logWatcher.Err())
+			exitCode = 1
+			break DONE
 		case <-osSignals:
 			signal.Stop(osSignals)
 			break DONE
 		}
 	}
 
+	close(stopMetrics)
+	logWatcher.Close()
+	if err := logProxy.Stop(*shutdownTimeout); err != nil {
+		logger.Error("failed-to-stop-proxy", err)
+	}
+	out.Close(logger)
+	if logBatcher != nil {
+		logBatcher.Close()
+	}
+	if loggregatorEmitter != nil {
+		loggregatorEmitter.Close()
+	}
+	mux.Close()
+	if configWatcher != nil {
+		configWatcher.Close()
+	}
+
 	logger.Info("exited")
+	os.Exit(exitCode)
+}
+
+// commandLineFlags holds the names of the flags given on the command line.
+var commandLineFlags = map[string]bool{}
+
+// resettable is implemented by repeatable flags, whose values are added to
+// rather than replaced when set.
+type resettable interface {
+	reset()
+}
+
+// applyConfig sets the flags the configuration file gives, unless they were
+// given on the command line. The flags set by previous, the configuration
+// applied before, are first returned to their defaults so that settings
+// removed from the file are undone.
+func applyConfig(cfg, previous *config.Config) error {
+	if previous != nil {
+		for _, f := range previous.Flags() {
+			if commandLineFlags[f.Name] {
+				continue
+			}
+			if err := resetFlag(f.Name); err != nil {
+				return err
+			}
+		}
+	}
+
+	for _, f := range cfg.Flags() {
+		if commandLineFlags[f.Name] {
+			continue
+		}
+		if err := resetFlag(f.Name); err != nil {
+			return err
+		}
+		for _, value := range f.Values {
+			if err := flag.Set(f.Name, value); err != nil {
+				return fmt.Errorf("%s: setting %s to %q: %s", *configFile, f.Name, value, err)
+			}
+		}
+	}
+	return nil
+}
+
+func resetFlag(name string) error {
+	f := flag.Lookup(name)
+	if r, ok := f.Value.(resettable); ok {
+		r.reset()
+		return nil
+	}
+	return flag.Set(name, f.DefValue)
+}
+
+// outputs are the destinations of the logs and the settings deciding which
+// go where. They are created again when the configuration is reloaded.
+type outputs struct {
+	sink   proxy.FanOut
+	config proxy.Config
+
+	operatorUDP *emitter.UdpEmitter
+}
+
+// newOutputs creates the outputs the flags describe. cfg, the configuration
+// file, may be nil. Errors are logged before being returned.
+func newOutputs(logger lager.Logger, loggregatorSink proxy.Sink, cfg *config.Config) (*outputs, error) {
+	out := &outputs{}
+	fail := func(action string, err error) (*outputs, error) {
+		logger.Error(action, err)
+		out.Close(logger)
+		return nil, err
+	}
+
+	unmatched, err := proxy.ParseUnmatchedPolicy(*unmatchedContainers)
+	if err != nil {
+		return fail("invalid-unmatched-containers", err)
+	}
+
+	syslogTLS, err := syslogTLSConfig()
+	if err != nil {
+		return fail("invalid-syslog-ca", err)
+	}
+
+	var appDrains map[string][]string
+	if *drainsFile != "" {
+		appDrains, err = sink.LoadDrainURLs(*drainsFile)
+		if err != nil {
+			return fail("failed-to-load-drains", err)
+		}
+	}
+
+	var appRateLimits map[string]*proxy.RateLimit
+	if cfg != nil {
+		for appID, urls := range cfg.Drains {
+			if appDrains == nil {
+				appDrains = map[string][]string{}
+			}
+			appDrains[appID] = append(appDrains[appID], urls...)
+		}
+		appRateLimits = cfg.AppRateLimits()
+	}
+
+	var operatorSink proxy.Sink
+	if *operatorDestination != "" {
+		out.operatorUDP, err = emitter.NewUdpEmitter(*operatorDestination)
+		if err != nil {
+			return fail("failed-to-initialize-operator-emitter", err)
+		}
+
+		operatorSink = proxy.NewEmitterSink(emitter.NewEventEmitter(out.operatorUDP, dropsondeOrigin))
+	}
+
+	out.sink, err = newSinks(logger, loggregatorSink, syslogTLS)
+	if err != nil {
+		return fail("invalid-sink", err)
+	}
+
+	drainBuffer := *drainBufferSize
+	out.config = proxy.Config{
+		RateLimit: proxy.RateLimit{
+			LinesPerSecond: *rateLimitLines,
+			LineBurst:      *rateLimitLineBurst,
+			BytesPerSecond: *rateLimitBytes,
+			ByteBurst:      *rateLimitByteBurst,
+		},
+		AppRateLimits: appRateLimits,
+
+		SourceRules:   []proxy.SourceRule(sourceRules),
+		Unmatched:     unmatched,
+		DefaultSource: *defaultSource,
+		OperatorSink:  operatorSink,
+
+		AppDrains: appDrains,
+		NewDrain: func(url string) (proxy.Sink, error) {
+			return sink.NewDrain(logger, url, syslogTLS, drainBuffer)
+		},
+	}
+	return out, nil
+}
+
+// Close closes the sinks.
+func (o *outputs) Close(logger lager.Logger) {
+	if o.sink != nil {
+		if err := o.sink.Close(); err != nil {
+			logger.Error("failed-to-close-sink", err)
+		}
+	}
+	if o.operatorUDP != nil {
+		o.operatorUDP.Close()
+	}
+}
+
+func multilineRules() (*retriever.MultilineRule, map[string]*retriever.MultilineRule, error) {
+	rule := func(pattern string) (*retriever.MultilineRule, error) {
+		if pattern == "" {
+			return nil, nil
+		}
+
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			return nil, err
+		}
+		return &retriever.MultilineRule{Continuation: re, FlushTimeout: *multilineTimeout}, nil
+	}
+
+	multiline, err := rule(*multilinePattern)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	appMultiline := map[string]*retriever.MultilineRule{}
+	for appID, pattern := range multilineApps {
+		appMultiline[appID], err = rule(pattern)
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+
+	return multiline, appMultiline, nil
+}
+
+// appPatterns collects repeated <app-guid>=<pattern> flags.
+type appPatterns map[string]string
+
+func (a appPatterns) String() string {
+	pairs := []string{}
+	for appID, pattern := range a {
+		pairs = append(pairs, appID+"="+pattern)
+	}
+	return strings.Join(pairs, ",")
+}
+
+func (a appPatterns) reset() {
+	for appID := range a {
+		delete(a, appID)
+	}
+}
+
+func (a appPatterns) Set(value string) error {
+	i := strings.Index(value, "=")
+	if i < 0 {
+		return fmt.Errorf("expected <app-guid>=<pattern>, got %q", value)
+	}
+	a[value[:i]] = value[i+1:]
+	return nil
+}
+
+// syslogTLSConfig returns the TLS configuration of syslog sinks and drains,
+// or nil to trust the system's CAs.
+func syslogTLSConfig() (*tls.Config, error) {
+	if *syslogCA == "" {
+		return nil, nil
+	}
+
+	caPEM, err := ioutil.ReadFile(*syslogCA)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(caPEM) {
+		return nil, fmt.Errorf("no certificates in %s", *syslogCA)
+	}
+	return &tls.Config{RootCAs: pool}, nil
+}
+
+// newSinks creates the sinks named by the sink flags. loggregatorSink is
+// used for "loggregator" and when no sink is named.
+func newSinks(logger lager.Logger, loggregatorSink proxy.Sink, tlsConfig *tls.Config) (proxy.FanOut, error) {
+	if len(sinkURLs) == 0 {
+		return proxy.FanOut{loggregatorSink}, nil
+	}
+
+	hostname, _ := os.Hostname()
+
+	sinks := proxy.FanOut{}
+	for _, sinkURL := range sinkURLs {
+		switch {
+		case sinkURL == "loggregator":
+			sinks = append(sinks, loggregatorSink)
+		case sinkURL == "stdout":
+			sinks = append(sinks, sink.NewWriter(os.Stdout))
+		case strings.HasPrefix(sinkURL, "file://"):
+			file, err := sink.NewFile(strings.TrimPrefix(sinkURL, "file://"))
+			if err != nil {
+				return nil, err
+			}
+			sinks = append(sinks, file)
+		case strings.HasPrefix(sinkURL, "syslog"):
+			config, err := sink.ParseSyslogURL(sinkURL, tlsConfig)
+			if err != nil {
+				return nil, err
+			}
+			config.Hostname = hostname
+			sinks = append(sinks, sink.NewSyslog(logger, config))
+		default:
+			return nil, fmt.Errorf("unknown sink %q", sinkURL)
+		}
+	}
+	return sinks, nil
+}
+
+// watchRoot is a directory watched for logs and how its logs are read.
+type watchRoot struct {
+	watcher.Root
+	options proxy.LogOptions
+}
+
+// watchRootList collects repeated watch root flags.
+type watchRootList []watchRoot
+
+func (l *watchRootList) String() string {
+	if l == nil {
+		return ""
+	}
+
+	roots := []string{}
+	for _, root := range *l {
+		roots = append(roots, root.Dir)
+	}
+	return strings.Join(roots, " ")
+}
+
+func (l *watchRootList) Set(value string) error {
+	// the names pattern is last and may hold commas.
+	var names string
+	if i := strings.Index(value, ",names="); i >= 0 {
+		value, names = value[:i], value[i+len(",names="):]
+	}
+
+	parts := strings.Split(value, ",")
+	if parts[0] == "" {
+		return fmt.Errorf("expected <dir>[,<setting>=<value>...], got %q", value)
+	}
+	root := watchRoot{Root: watcher.Root{Dir: filepath.Clean(parts[0])}}
+
+	for _, part := range parts[1:] {
+		i := strings.Index(part, "=")
+		if i < 0 {
+			return fmt.Errorf("expected <setting>=<value>, got %q", part)
+		}
+
+		var err error
+		switch name, setting := part[:i], part[i+1:]; name {
+		case "pattern":
+			_, err = filepath.Match(setting, "")
+			root.Pattern = setting
+		case "format":
+			root.options.Format, err = retriever.ParseFormat(setting)
+		case "metadata":
+			root.options.Metadata, err = proxy.ParseMetadataStrategy(setting)
+		default:
+			err = fmt.Errorf("unknown watch root setting %q", name)
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	switch {
+	case names != "":
+		var err error
+		root.NamePattern, err = regexp.Compile(names)
+		if err != nil {
+			return err
+		}
+	case root.options.Metadata == proxy.MetadataNode:
+		root.NamePattern = watcher.PlainNamePattern
+	}
+
+	for _, other := range *l {
+		if other.Dir == root.Dir {
+			return fmt.Errorf("%s is watched twice", root.Dir)
+		}
+	}
+	*l = append(*l, root)
+	return nil
+}
+
+func (l *watchRootList) reset() {
+	*l = nil
+}
+
+// checkOverlap fails when a root lies within another.
+func (l watchRootList) checkOverlap() error {
+	within := func(dir, parent string) bool {
+		rel, err := filepath.Rel(parent, dir)
+		return err == nil && rel != ".." && !strings.HasPrefix(rel, "../")
+	}
+
+	for i, root := range l {
+		for _, other := range l[i+1:] {
+			if within(root.Dir, other.Dir) || within(other.Dir, root.Dir) {
+				return fmt.Errorf("%s and %s overlap", root.Dir, other.Dir)
+			}
+		}
+	}
+	return nil
+}
+
+// stringList collects repeated flags.
+type stringList []string
+
+func (l *stringList) String() string {
+	if l == nil {
+		return ""
+	}
+	return strings.Join(*l, ",")
+}
+
+func (l *stringList) Set(value string) error {
+	*l = append(*l, value)
+	return nil
+}
+
+func (l *stringList) reset() {
+	*l = nil
+}
+
+// dropsondeMetrics sends metrics through the client set up by
+// dropsonde.Initialize.
+type dropsondeMetrics struct{}
+
+func (dropsondeMetrics) SendValue(name string, value float64, unit string) error {
+	return metrics.SendValue(name, value, unit)
+}
+
+func (dropsondeMetrics) AddToCounter(name string, delta uint64) error {
+	return metrics.AddToCounter(name, delta)
+}
+
+// sourceRuleList collects repeated source rule flags. It stays nil, selecting
+// the default rules, until the flag is given.
+type sourceRuleList []proxy.SourceRule
+
+func (l *sourceRuleList) String() string {
+	if l == nil {
+		return ""
+	}
+
+	rules := []string{}
+	for _, rule := range *l {
+		if rule.Pattern != nil {
+			rules = append(rules, "regexp:"+rule.Pattern.String()+"="+rule.SourceType)
+		} else {
+			rules = append(rules, "prefix:"+rule.Prefix+"="+rule.SourceType)
+		}
+	}
+	return strings.Join(rules, ",")
+}
+
+func (l *sourceRuleList) reset() {
+	*l = nil
+}
+
+func (l *sourceRuleList) Set(value string) error {
+	rule, err := proxy.ParseSourceRule(value)
+	if err != nil {
+		return err
+	}
+	*l = append(*l, rule)
+	return nil
+}
+
+func newKubeResolver() (*kube.Resolver, error) {
+	var config *rest.Config
+	var err error
+	if *kubeconfig != "" {
+		config, err = clientcmd.BuildConfigFromFlags("", *kubeconfig)
+	} else {
+		config, err = rest.InClusterConfig()
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	clientset, err := kubernetes.NewForConfig(config)
+	if err != nil {
+		return nil, err
+	}
+
+	return kube.NewResolver(clientset, *nodeName, 10*time.Minute), nil
 }
@@ -0,0 +1,576 @@
+// Package config loads the agent's settings from a YAML or JSON file.
+//
+// Each setting in the file corresponds to a command line flag, which
+// overrides it when given. Settings left out of the file keep the flag's
+// default.
+package config
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/url"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/cf-furnace/loggingAgent/notify"
+	"github.com/cf-furnace/loggingAgent/proxy"
+	"github.com/cf-furnace/loggingAgent/retriever"
+	"github.com/cf-furnace/loggingAgent/sink"
+	"gopkg.in/yaml.v2"
+)
+
+// Config is the content of a configuration file. Unset fields are nil.
+type Config struct {
+	LogsDir        *string     `yaml:"logs_dir"`
+	WatchRoots     []WatchRoot `yaml:"watch_roots"`
+	Recursive      *bool       `yaml:"recursive"`
+	FollowSymlinks *bool       `yaml:"follow_symlinks"`
+	FileEvents     *string     `yaml:"file_events"`
+	PollInterval   *Duration   `yaml:"poll_interval"`
+
+	LogFormat        *string `yaml:"log_format"`
+	MaxMessageSize   *int    `yaml:"max_message_size"`
+	TruncationMarker *string `yaml:"truncation_marker"`
+
+	Backpressure *string `yaml:"backpressure"`
+	QueueSize    *int    `yaml:"queue_size"`
+	MemoryBudget *int64  `yaml:"memory_budget"`
+
+	Multiline Multiline `yaml:"multiline"`
+	RateLimit RateLimit `yaml:"rate_limit"`
+
+	SourceRules         []SourceRule `yaml:"source_rules"`
+	UnmatchedContainers *string      `yaml:"unmatched_containers"`
+	DefaultSource       *string      `yaml:"default_source"`
+	OperatorDestination *string      `yaml:"operator_destination"`
+
+	DropsondePort *int        `yaml:"dropsonde_port"`
+	Loggregator   Loggregator `yaml:"loggregator"`
+	Batch         Batch       `yaml:"batch"`
+
+	Sinks           []string            `yaml:"sinks"`
+	SyslogCA        *string             `yaml:"syslog_ca"`
+	Drains          map[string][]string `yaml:"drains"`
+	DrainsFile      *string             `yaml:"drains_file"`
+	DrainBufferSize *int                `yaml:"drain_buffer_size"`
+
+	Kube        Kube        `yaml:"kube"`
+	Checkpoints Checkpoints `yaml:"checkpoints"`
+
+	MetricsInterval *Duration `yaml:"metrics_interval"`
+	StatusAddress   *string   `yaml:"status_address"`
+	ShutdownTimeout *Duration `yaml:"shutdown_timeout"`
+}
+
+// WatchRoot is a directory watched for logs. Pattern selects the logs by
+// name, Format is the encoding of their lines, and Metadata is the strategy
+// giving their app metadata. Names is a regular expression reading the pod,
+// namespace, container and container_id from the names of the logs through
+// named groups. The other settings may not contain commas.
+type WatchRoot struct {
+	Dir      string `yaml:"dir"`
+	Pattern  string `yaml:"pattern"`
+	Format   string `yaml:"format"`
+	Metadata string `yaml:"metadata"`
+	Names    string `yaml:"names"`
+}
+
+// Multiline joins continuation lines. Apps maps app GUIDs to the pattern
+// used for their logs.
+type Multiline struct {
+	Pattern *string           `yaml:"pattern"`
+	Timeout *Duration         `yaml:"timeout"`
+	Apps    map[string]string `yaml:"apps"`
+}
+
+// RateLimit limits the messages of each app. Apps overrides it for single
+// apps, identified by their GUIDs; a rate of zero there turns the limit off
+// for the app.
+type RateLimit struct {
+	Limit `yaml:",inline"`
+	Apps  map[string]Limit `yaml:"apps"`
+}
+
+// Limit is a rate limit. Unset rates are not limited, and unset bursts
+// default to one second's worth.
+type Limit struct {
+	LinesPerSecond *float64 `yaml:"lines_per_second"`
+	LineBurst      *float64 `yaml:"line_burst"`
+	BytesPerSecond *float64 `yaml:"bytes_per_second"`
+	ByteBurst      *float64 `yaml:"byte_burst"`
+}
+
+// SourceRule gives a source type to the containers whose names start with
+// Prefix or match Regexp. Exactly one of them is set.
+type SourceRule struct {
+	Prefix string `yaml:"prefix"`
+	Regexp string `yaml:"regexp"`
+	Source string `yaml:"source"`
+}
+
+// Loggregator is the v2 gRPC ingress logs are sent to.
+type Loggregator struct {
+	Address    *string `yaml:"address"`
+	CA         *string `yaml:"ca"`
+	Cert       *string `yaml:"cert"`
+	Key        *string `yaml:"key"`
+	ServerName *string `yaml:"server_name"`
+}
+
+// Batch groups envelopes before they are emitted.
+type Batch struct {
+	Window *Duration `yaml:"window"`
+	Size   *int      `yaml:"size"`
+}
+
+// Kube resolves app metadata through the kubernetes API.
+type Kube struct {
+	Metadata   *bool   `yaml:"metadata"`
+	Kubeconfig *string `yaml:"kubeconfig"`
+	NodeName   *string `yaml:"node_name"`
+}
+
+// Checkpoints persists read offsets across restarts.
+type Checkpoints struct {
+	File     *string   `yaml:"file"`
+	Interval *Duration `yaml:"interval"`
+}
+
+// Duration is a time.Duration written as a string such as "1m30s".
+type Duration time.Duration
+
+func (d *Duration) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var s string
+	if err := unmarshal(&s); err != nil {
+		return err
+	}
+
+	duration, err := time.ParseDuration(s)
+	if err != nil {
+		return fmt.Errorf("invalid duration %q", s)
+	}
+	*d = Duration(duration)
+	return nil
+}
+
+func (d Duration) String() string {
+	return time.Duration(d).String()
+}
+
+// Load reads and validates the configuration file at path. Its errors name
+// the file.
+func Load(path string) (*Config, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	config, err := Parse(data)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", path, err)
+	}
+	return config, nil
+}
+
+// Parse decodes and validates a configuration. JSON is accepted as well as
+// YAML. Unknown settings are rejected.
+func Parse(data []byte) (*Config, error) {
+	config := &Config{}
+	err := yaml.UnmarshalStrict(data, config)
+	if err != nil {
+		return nil, err
+	}
+
+	err = config.Validate()
+	if err != nil {
+		return nil, err
+	}
+	return config, nil
+}
+
+// Validate reports every invalid setting, each prefixed by its name.
+func (c *Config) Validate() error {
+	var problems []string
+	check := func(name string, err error) {
+		if err != nil {
+			problems = append(problems, fmt.Sprintf("%s: %s", name, err))
+		}
+	}
+	nonNegative := func(name string, value interface{}) {
+		switch v := value.(type) {
+		case *int:
+			if v != nil && *v < 0 {
+				check(name, fmt.Errorf("must not be negative, got %d", *v))
+			}
+		case *int64:
+			if v != nil && *v < 0 {
+				check(name, fmt.Errorf("must not be negative, got %d", *v))
+			}
+		case *float64:
+			if v != nil && *v < 0 {
+				check(name, fmt.Errorf("must not be negative, got %g", *v))
+			}
+		case *Duration:
+			if v != nil && *v < 0 {
+				check(name, fmt.Errorf("must not be negative, got %s", *v))
+			}
+		}
+	}
+
+	if c.FileEvents != nil {
+		_, err := notify.ParseBackend(*c.FileEvents)
+		check("file_events", err)
+	}
+	if c.LogFormat != nil {
+		_, err := retriever.ParseFormat(*c.LogFormat)
+		check("log_format", err)
+	}
+	if c.Backpressure != nil {
+		_, err := retriever.ParsePolicy(*c.Backpressure)
+		check("backpressure", err)
+	}
+	if c.UnmatchedContainers != nil {
+		_, err := proxy.ParseUnmatchedPolicy(*c.UnmatchedContainers)
+		check("unmatched_containers", err)
+	}
+
+	if c.Multiline.Pattern != nil {
+		_, err := regexp.Compile(*c.Multiline.Pattern)
+		check("multiline.pattern", err)
+	}
+	for appID, pattern := range c.Multiline.Apps {
+		_, err := regexp.Compile(pattern)
+		check("multiline.apps."+appID, err)
+	}
+
+	for i, root := range c.WatchRoots {
+		name := fmt.Sprintf("watch_roots[%d]", i)
+		if root.Dir == "" {
+			check(name+".dir", fmt.Errorf("must be set"))
+		}
+		for setting, value := range map[string]string{"dir": root.Dir, "pattern": root.Pattern, "format": root.Format, "metadata": root.Metadata} {
+			if strings.Contains(value, ",") {
+				check(name+"."+setting, fmt.Errorf("must not contain commas"))
+			}
+		}
+		if _, err := filepath.Match(root.Pattern, ""); err != nil {
+			check(name+".pattern", err)
+		}
+		if root.Format != "" {
+			_, err := retriever.ParseFormat(root.Format)
+			check(name+".format", err)
+		}
+		_, err := proxy.ParseMetadataStrategy(root.Metadata)
+		check(name+".metadata", err)
+		_, err = regexp.Compile(root.Names)
+		check(name+".names", err)
+	}
+
+	for i, rule := range c.SourceRules {
+		var err error
+		switch {
+		case (rule.Prefix == "") == (rule.Regexp == ""):
+			err = fmt.Errorf("exactly one of prefix and regexp must be set")
+		case rule.Source == "":
+			err = fmt.Errorf("source must be set")
+		default:
+			_, err = proxy.ParseSourceRule(rule.flag())
+		}
+		check(fmt.Sprintf("source_rules[%d]", i), err)
+	}
+
+	checkLimit := func(name string, limit Limit) {
+		nonNegative(name+".lines_per_second", limit.LinesPerSecond)
+		nonNegative(name+".line_burst", limit.LineBurst)
+		nonNegative(name+".bytes_per_second", limit.BytesPerSecond)
+		nonNegative(name+".byte_burst", limit.ByteBurst)
+	}
+	checkLimit("rate_limit", c.RateLimit.Limit)
+	for appID, limit := range c.RateLimit.Apps {
+		checkLimit("rate_limit.apps."+appID, limit)
+	}
+
+	for i, s := range c.Sinks {
+		switch {
+		case s == "loggregator" || s == "stdout" || strings.HasPrefix(s, "file://"):
+		case strings.HasPrefix(s, "syslog://") || strings.HasPrefix(s, "syslog-tls://"):
+			_, err := sink.ParseSyslogURL(s, nil)
+			check(fmt.Sprintf("sinks[%d]", i), err)
+		default:
+			check(fmt.Sprintf("sinks[%d]", i), fmt.Errorf("unknown sink %q", s))
+		}
+	}
+	for appID, drains := range c.Drains {
+		for i, drain := range drains {
+			check(fmt.Sprintf("drains.%s[%d]", appID, i), validateDrainURL(drain))
+		}
+	}
+	checkAddress := func(name string, address *string) {
+		if address != nil && *address != "" {
+			_, _, err := net.SplitHostPort(*address)
+			check(name, err)
+		}
+	}
+	checkAddress("operator_destination", c.OperatorDestination)
+	checkAddress("status_address", c.StatusAddress)
+
+	if c.DropsondePort != nil && (*c.DropsondePort < 1 || *c.DropsondePort > 65535) {
+		check("dropsonde_port", fmt.Errorf("must be between 1 and 65535, got %d", *c.DropsondePort))
+	}
+	if c.Loggregator.Address != nil && *c.Loggregator.Address != "" {
+		for name, path := range map[string]*string{"ca": c.Loggregator.CA, "cert": c.Loggregator.Cert, "key": c.Loggregator.Key} {
+			if path == nil || *path == "" {
+				check("loggregator."+name, fmt.Errorf("must be set with loggregator.address"))
+			}
+		}
+	}
+
+	nonNegative("poll_interval", c.PollInterval)
+	nonNegative("max_message_size", c.MaxMessageSize)
+	nonNegative("queue_size", c.QueueSize)
+	nonNegative("memory_budget", c.MemoryBudget)
+	nonNegative("multiline.timeout", c.Multiline.Timeout)
+	nonNegative("batch.window", c.Batch.Window)
+	nonNegative("batch.size", c.Batch.Size)
+	nonNegative("drain_buffer_size", c.DrainBufferSize)
+	nonNegative("checkpoints.interval", c.Checkpoints.Interval)
+	nonNegative("metrics_interval", c.MetricsInterval)
+	nonNegative("shutdown_timeout", c.ShutdownTimeout)
+
+	if len(problems) == 0 {
+		return nil
+	}
+	sort.Strings(problems)
+	return fmt.Errorf("invalid configuration:\n  %s", strings.Join(problems, "\n  "))
+}
+
+// validateDrainURL accepts the drain URLs sink.NewDrain accepts: https URLs
+// and syslog URLs with a port.
+func validateDrainURL(rawURL string) error {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return err
+	}
+	if u.Scheme == "https" {
+		if u.Host == "" {
+			return fmt.Errorf("drain URL %q has no host", rawURL)
+		}
+		return nil
+	}
+	_, err = sink.ParseSyslogURL(rawURL, nil)
+	return err
+}
+
+func (r WatchRoot) flag() string {
+	value := r.Dir
+	for _, setting := range []struct{ name, value string }{
+		{"pattern", r.Pattern},
+		{"format", r.Format},
+		{"metadata", r.Metadata},
+		{"names", r.Names},
+	} {
+		if setting.value != "" {
+			value += "," + setting.name + "=" + setting.value
+		}
+	}
+	return value
+}
+
+func (r SourceRule) flag() string {
+	if r.Regexp != "" {
+		return "regexp:" + r.Regexp + "=" + r.Source
+	}
+	return "prefix:" + r.Prefix + "=" + r.Source
+}
+
+// reloadable are the settings a running agent applies again when the file
+// changes. The others are only read when it starts.
+var reloadable = map[string]bool{
+	"rate_limit":           true,
+	"source_rules":         true,
+	"unmatched_containers": true,
+	"default_source":       true,
+	"operator_destination": true,
+	"sinks":                true,
+	"syslog_ca":            true,
+	"drains":               true,
+	"drains_file":          true,
+	"drain_buffer_size":    true,
+	"shutdown_timeout":     true,
+}
+
+// Unreloadable returns the names of the settings that differ from previous
+// and cannot be applied without restarting the agent.
+func (c *Config) Unreloadable(previous *Config) []string {
+	var names []string
+	current, old := reflect.ValueOf(*c), reflect.ValueOf(*previous)
+	for i := 0; i < current.NumField(); i++ {
+		name := strings.Split(current.Type().Field(i).Tag.Get("yaml"), ",")[0]
+		if !reloadable[name] && !reflect.DeepEqual(current.Field(i).Interface(), old.Field(i).Interface()) {
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+// Flag is the value of a command line flag given by the file. Repeatable
+// flags may have several values.
+type Flag struct {
+	Name   string
+	Values []string
+}
+
+// Flags returns the flags the file sets, in a fixed order.
+func (c *Config) Flags() []Flag {
+	var flags []Flag
+	add := func(name string, value interface{}) {
+		var s string
+		switch v := value.(type) {
+		case *string:
+			if v == nil {
+				return
+			}
+			s = *v
+		case *bool:
+			if v == nil {
+				return
+			}
+			s = strconv.FormatBool(*v)
+		case *int:
+			if v == nil {
+				return
+			}
+			s = strconv.Itoa(*v)
+		case *int64:
+			if v == nil {
+				return
+			}
+			s = strconv.FormatInt(*v, 10)
+		case *float64:
+			if v == nil {
+				return
+			}
+			s = strconv.FormatFloat(*v, 'g', -1, 64)
+		case *Duration:
+			if v == nil {
+				return
+			}
+			s = v.String()
+		}
+		flags = append(flags, Flag{Name: name, Values: []string{s}})
+	}
+	addAll := func(name string, values []string) {
+		if values != nil {
+			flags = append(flags, Flag{Name: name, Values: values})
+		}
+	}
+
+	add("logsDir", c.LogsDir)
+	if c.WatchRoots != nil {
+		var roots []string
+		for _, root := range c.WatchRoots {
+			roots = append(roots, root.flag())
+		}
+		addAll("watchRoot", roots)
+	}
+	add("recursive", c.Recursive)
+	add("followSymlinks", c.FollowSymlinks)
+	add("fileEvents", c.FileEvents)
+	add("pollInterval", c.PollInterval)
+
+	add("logFormat", c.LogFormat)
+	add("maxMessageSize", c.MaxMessageSize)
+	add("truncationMarker", c.TruncationMarker)
+
+	add("backpressure", c.Backpressure)
+	add("queueSize", c.QueueSize)
+	add("memoryBudget", c.MemoryBudget)
+
+	add("multilinePattern", c.Multiline.Pattern)
+	add("multilineTimeout", c.Multiline.Timeout)
+	if c.Multiline.Apps != nil {
+		var apps []string
+		for appID, pattern := range c.Multiline.Apps {
+			apps = append(apps, appID+"="+pattern)
+		}
+		sort.Strings(apps)
+		addAll("multilineApp", apps)
+	}
+
+	add("rateLimitLines", c.RateLimit.LinesPerSecond)
+	add("rateLimitLineBurst", c.RateLimit.LineBurst)
+	add("rateLimitBytes", c.RateLimit.BytesPerSecond)
+	add("rateLimitByteBurst", c.RateLimit.ByteBurst)
+
+	if c.SourceRules != nil {
+		var rules []string
+		for _, rule := range c.SourceRules {
+			rules = append(rules, rule.flag())
+		}
+		addAll("sourceRule", rules)
+	}
+	add("unmatchedContainers", c.UnmatchedContainers)
+	add("defaultSource", c.DefaultSource)
+	add("operatorDestination", c.OperatorDestination)
+
+	add("dropsondePort", c.DropsondePort)
+	add("loggregatorAddress", c.Loggregator.Address)
+	add("loggregatorCA", c.Loggregator.CA)
+	add("loggregatorCert", c.Loggregator.Cert)
+	add("loggregatorKey", c.Loggregator.Key)
+	add("loggregatorServerName", c.Loggregator.ServerName)
+	add("batchWindow", c.Batch.Window)
+	add("batchSize", c.Batch.Size)
+
+	addAll("sink", c.Sinks)
+	add("syslogCA", c.SyslogCA)
+	add("drainsFile", c.DrainsFile)
+	add("drainBufferSize", c.DrainBufferSize)
+
+	add("kubeMetadata", c.Kube.Metadata)
+	add("kubeconfig", c.Kube.Kubeconfig)
+	add("nodeName", c.Kube.NodeName)
+	add("checkpointFile", c.Checkpoints.File)
+	add("checkpointInterval", c.Checkpoints.Interval)
+
+	add("metricsInterval", c.MetricsInterval)
+	add("statusAddress", c.StatusAddress)
+	add("shutdownTimeout", c.ShutdownTimeout)
+
+	return flags
+}
+
+// AppRateLimits returns the rate limits of single apps.
+func (c *Config) AppRateLimits() map[string]*proxy.RateLimit {
+	if c.RateLimit.Apps == nil {
+		return nil
+	}
+
+	limits := map[string]*proxy.RateLimit{}
+	for appID, limit := range c.RateLimit.Apps {
+		// an app's limit of zero turns off the limit set for every app.
+		value := func(f *float64) float64 {
+			switch {
+			case f == nil:
+				return 0
+			case *f == 0:
+				return proxy.Unlimited
+			default:
+				return *f
+			}
+		}
+		limits[appID] = &proxy.RateLimit{
+			LinesPerSecond: value(limit.LinesPerSecond),
+			LineBurst:      value(limit.LineBurst),
+			BytesPerSecond: value(limit.BytesPerSecond),
+			ByteBurst:      value(limit.ByteBurst),
+		}
+	}
+	return limits
+}
@@ -0,0 +1,214 @@
+package config_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/cf-furnace/loggingAgent/config"
+	"github.com/cf-furnace/loggingAgent/proxy"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Config", func() {
+	Describe("Parse", func() {
+		It("reads YAML", func() {
+			cfg, err := config.Parse([]byte(`
+logs_dir: /var/log/pods
+recursive: true
+poll_interval: 2s
+multiline:
+  pattern: '^\s'
+  apps:
+    app-guid: '^\t'
+source_rules:
+- prefix: app-
+  source: APP
+- regexp: '^stg-.*'
+  source: STG
+loggregator:
+  address: localhost:3458
+  ca: ca.crt
+  cert: agent.crt
+  key: agent.key
+sinks: [loggregator, stdout]
+`))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(*cfg.LogsDir).To(Equal("/var/log/pods"))
+			Expect(*cfg.Recursive).To(BeTrue())
+			Expect(time.Duration(*cfg.PollInterval)).To(Equal(2 * time.Second))
+			Expect(cfg.FollowSymlinks).To(BeNil())
+			Expect(cfg.Multiline.Apps).To(HaveKeyWithValue("app-guid", `^\t`))
+			Expect(cfg.SourceRules).To(HaveLen(2))
+			Expect(*cfg.Loggregator.Address).To(Equal("localhost:3458"))
+		})
+
+		It("reads JSON", func() {
+			cfg, err := config.Parse([]byte(`{"queue_size": 10, "rate_limit": {"lines_per_second": 100}}`))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(*cfg.QueueSize).To(Equal(10))
+			Expect(*cfg.RateLimit.LinesPerSecond).To(Equal(100.0))
+		})
+
+		It("rejects unknown settings", func() {
+			_, err := config.Parse([]byte("logsdir: /tmp"))
+			Expect(err).To(MatchError(ContainSubstring("logsdir")))
+		})
+
+		It("rejects invalid durations", func() {
+			_, err := config.Parse([]byte("shutdown_timeout: soon"))
+			Expect(err).To(MatchError(ContainSubstring(`invalid duration "soon"`)))
+		})
+
+		It("reports every invalid setting", func() {
+			_, err := config.Parse([]byte(`
+log_format: xml
+queue_size: -1
+watch_roots:
+- metadata: pods
+  names: '(?P<pod'
+multiline:
+  pattern: '('
+source_rules:
+- source: APP
+dropsonde_port: 0
+loggregator:
+  address: localhost:3458
+sinks: [kafka://logs, syslog://logs.example.com]
+drains:
+  app-guid: [https://logs.example.com/app, 'syslog://logs.example.com']
+operator_destination: localhost
+status_address: localhost
+`))
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).To(HavePrefix("invalid configuration:\n"))
+			for _, name := range []string{
+				"log_format: ",
+				"queue_size: must not be negative, got -1",
+				"multiline.pattern: ",
+				"source_rules[0]: exactly one of prefix and regexp must be set",
+				"dropsonde_port: must be between 1 and 65535, got 0",
+				"watch_roots[0].dir: must be set",
+				`watch_roots[0].metadata: unknown metadata strategy "pods"`,
+				"watch_roots[0].names: error parsing regexp: invalid named capture: `(?P<pod`",
+				"loggregator.ca: must be set with loggregator.address",
+				`sinks[0]: unknown sink "kafka://logs"`,
+				`sinks[1]: syslog URL "syslog://logs.example.com" has no port`,
+				`drains.app-guid[1]: syslog URL "syslog://logs.example.com" has no port`,
+				"operator_destination: address localhost: missing port in address",
+				"status_address: address localhost: missing port in address",
+			} {
+				Expect(err.Error()).To(ContainSubstring("\n  " + name))
+			}
+			Expect(err.Error()).NotTo(ContainSubstring("drains.app-guid[0]"))
+		})
+	})
+
+	Describe("Load", func() {
+		var dir string
+
+		BeforeEach(func() {
+			var err error
+			dir, err = ioutil.TempDir("", "config")
+			Expect(err).NotTo(HaveOccurred())
+		})
+
+		AfterEach(func() {
+			os.RemoveAll(dir)
+		})
+
+		It("names the file in its errors", func() {
+			path := filepath.Join(dir, "agent.yml")
+			Expect(ioutil.WriteFile(path, []byte("queue_size: -1"), 0644)).To(Succeed())
+
+			_, err := config.Load(path)
+			Expect(err).To(MatchError(path + ": invalid configuration:\n  queue_size: must not be negative, got -1"))
+		})
+	})
+
+	Describe("Flags", func() {
+		It("returns the flags the file sets", func() {
+			cfg, err := config.Parse([]byte(`
+watch_roots:
+- dir: /var/log/pods
+  format: cri
+- dir: /var/log/node
+  pattern: '*.log'
+  metadata: node
+  names: '^(?P<container>[^,]+)$'
+recursive: false
+max_message_size: 1024
+multiline:
+  timeout: 500ms
+  apps:
+    b: 'y'
+    a: 'x'
+rate_limit:
+  bytes_per_second: 1.5
+source_rules:
+- regexp: '^ops-'
+  source: OPS
+sinks: [stdout]
+`))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(cfg.Flags()).To(Equal([]config.Flag{
+				{Name: "watchRoot", Values: []string{"/var/log/pods,format=cri", "/var/log/node,pattern=*.log,metadata=node,names=^(?P<container>[^,]+)$"}},
+				{Name: "recursive", Values: []string{"false"}},
+				{Name: "maxMessageSize", Values: []string{"1024"}},
+				{Name: "multilineTimeout", Values: []string{"500ms"}},
+				{Name: "multilineApp", Values: []string{"a=x", "b=y"}},
+				{Name: "rateLimitBytes", Values: []string{"1.5"}},
+				{Name: "sourceRule", Values: []string{"regexp:^ops-=OPS"}},
+				{Name: "sink", Values: []string{"stdout"}},
+			}))
+		})
+	})
+
+	Describe("Unreloadable", func() {
+		It("returns the changed settings that are only read at startup", func() {
+			previous, err := config.Parse([]byte(`
+queue_size: 10
+rate_limit:
+  lines_per_second: 10
+loggregator:
+  server_name: loggregator
+sinks: [stdout]
+`))
+			Expect(err).NotTo(HaveOccurred())
+			cfg, err := config.Parse([]byte(`
+queue_size: 20
+rate_limit:
+  lines_per_second: 20
+loggregator:
+  server_name: doppler
+sinks: [loggregator]
+`))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(cfg.Unreloadable(previous)).To(Equal([]string{"queue_size", "loggregator"}))
+			Expect(previous.Unreloadable(previous)).To(BeEmpty())
+		})
+	})
+
+	Describe("AppRateLimits", func() {
+		It("returns the limits of single apps", func() {
+			cfg, err := config.Parse([]byte(`
+rate_limit:
+  lines_per_second: 10
+  apps:
+    app-guid:
+      lines_per_second: 100
+      line_burst: 200
+    unlimited-guid:
+      lines_per_second: 0
+`))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(cfg.AppRateLimits()).To(Equal(map[string]*proxy.RateLimit{
+				"app-guid":       {LinesPerSecond: 100, LineBurst: 200},
+				"unlimited-guid": {LinesPerSecond: proxy.Unlimited},
+			}))
+		})
+	})
+})
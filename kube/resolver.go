@@ -0,0 +1,192 @@
+package kube
+
+import (
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/cf-furnace/loggingAgent/proxy"
+	"k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes"
+	corelisters "k8s.io/client-go/listers/core/v1"
+	"k8s.io/client-go/tools/cache"
+)
+
+// Labels and annotations read from Cloud Foundry pods. The instance index
+// and source type are looked up in both the labels and the annotations.
+const (
+	AppGUIDKey       = "cloudfoundry.org/app-guid"
+	InstanceIndexKey = "cloudfoundry.org/instance-index"
+	SourceTypeKey    = "cloudfoundry.org/source-type"
+)
+
+// Annotations overriding the rate limit of an app, in lines and bytes per
+// second. Zero turns the limit off for the app; values that are not numbers,
+// or are negative, are ignored.
+const (
+	RateLimitLinesKey = "cloudfoundry.org/log-rate-limit-lines"
+	RateLimitBytesKey = "cloudfoundry.org/log-rate-limit-bytes"
+)
+
+// SyslogDrainsKey is the annotation listing the syslog drain URLs of an app,
+// separated by commas or white space.
+const SyslogDrainsKey = "cloudfoundry.org/syslog-drain-urls"
+
+// InstanceIndexEnv are the container environment variables holding the
+// instance index, in the order they are checked.
+var InstanceIndexEnv = []string{"CF_INSTANCE_INDEX", "INSTANCE_INDEX"}
+
+// TagAnnotations maps pod annotations to the envelope tags they become.
+var TagAnnotations = map[string]string{
+	"cloudfoundry.org/app-name":   "app_name",
+	"cloudfoundry.org/space-guid": "space_id",
+	"cloudfoundry.org/space-name": "space_name",
+	"cloudfoundry.org/org-guid":   "organization_id",
+	"cloudfoundry.org/org-name":   "organization_name",
+}
+
+// Resolver supplies pod metadata from an informer cache of the pods
+// scheduled on a node.
+type Resolver struct {
+	factory  informers.SharedInformerFactory
+	informer cache.SharedIndexInformer
+	lister   corelisters.PodLister
+}
+
+// NewResolver creates a resolver for the pods on nodeName, or for every pod
+// when nodeName is empty.
+func NewResolver(clientset kubernetes.Interface, nodeName string, resync time.Duration) *Resolver {
+	factory := informers.NewSharedInformerFactoryWithOptions(clientset, resync,
+		informers.WithTweakListOptions(func(options *metav1.ListOptions) {
+			if nodeName != "" {
+				options.FieldSelector = fields.OneTermEqualSelector("spec.nodeName", nodeName).String()
+			}
+		}),
+	)
+
+	pods := factory.Core().V1().Pods()
+	return &Resolver{
+		factory:  factory,
+		informer: pods.Informer(),
+		lister:   pods.Lister(),
+	}
+}
+
+// Start fills the cache and keeps it up to date until stop is closed. It
+// reports whether the cache synced.
+func (r *Resolver) Start(stop <-chan struct{}) bool {
+	r.factory.Start(stop)
+	return cache.WaitForCacheSync(stop, r.informer.HasSynced)
+}
+
+func (r *Resolver) Resolve(namespace, podName, container string) (proxy.Metadata, bool) {
+	pod, err := r.lister.Pods(namespace).Get(podName)
+	if err != nil {
+		return proxy.Metadata{}, false
+	}
+
+	meta := proxy.Metadata{
+		AppID:         lookup(pod, AppGUIDKey),
+		InstanceIndex: lookup(pod, InstanceIndexKey),
+		SourceType:    lookup(pod, SourceTypeKey),
+	}
+
+	if meta.InstanceIndex == "" {
+		meta.InstanceIndex = envIndex(pod, container)
+	}
+	if meta.InstanceIndex == "" {
+		meta.InstanceIndex = statefulSetOrdinal(pod)
+	}
+
+	for annotation, tag := range TagAnnotations {
+		if value, ok := pod.Annotations[annotation]; ok {
+			if meta.Tags == nil {
+				meta.Tags = map[string]string{}
+			}
+			meta.Tags[tag] = value
+		}
+	}
+
+	meta.RateLimit = rateLimit(pod)
+	if drains, ok := pod.Annotations[SyslogDrainsKey]; ok {
+		meta.Drains = strings.FieldsFunc(drains, func(r rune) bool {
+			return r == ',' || unicode.IsSpace(r)
+		})
+	}
+
+	return meta, true
+}
+
+// rateLimit returns the rate limit set by the pod's annotations, or nil if
+// there is none.
+func rateLimit(pod *v1.Pod) *proxy.RateLimit {
+	var limit proxy.RateLimit
+	for key, rate := range map[string]*float64{
+		RateLimitLinesKey: &limit.LinesPerSecond,
+		RateLimitBytesKey: &limit.BytesPerSecond,
+	} {
+		value, err := strconv.ParseFloat(pod.Annotations[key], 64)
+		switch {
+		case err != nil:
+		case value > 0:
+			*rate = value
+		case value == 0:
+			*rate = proxy.Unlimited
+		}
+	}
+
+	if limit == (proxy.RateLimit{}) {
+		return nil
+	}
+	return &limit
+}
+
+func lookup(pod *v1.Pod, key string) string {
+	if value, ok := pod.Labels[key]; ok {
+		return value
+	}
+	return pod.Annotations[key]
+}
+
+// statefulSetOrdinal returns the ordinal a StatefulSet gives its pod at the
+// end of its name, as in "web-2". The pods of other controllers end in a
+// random suffix instead, which can be made of digits too.
+func statefulSetOrdinal(pod *v1.Pod) string {
+	owner := metav1.GetControllerOf(pod)
+	if owner == nil || owner.Kind != "StatefulSet" {
+		return ""
+	}
+
+	i := strings.LastIndexByte(pod.Name, '-')
+	if i == -1 {
+		return ""
+	}
+	if _, err := strconv.ParseUint(pod.Name[i+1:], 10, 32); err != nil {
+		return ""
+	}
+	return pod.Name[i+1:]
+}
+
+// envIndex returns the instance index set as a literal environment variable
+// on the container. Log file names may carry the container ID after the
+// container name.
+func envIndex(pod *v1.Pod, container string) string {
+	for _, c := range pod.Spec.Containers {
+		if c.Name != container && !strings.HasPrefix(container, c.Name+"-") {
+			continue
+		}
+
+		for _, name := range InstanceIndexEnv {
+			for _, env := range c.Env {
+				if env.Name == name && env.Value != "" {
+					return env.Value
+				}
+			}
+		}
+	}
+	return ""
+}
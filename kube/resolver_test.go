@@ -0,0 +1,198 @@
+package kube_test
+
+import (
+	"context"
+	"time"
+
+	"github.com/cf-furnace/loggingAgent/kube"
+	"github.com/cf-furnace/loggingAgent/proxy"
+	"k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Resolver", func() {
+	var (
+		pod       *v1.Pod
+		clientset *fake.Clientset
+		stop      chan struct{}
+
+		resolver *kube.Resolver
+	)
+
+	BeforeEach(func() {
+		pod = &v1.Pod{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      "pod",
+				Namespace: "namespace",
+				Labels: map[string]string{
+					kube.AppGUIDKey: "app-guid",
+				},
+				Annotations: map[string]string{
+					kube.SourceTypeKey:            "TASK",
+					"cloudfoundry.org/space-name": "dev",
+					"cloudfoundry.org/org-name":   "org",
+				},
+			},
+			Spec: v1.PodSpec{
+				NodeName: "node",
+				Containers: []v1.Container{{
+					Name: "application-cnr",
+					Env:  []v1.EnvVar{{Name: "CF_INSTANCE_INDEX", Value: "3"}},
+				}},
+			},
+		}
+		stop = make(chan struct{})
+	})
+
+	JustBeforeEach(func() {
+		clientset = fake.NewSimpleClientset(pod)
+		resolver = kube.NewResolver(clientset, "node", time.Minute)
+		Expect(resolver.Start(stop)).To(BeTrue())
+	})
+
+	AfterEach(func() {
+		close(stop)
+	})
+
+	It("resolves metadata from labels, annotations and the environment", func() {
+		meta, ok := resolver.Resolve("namespace", "pod", "application-cnr")
+		Expect(ok).To(BeTrue())
+		Expect(meta).To(Equal(proxy.Metadata{
+			AppID:         "app-guid",
+			InstanceIndex: "3",
+			SourceType:    "TASK",
+			Tags: map[string]string{
+				"space_name":        "dev",
+				"organization_name": "org",
+			},
+		}))
+	})
+
+	It("matches containers whose log name carries the container ID", func() {
+		meta, ok := resolver.Resolve("namespace", "pod", "application-cnr-0123abcd")
+		Expect(ok).To(BeTrue())
+		Expect(meta.InstanceIndex).To(Equal("3"))
+	})
+
+	Context("when the instance index is labelled", func() {
+		BeforeEach(func() {
+			pod.Labels[kube.InstanceIndexKey] = "5"
+		})
+
+		It("prefers the label", func() {
+			meta, ok := resolver.Resolve("namespace", "pod", "application-cnr")
+			Expect(ok).To(BeTrue())
+			Expect(meta.InstanceIndex).To(Equal("5"))
+		})
+	})
+
+	Context("when the pod belongs to a StatefulSet", func() {
+		BeforeEach(func() {
+			pod.Name = "web-2"
+			pod.Spec.Containers[0].Env = nil
+			pod.OwnerReferences = []metav1.OwnerReference{{
+				Kind:       "StatefulSet",
+				Name:       "web",
+				Controller: &[]bool{true}[0],
+			}}
+		})
+
+		It("uses its ordinal", func() {
+			meta, ok := resolver.Resolve("namespace", "web-2", "application-cnr")
+			Expect(ok).To(BeTrue())
+			Expect(meta.InstanceIndex).To(Equal("2"))
+		})
+
+		Context("when the environment sets the index", func() {
+			BeforeEach(func() {
+				pod.Spec.Containers[0].Env = []v1.EnvVar{{Name: "CF_INSTANCE_INDEX", Value: "3"}}
+			})
+
+			It("prefers the environment", func() {
+				meta, ok := resolver.Resolve("namespace", "web-2", "application-cnr")
+				Expect(ok).To(BeTrue())
+				Expect(meta.InstanceIndex).To(Equal("3"))
+			})
+		})
+	})
+
+	Context("when the pod belongs to a ReplicaSet", func() {
+		BeforeEach(func() {
+			pod.Name = "web-5d8c7b9f64-12345"
+			pod.Spec.Containers[0].Env = nil
+			pod.OwnerReferences = []metav1.OwnerReference{{
+				Kind:       "ReplicaSet",
+				Name:       "web-5d8c7b9f64",
+				Controller: &[]bool{true}[0],
+			}}
+		})
+
+		It("does not take the name's suffix for an ordinal", func() {
+			meta, ok := resolver.Resolve("namespace", "web-5d8c7b9f64-12345", "application-cnr")
+			Expect(ok).To(BeTrue())
+			Expect(meta.InstanceIndex).To(BeEmpty())
+		})
+	})
+
+	Context("when the pod overrides the log rate limit", func() {
+		BeforeEach(func() {
+			pod.Annotations[kube.RateLimitLinesKey] = "100"
+			pod.Annotations[kube.RateLimitBytesKey] = "not-a-number"
+		})
+
+		It("resolves the valid limits", func() {
+			meta, ok := resolver.Resolve("namespace", "pod", "application-cnr")
+			Expect(ok).To(BeTrue())
+			Expect(meta.RateLimit).To(Equal(&proxy.RateLimit{LinesPerSecond: 100}))
+		})
+	})
+
+	Context("when the pod turns the log rate limit off", func() {
+		BeforeEach(func() {
+			pod.Annotations[kube.RateLimitLinesKey] = "0"
+		})
+
+		It("resolves an unlimited rate", func() {
+			meta, ok := resolver.Resolve("namespace", "pod", "application-cnr")
+			Expect(ok).To(BeTrue())
+			Expect(meta.RateLimit).To(Equal(&proxy.RateLimit{LinesPerSecond: proxy.Unlimited}))
+		})
+	})
+
+	Context("when the pod has syslog drains", func() {
+		BeforeEach(func() {
+			pod.Annotations[kube.SyslogDrainsKey] = "syslog://one.example.com:514, https://two.example.com/logs\n"
+		})
+
+		It("resolves their URLs", func() {
+			meta, ok := resolver.Resolve("namespace", "pod", "application-cnr")
+			Expect(ok).To(BeTrue())
+			Expect(meta.Drains).To(Equal([]string{"syslog://one.example.com:514", "https://two.example.com/logs"}))
+		})
+	})
+
+	Context("when the pod is not known", func() {
+		It("reports that it cannot resolve it", func() {
+			_, ok := resolver.Resolve("namespace", "other", "application-cnr")
+			Expect(ok).To(BeFalse())
+		})
+	})
+
+	Context("when a pod is added later", func() {
+		It("resolves it once the cache catches up", func() {
+			other := pod.DeepCopy()
+			other.Name = "other"
+			_, err := clientset.CoreV1().Pods("namespace").Create(context.Background(), other, metav1.CreateOptions{})
+			Expect(err).NotTo(HaveOccurred())
+
+			Eventually(func() bool {
+				_, ok := resolver.Resolve("namespace", "other", "application-cnr")
+				return ok
+			}).Should(BeTrue())
+		})
+	})
+})
@@ -0,0 +1,193 @@
+// Package loggregator emits logs to the v2 gRPC ingress of a loggregator
+// agent.
+package loggregator
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"sync"
+
+	"code.cloudfoundry.org/go-loggregator/rpc/loggregator_v2"
+	"code.cloudfoundry.org/lager"
+
+	"github.com/cloudfoundry/dropsonde/emitter"
+	"github.com/cloudfoundry/sonde-go/events"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+)
+
+// DefaultServerName is the name in the certificate of a loggregator agent.
+const DefaultServerName = "metron"
+
+// NewTLSConfig creates a TLS configuration presenting the certificate and
+// key, and trusting servers named serverName that are signed by the CA.
+func NewTLSConfig(caPath, certPath, keyPath, serverName string) (*tls.Config, error) {
+	cert, err := tls.LoadX509KeyPair(certPath, keyPath)
+	if err != nil {
+		return nil, err
+	}
+
+	caPEM, err := ioutil.ReadFile(caPath)
+	if err != nil {
+		return nil, err
+	}
+
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(caPEM) {
+		return nil, fmt.Errorf("no certificates in %s", caPath)
+	}
+
+	return &tls.Config{
+		ServerName:   serverName,
+		Certificates: []tls.Certificate{cert},
+		RootCAs:      pool,
+		MinVersion:   tls.VersionTLS12,
+	}, nil
+}
+
+// Emitter converts log messages into v2 envelopes and streams them to the
+// ingress at an address. It implements dropsonde.EventEmitter and
+// proxy.BatchEmitter.
+type Emitter struct {
+	logger lager.Logger
+	origin string
+	conn   *grpc.ClientConn
+	client loggregator_v2.IngressClient
+
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	mu     sync.Mutex
+	stream loggregator_v2.Ingress_BatchSenderClient
+}
+
+// New creates an emitter for the ingress at address. It connects in the
+// background and again whenever the stream breaks.
+func New(logger lager.Logger, address string, tlsConfig *tls.Config, origin string) (*Emitter, error) {
+	conn, err := grpc.Dial(address, grpc.WithTransportCredentials(credentials.NewTLS(tlsConfig)))
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	return &Emitter{
+		logger: logger.Session("loggregator-emitter", lager.Data{"address": address}),
+		origin: origin,
+		conn:   conn,
+		client: loggregator_v2.NewIngressClient(conn),
+		ctx:    ctx,
+		cancel: cancel,
+	}, nil
+}
+
+func (e *Emitter) Origin() string {
+	return e.origin
+}
+
+func (e *Emitter) Emit(event events.Event) error {
+	envelope, err := emitter.Wrap(event, e.origin)
+	if err != nil {
+		return err
+	}
+	return e.EmitEnvelope(envelope)
+}
+
+func (e *Emitter) EmitEnvelope(envelope *events.Envelope) error {
+	return e.EmitBatch([]*events.Envelope{envelope})
+}
+
+// EmitBatch sends the envelopes as one batch. Envelopes that are not log
+// messages are rejected.
+func (e *Emitter) EmitBatch(envelopes []*events.Envelope) error {
+	batch := &loggregator_v2.EnvelopeBatch{}
+	for _, envelope := range envelopes {
+		v2, err := Convert(envelope)
+		if err != nil {
+			return err
+		}
+		batch.Batch = append(batch.Batch, v2)
+	}
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	if e.stream == nil {
+		stream, err := e.client.BatchSender(e.ctx)
+		if err != nil {
+			e.logger.Error("failed-to-open-stream", err)
+			return err
+		}
+		e.stream = stream
+	}
+
+	err := e.stream.Send(batch)
+	if err != nil {
+		// Send only reports that the stream is broken; the reason comes
+		// from CloseAndRecv.
+		if err == io.EOF {
+			_, err = e.stream.CloseAndRecv()
+		}
+		e.logger.Error("failed-to-send", err)
+		e.stream = nil
+		return err
+	}
+	return nil
+}
+
+// Close ends the stream and closes the connection.
+func (e *Emitter) Close() error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	if e.stream != nil {
+		_, err := e.stream.CloseAndRecv()
+		if err != nil && err != io.EOF {
+			e.logger.Error("failed-to-close-stream", err)
+		}
+		e.stream = nil
+	}
+
+	e.cancel()
+	return e.conn.Close()
+}
+
+// Convert returns the v2 form of a log message envelope. The app GUID
+// becomes the source ID and the source instance the instance ID, while the
+// source type and origin join the envelope's tags.
+func Convert(envelope *events.Envelope) (*loggregator_v2.Envelope, error) {
+	msg := envelope.GetLogMessage()
+	if msg == nil {
+		return nil, errors.New("unsupported-event-type")
+	}
+
+	logType := loggregator_v2.Log_OUT
+	if msg.GetMessageType() == events.LogMessage_ERR {
+		logType = loggregator_v2.Log_ERR
+	}
+
+	tags := map[string]string{
+		"source_type": msg.GetSourceType(),
+		"origin":      envelope.GetOrigin(),
+	}
+	for key, value := range envelope.GetTags() {
+		tags[key] = value
+	}
+
+	return &loggregator_v2.Envelope{
+		Timestamp:  msg.GetTimestamp(),
+		SourceId:   msg.GetAppId(),
+		InstanceId: msg.GetSourceInstance(),
+		Tags:       tags,
+		Message: &loggregator_v2.Envelope_Log{
+			Log: &loggregator_v2.Log{
+				Payload: msg.GetMessage(),
+				Type:    logType,
+			},
+		},
+	}, nil
+}
@@ -0,0 +1,205 @@
+package loggregator_test
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net"
+	"sync"
+
+	"code.cloudfoundry.org/go-loggregator/rpc/loggregator_v2"
+	"code.cloudfoundry.org/lager/lagertest"
+	"github.com/cf-furnace/loggingAgent/loggregator"
+	"github.com/cloudfoundry/sonde-go/events"
+	"github.com/gogo/protobuf/proto"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Emitter", func() {
+	var (
+		ingress *fakeIngress
+		server  *grpc.Server
+		address string
+
+		emitter *loggregator.Emitter
+	)
+
+	BeforeEach(func() {
+		cert, err := tls.LoadX509KeyPair(certPath("metron"), keyPath("metron"))
+		Expect(err).NotTo(HaveOccurred())
+		caPEM, err := ioutil.ReadFile(certPath("ca"))
+		Expect(err).NotTo(HaveOccurred())
+		pool := x509.NewCertPool()
+		Expect(pool.AppendCertsFromPEM(caPEM)).To(BeTrue())
+
+		listener, err := net.Listen("tcp", "127.0.0.1:0")
+		Expect(err).NotTo(HaveOccurred())
+		address = listener.Addr().String()
+
+		ingress = &fakeIngress{}
+		server = grpc.NewServer(grpc.Creds(credentials.NewTLS(&tls.Config{
+			Certificates: []tls.Certificate{cert},
+			ClientCAs:    pool,
+			ClientAuth:   tls.RequireAndVerifyClientCert,
+		})))
+		loggregator_v2.RegisterIngressServer(server, ingress)
+		go server.Serve(listener)
+
+		tlsConfig, err := loggregator.NewTLSConfig(certPath("ca"), certPath("agent"), keyPath("agent"), "metron")
+		Expect(err).NotTo(HaveOccurred())
+
+		emitter, err = loggregator.New(lagertest.NewTestLogger(""), address, tlsConfig, "origin")
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	AfterEach(func() {
+		emitter.Close()
+		server.Stop()
+	})
+
+	logEnvelope := func(text string) *events.Envelope {
+		return &events.Envelope{
+			Origin:    proto.String("origin"),
+			EventType: events.Envelope_LogMessage.Enum(),
+			Tags:      map[string]string{"space_name": "dev"},
+			LogMessage: &events.LogMessage{
+				Message:        []byte(text),
+				MessageType:    events.LogMessage_ERR.Enum(),
+				Timestamp:      proto.Int64(1257894000000000000),
+				AppId:          proto.String("app-guid"),
+				SourceType:     proto.String("APP"),
+				SourceInstance: proto.String("3"),
+			},
+		}
+	}
+
+	It("streams log messages as v2 envelopes", func() {
+		Expect(emitter.EmitEnvelope(logEnvelope("a message"))).To(Succeed())
+
+		Eventually(ingress.getEnvelopes).Should(HaveLen(1))
+		envelope := ingress.getEnvelopes()[0]
+		Expect(envelope.SourceId).To(Equal("app-guid"))
+		Expect(envelope.InstanceId).To(Equal("3"))
+		Expect(envelope.Timestamp).To(Equal(int64(1257894000000000000)))
+		Expect(envelope.Tags).To(Equal(map[string]string{
+			"source_type": "APP",
+			"origin":      "origin",
+			"space_name":  "dev",
+		}))
+		Expect(envelope.GetLog().Payload).To(Equal([]byte("a message")))
+		Expect(envelope.GetLog().Type).To(Equal(loggregator_v2.Log_ERR))
+	})
+
+	It("wraps events with its origin", func() {
+		Expect(emitter.Emit(logEnvelope("a message").LogMessage)).To(Succeed())
+
+		Eventually(ingress.getEnvelopes).Should(HaveLen(1))
+		Expect(ingress.getEnvelopes()[0].Tags).To(HaveKeyWithValue("origin", "origin"))
+	})
+
+	It("sends batches whole", func() {
+		Expect(emitter.EmitBatch([]*events.Envelope{logEnvelope("a"), logEnvelope("b")})).To(Succeed())
+
+		Eventually(ingress.getBatches).Should(HaveLen(1))
+		Expect(ingress.getBatches()[0]).To(Equal(2))
+	})
+
+	It("rejects events other than log messages", func() {
+		err := emitter.Emit(&events.ValueMetric{Name: proto.String("metric")})
+		Expect(err).To(MatchError("unsupported-event-type"))
+	})
+
+	Context("when the stream breaks", func() {
+		It("opens another one", func() {
+			ingress.fail()
+			Expect(emitter.EmitEnvelope(logEnvelope("a"))).To(Succeed())
+			Eventually(func() error { return emitter.EmitEnvelope(logEnvelope("b")) }).Should(HaveOccurred())
+
+			Expect(emitter.EmitEnvelope(logEnvelope("c"))).To(Succeed())
+			Eventually(ingress.getEnvelopes).Should(ContainElement(
+				WithTransform(func(e *loggregator_v2.Envelope) string { return string(e.GetLog().Payload) }, Equal("c")),
+			))
+		})
+	})
+})
+
+var _ = Describe("NewTLSConfig", func() {
+	It("fails when a file is missing", func() {
+		_, err := loggregator.NewTLSConfig(certPath("missing"), certPath("agent"), keyPath("agent"), "metron")
+		Expect(err).To(HaveOccurred())
+	})
+
+	It("fails when the CA file has no certificates", func() {
+		_, err := loggregator.NewTLSConfig(keyPath("agent"), certPath("agent"), keyPath("agent"), "metron")
+		Expect(err).To(HaveOccurred())
+	})
+})
+
+type fakeIngress struct {
+	mu        sync.Mutex
+	envelopes []*loggregator_v2.Envelope
+	batches   []int
+	failNext  bool
+}
+
+// fail makes the next stream end after its first batch.
+func (f *fakeIngress) fail() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.failNext = true
+}
+
+func (f *fakeIngress) record(batch []*loggregator_v2.Envelope) bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.envelopes = append(f.envelopes, batch...)
+	f.batches = append(f.batches, len(batch))
+
+	failed := f.failNext
+	f.failNext = false
+	return failed
+}
+
+func (f *fakeIngress) Sender(stream loggregator_v2.Ingress_SenderServer) error {
+	return errors.New("not implemented")
+}
+
+func (f *fakeIngress) BatchSender(stream loggregator_v2.Ingress_BatchSenderServer) error {
+	for {
+		batch, err := stream.Recv()
+		if err == io.EOF {
+			return stream.SendAndClose(&loggregator_v2.BatchSenderResponse{})
+		}
+		if err != nil {
+			return err
+		}
+
+		if f.record(batch.Batch) {
+			return errors.New("stream failed")
+		}
+	}
+}
+
+func (f *fakeIngress) Send(ctx context.Context, batch *loggregator_v2.EnvelopeBatch) (*loggregator_v2.SendResponse, error) {
+	f.record(batch.Batch)
+	return &loggregator_v2.SendResponse{}, nil
+}
+
+func (f *fakeIngress) getEnvelopes() []*loggregator_v2.Envelope {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]*loggregator_v2.Envelope{}, f.envelopes...)
+}
+
+func (f *fakeIngress) getBatches() []int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]int{}, f.batches...)
+}
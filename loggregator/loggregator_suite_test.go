@@ -0,0 +1,86 @@
+package loggregator_test
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path/filepath"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"testing"
+)
+
+var tmpDir string
+
+func TestLoggregator(t *testing.T) {
+	RegisterFailHandler(Fail)
+	RunSpecs(t, "Loggregator Suite")
+}
+
+var _ = BeforeSuite(func() {
+	var err error
+	tmpDir, err = ioutil.TempDir("", "loggregator")
+	Expect(err).NotTo(HaveOccurred())
+
+	ca, caKey := writeCert("ca", nil, nil)
+	writeCert("metron", ca, caKey)
+	writeCert("agent", ca, caKey)
+})
+
+var _ = AfterSuite(func() {
+	os.RemoveAll(tmpDir)
+})
+
+func certPath(name string) string {
+	return filepath.Join(tmpDir, name+".crt")
+}
+
+func keyPath(name string) string {
+	return filepath.Join(tmpDir, name+".key")
+}
+
+// writeCert writes a certificate for name and its key to tmpDir. The
+// certificate is signed by ca, or is a CA itself when ca is nil.
+func writeCert(name string, ca *x509.Certificate, caKey *ecdsa.PrivateKey) (*x509.Certificate, *ecdsa.PrivateKey) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	Expect(err).NotTo(HaveOccurred())
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: name},
+		DNSNames:     []string{name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	if ca == nil {
+		template.IsCA = true
+		template.BasicConstraintsValid = true
+		template.KeyUsage |= x509.KeyUsageCertSign
+		ca, caKey = template, key
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, ca, &key.PublicKey, caKey)
+	Expect(err).NotTo(HaveOccurred())
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	Expect(err).NotTo(HaveOccurred())
+
+	err = ioutil.WriteFile(certPath(name), pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600)
+	Expect(err).NotTo(HaveOccurred())
+	err = ioutil.WriteFile(keyPath(name), pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600)
+	Expect(err).NotTo(HaveOccurred())
+
+	cert, err := x509.ParseCertificate(der)
+	Expect(err).NotTo(HaveOccurred())
+	return cert, key
+}
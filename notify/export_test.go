@@ -0,0 +1,25 @@
+package notify
+
+import "github.com/fsnotify/fsnotify"
+
+// SetNewFSWatcher replaces the function creating inotify watchers and returns
+// a function restoring it.
+func SetNewFSWatcher(f func() (*fsnotify.Watcher, error)) func() {
+	old := newFSWatcher
+	newFSWatcher = f
+	return func() {
+		newFSWatcher = old
+	}
+}
+
+// Polling reports whether w is an auto watcher that has started polling.
+func Polling(w Watcher) bool {
+	auto, ok := w.(*autoWatcher)
+	if !ok {
+		return false
+	}
+
+	auto.mu.Lock()
+	defer auto.mu.Unlock()
+	return auto.poller != nil
+}
@@ -0,0 +1,87 @@
+package notify
+
+import (
+	"sync"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+var newFSWatcher = fsnotify.NewWatcher
+
+// inotifyWatcher passes on the events of an fsnotify watcher.
+type inotifyWatcher struct {
+	watcher *fsnotify.Watcher
+
+	events chan Event
+	errors chan error
+
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+func newInotify(events chan Event, errs chan error) (*inotifyWatcher, error) {
+	watcher, err := newFSWatcher()
+	if err != nil {
+		return nil, err
+	}
+
+	w := &inotifyWatcher{
+		watcher: watcher,
+		events:  events,
+		errors:  errs,
+		done:    make(chan struct{}),
+	}
+	go w.run()
+
+	return w, nil
+}
+
+func (w *inotifyWatcher) run() {
+	for {
+		select {
+		case event, ok := <-w.watcher.Events:
+			if !ok {
+				return
+			}
+			select {
+			case w.events <- Event{Name: event.Name, Op: Op(event.Op)}:
+			case <-w.done:
+				return
+			}
+		case err, ok := <-w.watcher.Errors:
+			if !ok {
+				return
+			}
+			select {
+			case w.errors <- err:
+			case <-w.done:
+				return
+			}
+		}
+	}
+}
+
+func (w *inotifyWatcher) Add(name string) error {
+	return w.watcher.Add(name)
+}
+
+func (w *inotifyWatcher) Remove(name string) error {
+	return w.watcher.Remove(name)
+}
+
+func (w *inotifyWatcher) Events() <-chan Event {
+	return w.events
+}
+
+func (w *inotifyWatcher) Errors() <-chan error {
+	return w.errors
+}
+
+func (w *inotifyWatcher) Close() error {
+	var err error
+	w.closeOnce.Do(func() {
+		close(w.done)
+		err = w.watcher.Close()
+	})
+	return err
+}
@@ -0,0 +1,255 @@
+package notify
+
+import (
+	"path/filepath"
+	"sync"
+)
+
+// Mux shares one Watcher between many subscribers. Each subscriber receives
+// the events for the paths it added, and every error. An error does not stop
+// the Mux; it tells the subscribers that events may have been lost.
+type Mux struct {
+	watcher Watcher
+
+	mu   sync.Mutex
+	subs map[string]map[*subscription]struct{}
+
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+// NewMux creates a Mux using a watcher created with opts.
+func NewMux(opts Options) (*Mux, error) {
+	watcher, err := New(opts)
+	if err != nil {
+		return nil, err
+	}
+
+	return Share(watcher), nil
+}
+
+// Share creates a Mux handing out subscriptions to watcher. Closing the Mux
+// closes watcher.
+func Share(watcher Watcher) *Mux {
+	m := &Mux{
+		watcher: watcher,
+		subs:    map[string]map[*subscription]struct{}{},
+		done:    make(chan struct{}),
+	}
+	go m.run()
+
+	return m
+}
+
+// Watcher returns a new subscriber. Closing it removes its paths without
+// affecting the other subscribers.
+func (m *Mux) Watcher() Watcher {
+	s := &subscription{
+		mux:     m,
+		events:  make(chan Event),
+		errors:  make(chan error, 1),
+		paths:   map[string]struct{}{},
+		pending: map[string]Op{},
+		wake:    make(chan struct{}, 1),
+		done:    make(chan struct{}),
+	}
+	go s.run()
+
+	return s
+}
+
+// Close stops the shared watcher.
+func (m *Mux) Close() error {
+	var err error
+	m.closeOnce.Do(func() {
+		close(m.done)
+		err = m.watcher.Close()
+	})
+	return err
+}
+
+func (m *Mux) run() {
+	for {
+		select {
+		case event := <-m.watcher.Events():
+			m.mu.Lock()
+			// events for a watched directory name the file that changed.
+			for _, name := range []string{event.Name, filepath.Dir(event.Name)} {
+				for s := range m.subs[name] {
+					s.deliver(event)
+				}
+			}
+			m.mu.Unlock()
+		case err := <-m.watcher.Errors():
+			m.mu.Lock()
+			delivered := map[*subscription]struct{}{}
+			for _, subs := range m.subs {
+				for s := range subs {
+					if _, ok := delivered[s]; !ok {
+						s.fail(err)
+						delivered[s] = struct{}{}
+					}
+				}
+			}
+			m.mu.Unlock()
+		case <-m.done:
+			return
+		}
+	}
+}
+
+func (m *Mux) add(s *subscription, name string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, ok := m.subs[name][s]; ok {
+		return nil
+	}
+
+	if len(m.subs[name]) == 0 {
+		err := m.watcher.Add(name)
+		if err != nil {
+			return err
+		}
+		m.subs[name] = map[*subscription]struct{}{}
+	}
+	m.subs[name][s] = struct{}{}
+	return nil
+}
+
+func (m *Mux) remove(s *subscription, name string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, ok := m.subs[name][s]; !ok {
+		return nil
+	}
+
+	delete(m.subs[name], s)
+	if len(m.subs[name]) > 0 {
+		return nil
+	}
+	delete(m.subs, name)
+	return m.watcher.Remove(name)
+}
+
+// subscription queues the events of its paths so that a slow subscriber
+// does not hold up the others. Queued events for the same path are merged.
+type subscription struct {
+	mux *Mux
+
+	events chan Event
+	errors chan error
+
+	mu      sync.Mutex
+	paths   map[string]struct{}
+	pending map[string]Op
+	order   []string
+
+	wake      chan struct{}
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+func (s *subscription) Add(name string) error {
+	err := s.mux.add(s, name)
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	s.paths[name] = struct{}{}
+	s.mu.Unlock()
+	return nil
+}
+
+func (s *subscription) Remove(name string) error {
+	s.mu.Lock()
+	delete(s.paths, name)
+	s.mu.Unlock()
+
+	return s.mux.remove(s, name)
+}
+
+func (s *subscription) Events() <-chan Event {
+	return s.events
+}
+
+func (s *subscription) Errors() <-chan error {
+	return s.errors
+}
+
+func (s *subscription) Close() error {
+	s.closeOnce.Do(func() {
+		s.mu.Lock()
+		paths := s.paths
+		s.paths = map[string]struct{}{}
+		s.mu.Unlock()
+
+		for name := range paths {
+			s.mux.remove(s, name)
+		}
+		close(s.done)
+	})
+	return nil
+}
+
+func (s *subscription) deliver(event Event) {
+	s.mu.Lock()
+	if op, ok := s.pending[event.Name]; ok {
+		s.pending[event.Name] = op | event.Op
+	} else {
+		s.pending[event.Name] = event.Op
+		s.order = append(s.order, event.Name)
+	}
+	s.mu.Unlock()
+
+	select {
+	case s.wake <- struct{}{}:
+	default:
+	}
+}
+
+// fail passes on err unless an earlier error has not been received yet.
+func (s *subscription) fail(err error) {
+	select {
+	case s.errors <- err:
+	default:
+	}
+}
+
+func (s *subscription) next() (Event, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if len(s.order) == 0 {
+		return Event{}, false
+	}
+
+	name := s.order[0]
+	s.order = s.order[1:]
+	op := s.pending[name]
+	delete(s.pending, name)
+	return Event{Name: name, Op: op}, true
+}
+
+func (s *subscription) run() {
+	for {
+		select {
+		case <-s.wake:
+			for event, ok := s.next(); ok; event, ok = s.next() {
+				select {
+				case s.events <- event:
+				case <-s.done:
+					return
+				case <-s.mux.done:
+					return
+				}
+			}
+		case <-s.done:
+			return
+		case <-s.mux.done:
+			return
+		}
+	}
+}
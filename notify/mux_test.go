@@ -0,0 +1,85 @@
+package notify_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/cf-furnace/loggingAgent/notify"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Mux", func() {
+	var (
+		tmpDir       string
+		mux          *notify.Mux
+		first, other notify.Watcher
+		firstName    string
+		otherName    string
+	)
+
+	BeforeEach(func() {
+		var err error
+		tmpDir, err = ioutil.TempDir("", "mux")
+		Expect(err).NotTo(HaveOccurred())
+
+		firstName = filepath.Join(tmpDir, "first.log")
+		otherName = filepath.Join(tmpDir, "other.log")
+		Expect(ioutil.WriteFile(firstName, nil, 0644)).To(Succeed())
+		Expect(ioutil.WriteFile(otherName, nil, 0644)).To(Succeed())
+
+		mux, err = notify.NewMux(notify.Options{Backend: notify.BackendInotify})
+		Expect(err).NotTo(HaveOccurred())
+
+		first = mux.Watcher()
+		other = mux.Watcher()
+	})
+
+	AfterEach(func() {
+		mux.Close()
+		os.RemoveAll(tmpDir)
+	})
+
+	It("sends each subscriber the events of its paths", func() {
+		Expect(first.Add(firstName)).To(Succeed())
+		Expect(other.Add(otherName)).To(Succeed())
+
+		Expect(ioutil.WriteFile(firstName, []byte("data"), 0644)).To(Succeed())
+		Eventually(first.Events()).Should(Receive(HaveField("Name", firstName)))
+		Consistently(other.Events()).ShouldNot(Receive())
+	})
+
+	It("sends the events of a directory's files to its subscribers", func() {
+		Expect(first.Add(tmpDir)).To(Succeed())
+
+		Expect(ioutil.WriteFile(otherName, []byte("data"), 0644)).To(Succeed())
+		Eventually(first.Events()).Should(Receive(HaveField("Name", otherName)))
+	})
+
+	Context("when subscribers share a path", func() {
+		BeforeEach(func() {
+			Expect(first.Add(firstName)).To(Succeed())
+			Expect(other.Add(firstName)).To(Succeed())
+		})
+
+		It("keeps watching it until the last subscriber removes it", func() {
+			Expect(first.Close()).To(Succeed())
+
+			Expect(ioutil.WriteFile(firstName, []byte("data"), 0644)).To(Succeed())
+			Eventually(other.Events()).Should(Receive(HaveField("Name", firstName)))
+		})
+	})
+
+	It("does not hold up other subscribers when one does not receive", func() {
+		Expect(first.Add(firstName)).To(Succeed())
+		Expect(other.Add(otherName)).To(Succeed())
+
+		for i := 0; i < 10; i++ {
+			Expect(ioutil.WriteFile(firstName, []byte("data"), 0644)).To(Succeed())
+		}
+		Expect(ioutil.WriteFile(otherName, []byte("data"), 0644)).To(Succeed())
+		Eventually(other.Events()).Should(Receive(HaveField("Name", otherName)))
+	})
+})
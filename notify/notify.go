@@ -0,0 +1,189 @@
+package notify
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// Op is a set of changes to a file. The values match those of fsnotify.
+type Op uint32
+
+const (
+	Create Op = 1 << iota
+	Write
+	Remove
+	Rename
+	Chmod
+)
+
+// Event reports changes to the file Name. Events for a watched directory
+// name the file in the directory that changed.
+type Event struct {
+	Name string
+	Op   Op
+}
+
+// A Watcher reports changes to the files and directories added to it.
+type Watcher interface {
+	Add(name string) error
+	Remove(name string) error
+	Events() <-chan Event
+	Errors() <-chan error
+	Close() error
+}
+
+// Backend selects how changes are detected.
+type Backend string
+
+const (
+	// BackendAuto uses inotify and polls the files inotify cannot watch
+	// because its limits are exhausted.
+	BackendAuto Backend = "auto"
+	// BackendInotify only uses inotify.
+	BackendInotify Backend = "inotify"
+	// BackendPoll compares the state of every file at each poll interval.
+	BackendPoll Backend = "poll"
+)
+
+// DefaultPollInterval is used when Options.PollInterval is not set.
+const DefaultPollInterval = 1 * time.Second
+
+// Options configure the watchers created by New.
+type Options struct {
+	Backend      Backend
+	PollInterval time.Duration
+}
+
+// ParseBackend converts a backend name into a Backend. An empty name means
+// BackendAuto.
+func ParseBackend(name string) (Backend, error) {
+	switch backend := Backend(name); backend {
+	case "":
+		return BackendAuto, nil
+	case BackendAuto, BackendInotify, BackendPoll:
+		return backend, nil
+	default:
+		return "", fmt.Errorf("unknown file event backend %q", name)
+	}
+}
+
+// New creates a watcher using the configured backend.
+func New(opts Options) (Watcher, error) {
+	interval := opts.PollInterval
+	if interval <= 0 {
+		interval = DefaultPollInterval
+	}
+
+	events := make(chan Event)
+	errs := make(chan error)
+
+	switch opts.Backend {
+	case BackendPoll:
+		return newPoller(interval, events, errs), nil
+	case BackendInotify:
+		inotify, err := newInotify(events, errs)
+		if err != nil {
+			return nil, err
+		}
+		return inotify, nil
+	case BackendAuto, "":
+		inotify, err := newInotify(events, errs)
+		if err != nil && !exhausted(err) {
+			return nil, err
+		}
+		w := &autoWatcher{
+			inotify:  inotify,
+			interval: interval,
+			events:   events,
+			errors:   errs,
+		}
+		if inotify == nil {
+			w.poller = newPoller(interval, events, errs)
+		}
+		return w, nil
+	default:
+		return nil, fmt.Errorf("unknown file event backend %q", opts.Backend)
+	}
+}
+
+// exhausted reports whether err means an inotify limit has been reached.
+func exhausted(err error) bool {
+	return errors.Is(err, syscall.EMFILE) || errors.Is(err, syscall.ENOSPC) || errors.Is(err, syscall.ENOMEM)
+}
+
+// autoWatcher watches with inotify and falls back to polling for the paths
+// inotify cannot take, or for every path when no inotify instance could be
+// created. The poller is only started once it is needed.
+type autoWatcher struct {
+	inotify  *inotifyWatcher
+	interval time.Duration
+
+	mu     sync.Mutex
+	poller *poller
+
+	events chan Event
+	errors chan error
+}
+
+func (w *autoWatcher) Add(name string) error {
+	if w.inotify != nil {
+		err := w.inotify.Add(name)
+		if err == nil || !exhausted(err) {
+			return err
+		}
+	}
+
+	w.mu.Lock()
+	if w.poller == nil {
+		w.poller = newPoller(w.interval, w.events, w.errors)
+	}
+	poller := w.poller
+	w.mu.Unlock()
+
+	return poller.Add(name)
+}
+
+func (w *autoWatcher) Remove(name string) error {
+	w.mu.Lock()
+	poller := w.poller
+	w.mu.Unlock()
+
+	if poller == nil {
+		return w.inotify.Remove(name)
+	}
+
+	pollErr := poller.Remove(name)
+	if w.inotify == nil {
+		return pollErr
+	}
+
+	err := w.inotify.Remove(name)
+	if err != nil && pollErr == nil {
+		return nil
+	}
+	return err
+}
+
+func (w *autoWatcher) Events() <-chan Event {
+	return w.events
+}
+
+func (w *autoWatcher) Errors() <-chan error {
+	return w.errors
+}
+
+func (w *autoWatcher) Close() error {
+	w.mu.Lock()
+	if w.poller != nil {
+		w.poller.Close()
+	}
+	w.mu.Unlock()
+
+	if w.inotify != nil {
+		return w.inotify.Close()
+	}
+	return nil
+}
@@ -0,0 +1,157 @@
+package notify_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"syscall"
+	"time"
+
+	"github.com/cf-furnace/loggingAgent/notify"
+	"github.com/fsnotify/fsnotify"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Watcher", func() {
+	var (
+		tmpDir  string
+		opts    notify.Options
+		watcher notify.Watcher
+		newErr  error
+	)
+
+	BeforeEach(func() {
+		var err error
+		tmpDir, err = ioutil.TempDir("", "notify")
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	JustBeforeEach(func() {
+		watcher, newErr = notify.New(opts)
+	})
+
+	AfterEach(func() {
+		if watcher != nil {
+			watcher.Close()
+		}
+		os.RemoveAll(tmpDir)
+	})
+
+	receive := func(op notify.Op, name string) {
+		EventuallyWithOffset(1, watcher.Events()).Should(Receive(And(
+			HaveField("Name", name),
+			HaveField("Op", WithTransform(func(o notify.Op) notify.Op { return o & op }, Equal(op))),
+		)))
+	}
+
+	itReportsChanges := func() {
+		JustBeforeEach(func() {
+			Expect(newErr).NotTo(HaveOccurred())
+		})
+
+		It("reports files created in and removed from a directory", func() {
+			Expect(watcher.Add(tmpDir)).To(Succeed())
+
+			name := filepath.Join(tmpDir, "created.log")
+			Expect(ioutil.WriteFile(name, nil, 0644)).To(Succeed())
+			receive(notify.Create, name)
+
+			Expect(os.Remove(name)).To(Succeed())
+			receive(notify.Remove, name)
+		})
+
+		It("reports writes to a file", func() {
+			name := filepath.Join(tmpDir, "written.log")
+			Expect(ioutil.WriteFile(name, nil, 0644)).To(Succeed())
+			Expect(watcher.Add(name)).To(Succeed())
+
+			Expect(ioutil.WriteFile(name, []byte("data"), 0644)).To(Succeed())
+			receive(notify.Write, name)
+		})
+
+		It("fails to add a missing path", func() {
+			Expect(watcher.Add(filepath.Join(tmpDir, "missing"))).NotTo(Succeed())
+		})
+	}
+
+	Context("with inotify", func() {
+		BeforeEach(func() {
+			opts = notify.Options{Backend: notify.BackendInotify}
+		})
+
+		itReportsChanges()
+	})
+
+	Context("when polling", func() {
+		BeforeEach(func() {
+			opts = notify.Options{Backend: notify.BackendPoll, PollInterval: 10 * time.Millisecond}
+		})
+
+		itReportsChanges()
+
+		It("reports a file that was replaced as removed", func() {
+			name := filepath.Join(tmpDir, "rotated.log")
+			Expect(ioutil.WriteFile(name, nil, 0644)).To(Succeed())
+			Expect(watcher.Add(name)).To(Succeed())
+
+			Expect(os.Rename(name, name+".1")).To(Succeed())
+			Expect(ioutil.WriteFile(name, nil, 0644)).To(Succeed())
+			receive(notify.Remove, name)
+		})
+	})
+
+	Context("with the auto backend", func() {
+		BeforeEach(func() {
+			opts = notify.Options{Backend: notify.BackendAuto, PollInterval: 10 * time.Millisecond}
+		})
+
+		itReportsChanges()
+
+		It("does not poll while inotify takes every path", func() {
+			Expect(watcher.Add(tmpDir)).To(Succeed())
+			Expect(notify.Polling(watcher)).To(BeFalse())
+		})
+	})
+
+	Context("when inotify instances are exhausted", func() {
+		var restore func()
+
+		BeforeEach(func() {
+			opts = notify.Options{Backend: notify.BackendAuto, PollInterval: 10 * time.Millisecond}
+			restore = notify.SetNewFSWatcher(func() (*fsnotify.Watcher, error) {
+				return nil, os.NewSyscallError("inotify_init1", syscall.EMFILE)
+			})
+		})
+
+		AfterEach(func() {
+			restore()
+		})
+
+		Context("with the auto backend", func() {
+			itReportsChanges()
+		})
+
+		Context("with the inotify backend", func() {
+			BeforeEach(func() {
+				opts.Backend = notify.BackendInotify
+			})
+
+			It("fails to create the watcher", func() {
+				Expect(newErr).To(MatchError(syscall.EMFILE))
+			})
+		})
+	})
+
+	Describe("ParseBackend", func() {
+		It("defaults to auto", func() {
+			Expect(notify.ParseBackend("")).To(Equal(notify.BackendAuto))
+		})
+
+		It("rejects unknown backends", func() {
+			_, err := notify.ParseBackend("kqueue")
+			Expect(err).To(MatchError(`unknown file event backend "kqueue"`))
+		})
+	})
+})
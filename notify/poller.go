@@ -0,0 +1,168 @@
+package notify
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// poller detects changes by comparing the state of the watched paths at each
+// interval. Directories report the files created in and removed from them;
+// files report writes, and their removal or replacement.
+type poller struct {
+	interval time.Duration
+
+	mu    sync.Mutex
+	paths map[string]*pollState
+
+	events chan Event
+	errors chan error
+
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+type pollState struct {
+	info os.FileInfo
+	// entries holds the files of a directory.
+	entries map[string]os.FileInfo
+}
+
+func newPoller(interval time.Duration, events chan Event, errs chan error) *poller {
+	p := &poller{
+		interval: interval,
+		paths:    map[string]*pollState{},
+		events:   events,
+		errors:   errs,
+		done:     make(chan struct{}),
+	}
+	go p.run()
+
+	return p
+}
+
+func (p *poller) Add(name string) error {
+	state, err := poll(name)
+	if err != nil {
+		return err
+	}
+
+	p.mu.Lock()
+	p.paths[name] = state
+	p.mu.Unlock()
+	return nil
+}
+
+func (p *poller) Remove(name string) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if _, ok := p.paths[name]; !ok {
+		return fmt.Errorf("can't remove non-existent poll watch for: %s", name)
+	}
+	delete(p.paths, name)
+	return nil
+}
+
+func (p *poller) Events() <-chan Event {
+	return p.events
+}
+
+func (p *poller) Errors() <-chan error {
+	return p.errors
+}
+
+func (p *poller) Close() error {
+	p.closeOnce.Do(func() {
+		close(p.done)
+	})
+	return nil
+}
+
+func (p *poller) run() {
+	ticker := time.NewTicker(p.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			for _, event := range p.changes() {
+				select {
+				case p.events <- event:
+				case <-p.done:
+					return
+				}
+			}
+		case <-p.done:
+			return
+		}
+	}
+}
+
+// changes polls every watched path and returns what changed since the last
+// poll. Events are sent without holding the lock so that receivers can add
+// and remove paths.
+func (p *poller) changes() []Event {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	var events []Event
+	for name, old := range p.paths {
+		state, err := poll(name)
+		if err != nil {
+			// inotify stops watching removed paths as well.
+			delete(p.paths, name)
+			events = append(events, Event{Name: name, Op: Remove})
+			continue
+		}
+		p.paths[name] = state
+
+		if !os.SameFile(old.info, state.info) {
+			events = append(events, Event{Name: name, Op: Remove})
+			continue
+		}
+
+		if state.entries == nil {
+			if state.info.Size() != old.info.Size() || !state.info.ModTime().Equal(old.info.ModTime()) {
+				events = append(events, Event{Name: name, Op: Write})
+			}
+			continue
+		}
+
+		for entry, fi := range state.entries {
+			if prev, ok := old.entries[entry]; !ok || !os.SameFile(prev, fi) {
+				events = append(events, Event{Name: filepath.Join(name, entry), Op: Create})
+			}
+		}
+		for entry := range old.entries {
+			if _, ok := state.entries[entry]; !ok {
+				events = append(events, Event{Name: filepath.Join(name, entry), Op: Remove})
+			}
+		}
+	}
+	return events
+}
+
+func poll(name string) (*pollState, error) {
+	info, err := os.Stat(name)
+	if err != nil {
+		return nil, err
+	}
+
+	state := &pollState{info: info}
+	if info.IsDir() {
+		files, err := ioutil.ReadDir(name)
+		if err != nil {
+			return nil, err
+		}
+
+		state.entries = make(map[string]os.FileInfo, len(files))
+		for _, fi := range files {
+			state.entries[fi.Name()] = fi
+		}
+	}
+	return state, nil
+}
@@ -0,0 +1,191 @@
+package proxy
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	"code.cloudfoundry.org/lager"
+
+	"github.com/cloudfoundry/dropsonde"
+	"github.com/cloudfoundry/dropsonde/emitter"
+	"github.com/cloudfoundry/sonde-go/events"
+)
+
+// Defaults for the BatchOptions that are not set.
+const (
+	DefaultBatchSize   = 64 * 1024
+	DefaultBatchWindow = 100 * time.Millisecond
+)
+
+// A BatchEmitter sends many envelopes at once. A BatchingEmitter hands whole
+// batches to an emitter implementing it, for example one writing to metron's
+// gRPC ingress.
+type BatchEmitter interface {
+	EmitBatch(envelopes []*events.Envelope) error
+}
+
+// BatchOptions bound a batch. It is sent once its envelopes add up to Size
+// bytes, or Window after its first envelope was added.
+type BatchOptions struct {
+	Size   int
+	Window time.Duration
+	// Failed, if set, is given the envelopes of a batch that failed to send
+	// when that error was not returned for them, e.g. Proxy.EmitFailed.
+	Failed func(envelopes []*events.Envelope)
+}
+
+// BatchingEmitter groups envelopes into batches before passing them on to
+// another emitter. Emitters that do not implement BatchEmitter receive the
+// envelopes of a batch one by one.
+type BatchingEmitter struct {
+	logger  lager.Logger
+	emitter dropsonde.EventEmitter
+	batcher BatchEmitter
+	options BatchOptions
+
+	// sending orders the batches. It is taken before mu.
+	sending sync.Mutex
+
+	mu     sync.Mutex
+	batch  []*events.Envelope
+	size   int
+	timer  *time.Timer
+	closed bool
+}
+
+func NewBatchingEmitter(logger lager.Logger, eventEmitter dropsonde.EventEmitter, options BatchOptions) *BatchingEmitter {
+	if options.Size <= 0 {
+		options.Size = DefaultBatchSize
+	}
+	if options.Window <= 0 {
+		options.Window = DefaultBatchWindow
+	}
+
+	batcher, _ := eventEmitter.(BatchEmitter)
+	return &BatchingEmitter{
+		logger:  logger.Session("batching-emitter"),
+		emitter: eventEmitter,
+		batcher: batcher,
+		options: options,
+	}
+}
+
+func (b *BatchingEmitter) Origin() string {
+	return b.emitter.Origin()
+}
+
+func (b *BatchingEmitter) Emit(event events.Event) error {
+	envelope, err := emitter.Wrap(event, b.Origin())
+	if err != nil {
+		return err
+	}
+	return b.EmitEnvelope(envelope)
+}
+
+// EmitEnvelope adds envelope to the current batch. If that fills the batch,
+// it is sent before EmitEnvelope returns, along with the error sending it.
+func (b *BatchingEmitter) EmitEnvelope(envelope *events.Envelope) error {
+	b.mu.Lock()
+	if b.closed {
+		b.mu.Unlock()
+		return errors.New("batching-emitter-closed")
+	}
+
+	b.batch = append(b.batch, envelope)
+	b.size += envelope.Size()
+	if len(b.batch) == 1 {
+		b.timer = time.AfterFunc(b.options.Window, b.flushWindow)
+	}
+	full := b.size >= b.options.Size
+	b.mu.Unlock()
+
+	if !full {
+		return nil
+	}
+
+	batch, err := b.flush()
+	if err != nil {
+		// the error is returned for envelope; the other envelopes of the
+		// batch were accepted earlier.
+		b.fail(batch, envelope, err)
+	}
+	return err
+}
+
+// Flush sends the current batch.
+func (b *BatchingEmitter) Flush() error {
+	batch, err := b.flush()
+	if err != nil {
+		b.fail(batch, nil, err)
+	}
+	return err
+}
+
+// flush sends the current batch and returns it.
+func (b *BatchingEmitter) flush() ([]*events.Envelope, error) {
+	b.sending.Lock()
+	defer b.sending.Unlock()
+
+	b.mu.Lock()
+	batch := b.batch
+	b.batch = nil
+	b.size = 0
+	if b.timer != nil {
+		b.timer.Stop()
+		b.timer = nil
+	}
+	b.mu.Unlock()
+
+	if len(batch) == 0 {
+		return nil, nil
+	}
+	return batch, b.send(batch)
+}
+
+// Close sends the current batch. Envelopes emitted afterwards are rejected.
+func (b *BatchingEmitter) Close() error {
+	b.mu.Lock()
+	b.closed = true
+	b.mu.Unlock()
+
+	return b.Flush()
+}
+
+func (b *BatchingEmitter) flushWindow() {
+	b.Flush()
+}
+
+// fail logs the error sending batch and passes on its envelopes, except the
+// one the error is returned for, to the Failed option.
+func (b *BatchingEmitter) fail(batch []*events.Envelope, returned *events.Envelope, err error) {
+	b.logger.Error("failed-to-emit-batch", err, lager.Data{"envelopes": len(batch)})
+	if b.options.Failed == nil {
+		return
+	}
+
+	failed := make([]*events.Envelope, 0, len(batch))
+	for _, envelope := range batch {
+		if envelope != returned {
+			failed = append(failed, envelope)
+		}
+	}
+	if len(failed) > 0 {
+		b.options.Failed(failed)
+	}
+}
+
+func (b *BatchingEmitter) send(batch []*events.Envelope) error {
+	if b.batcher != nil {
+		return b.batcher.EmitBatch(batch)
+	}
+
+	var firstErr error
+	for _, envelope := range batch {
+		err := b.emitter.EmitEnvelope(envelope)
+		if err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
@@ -0,0 +1,161 @@
+package proxy_test
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	"code.cloudfoundry.org/lager/lagertest"
+	. "github.com/cf-furnace/loggingAgent/proxy"
+	"github.com/cloudfoundry/dropsonde/emitter/fake"
+	"github.com/cloudfoundry/sonde-go/events"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("BatchingEmitter", func() {
+	var (
+		logger  *lagertest.TestLogger
+		target  *fakeBatchEmitter
+		options BatchOptions
+
+		failed chan *events.Envelope
+
+		batching *BatchingEmitter
+	)
+
+	BeforeEach(func() {
+		logger = lagertest.NewTestLogger("")
+		target = &fakeBatchEmitter{FakeEventEmitter: fake.NewFakeEventEmitter("origin")}
+		failed = make(chan *events.Envelope, 10)
+		options = BatchOptions{
+			Size:   1024 * 1024,
+			Window: time.Hour,
+			Failed: func(failed chan<- *events.Envelope) func([]*events.Envelope) {
+				return func(envelopes []*events.Envelope) {
+					for _, envelope := range envelopes {
+						failed <- envelope
+					}
+				}
+			}(failed),
+		}
+	})
+
+	JustBeforeEach(func() {
+		batching = NewBatchingEmitter(logger, target, options)
+	})
+
+	logMessage := func(text string) *events.LogMessage {
+		return &events.LogMessage{Message: []byte(text)}
+	}
+
+	It("wraps events with the origin of the emitter", func() {
+		Expect(batching.Origin()).To(Equal("origin"))
+		Expect(batching.Emit(logMessage("a"))).To(Succeed())
+		Expect(batching.Flush()).To(Succeed())
+
+		Expect(target.getBatches()).To(HaveLen(1))
+		Expect(target.getBatches()[0][0].GetOrigin()).To(Equal("origin"))
+	})
+
+	It("holds envelopes until the batch is sent", func() {
+		Expect(batching.Emit(logMessage("a"))).To(Succeed())
+		Expect(batching.Emit(logMessage("b"))).To(Succeed())
+		Expect(target.getBatches()).To(BeEmpty())
+
+		Expect(batching.Close()).To(Succeed())
+		Expect(target.getBatches()).To(HaveLen(1))
+		Expect(target.getBatches()[0]).To(HaveLen(2))
+		Expect(string(target.getBatches()[0][1].LogMessage.Message)).To(Equal("b"))
+	})
+
+	It("rejects envelopes once closed", func() {
+		Expect(batching.Close()).To(Succeed())
+		Expect(batching.Emit(logMessage("a"))).To(MatchError("batching-emitter-closed"))
+	})
+
+	Context("when a batch reaches its size", func() {
+		BeforeEach(func() {
+			options.Size = 1
+		})
+
+		It("sends it at once", func() {
+			Expect(batching.Emit(logMessage("a"))).To(Succeed())
+			Expect(batching.Emit(logMessage("b"))).To(Succeed())
+			Expect(target.getBatches()).To(HaveLen(2))
+		})
+
+		It("returns the error sending it", func() {
+			target.ReturnError = errors.New("boom")
+			Expect(batching.Emit(logMessage("a"))).To(MatchError("boom"))
+			Expect(failed).NotTo(Receive())
+		})
+	})
+
+	Context("when the window passes", func() {
+		BeforeEach(func() {
+			options.Window = 10 * time.Millisecond
+		})
+
+		It("sends the batch", func() {
+			Expect(batching.Emit(logMessage("a"))).To(Succeed())
+			Eventually(target.getBatches).Should(HaveLen(1))
+		})
+
+		It("logs the error sending it", func() {
+			target.ReturnError = errors.New("boom")
+			Expect(batching.Emit(logMessage("a"))).To(Succeed())
+			Eventually(logger.LogMessages).Should(ContainElement(".batching-emitter.failed-to-emit-batch"))
+		})
+
+		It("reports the envelopes of the failed batch", func() {
+			target.ReturnError = errors.New("boom")
+			Expect(batching.Emit(logMessage("a"))).To(Succeed())
+			Expect(batching.Emit(logMessage("b"))).To(Succeed())
+			Eventually(failed).Should(Receive())
+			Eventually(failed).Should(Receive())
+		})
+	})
+
+	Context("when the emitter does not take batches", func() {
+		var emitter *fake.FakeEventEmitter
+
+		JustBeforeEach(func() {
+			emitter = fake.NewFakeEventEmitter("origin")
+			batching = NewBatchingEmitter(logger, emitter, options)
+		})
+
+		It("emits the envelopes one by one", func() {
+			Expect(batching.Emit(logMessage("a"))).To(Succeed())
+			Expect(batching.Emit(logMessage("b"))).To(Succeed())
+			Expect(batching.Flush()).To(Succeed())
+
+			Expect(emitter.GetEnvelopes()).To(HaveLen(2))
+			Expect(string(emitter.GetEnvelopes()[0].LogMessage.Message)).To(Equal("a"))
+		})
+	})
+})
+
+type fakeBatchEmitter struct {
+	*fake.FakeEventEmitter
+
+	mu      sync.Mutex
+	batches [][]*events.Envelope
+}
+
+func (f *fakeBatchEmitter) EmitBatch(envelopes []*events.Envelope) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.ReturnError != nil {
+		return f.ReturnError
+	}
+	f.batches = append(f.batches, envelopes)
+	return nil
+}
+
+func (f *fakeBatchEmitter) getBatches() [][]*events.Envelope {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([][]*events.Envelope{}, f.batches...)
+}
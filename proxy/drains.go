@@ -0,0 +1,101 @@
+package proxy
+
+import (
+	"io"
+
+	"code.cloudfoundry.org/lager"
+)
+
+// appDrains holds the drains of an app while it has readers. It is guarded
+// by the proxy's mutex.
+type appDrains struct {
+	readers int
+	sinks   map[string]Sink
+}
+
+// drainURLs returns the drains of an app named by its metadata and by
+// Config.AppDrains, without duplicates.
+func (p *Proxy) drainURLs(appID string, meta Metadata) []string {
+	seen := map[string]bool{}
+	var urls []string
+	for _, list := range [][]string{meta.Drains, p.config.AppDrains[appID]} {
+		for _, url := range list {
+			if !seen[url] {
+				seen[url] = true
+				urls = append(urls, url)
+			}
+		}
+	}
+	return urls
+}
+
+// drainSink returns sink extended with the drains of an app, opening the
+// ones that are not open yet. Drains that cannot be opened are logged and
+// skipped. The caller holds p.mu, and counts the reader using the returned
+// sink in c.drains.readers until it calls releaseDrains.
+func (p *Proxy) drainSink(logger lager.Logger, c *appCounters, sink Sink, urls []string) Sink {
+	if len(urls) == 0 || p.config.NewDrain == nil {
+		return sink
+	}
+
+	if c.drains.sinks == nil {
+		c.drains.sinks = map[string]Sink{}
+	}
+
+	sinks := FanOut{sink}
+	for _, url := range urls {
+		drain, ok := c.drains.sinks[url]
+		if !ok {
+			var err error
+			drain, err = p.config.NewDrain(url)
+			if err != nil {
+				// the URL is not logged as it may hold credentials.
+				logger.Error("invalid-drain", err)
+				continue
+			}
+			c.drains.sinks[url] = drain
+		}
+		sinks = append(sinks, drain)
+	}
+	return sinks
+}
+
+// releaseDrains removes the drains of an app once it has no readers left,
+// and returns them. The caller holds p.mu, and closes them with closeDrains
+// after releasing it since a drain may take a while to stop.
+func (p *Proxy) releaseDrains(c *appCounters) []Sink {
+	c.drains.readers--
+	if c.drains.readers > 0 {
+		return nil
+	}
+
+	var drains []Sink
+	for url, drain := range c.drains.sinks {
+		drains = append(drains, drain)
+		delete(c.drains.sinks, url)
+	}
+	return drains
+}
+
+// pruneDrains removes the drains of an app whose URLs are not in keep, and
+// returns them to be closed with closeDrains. The caller holds p.mu.
+func (p *Proxy) pruneDrains(c *appCounters, keep map[string]bool) []Sink {
+	var drains []Sink
+	for url, drain := range c.drains.sinks {
+		if !keep[url] {
+			drains = append(drains, drain)
+			delete(c.drains.sinks, url)
+		}
+	}
+	return drains
+}
+
+func closeDrains(logger lager.Logger, drains []Sink) {
+	for _, drain := range drains {
+		if closer, ok := drain.(io.Closer); ok {
+			if err := closer.Close(); err != nil {
+				logger.Error("failed-to-close-drain", err)
+			}
+		}
+	}
+}
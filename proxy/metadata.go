@@ -0,0 +1,141 @@
+package proxy
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"code.cloudfoundry.org/lager"
+
+	"github.com/cf-furnace/loggingAgent/retriever"
+	"github.com/cf-furnace/pkg/cloudfoundry"
+)
+
+// Metadata describes the app whose logs a container writes. Empty fields
+// are derived from the pod and container names instead.
+type Metadata struct {
+	AppID         string
+	InstanceIndex string
+	SourceType    string
+	// Tags are attached to every envelope emitted for the container, for
+	// example the space and organization of the app.
+	Tags map[string]string
+	// RateLimit, if set, overrides the non-zero fields of Config.RateLimit
+	// for the app.
+	RateLimit *RateLimit
+	// Drains are the URLs of the syslog drains the app's messages are
+	// forwarded to.
+	Drains []string
+}
+
+// MetadataStrategy decides where the metadata of a log comes from.
+type MetadataStrategy string
+
+const (
+	// MetadataKube asks Config.MetadataResolver about the pod and derives
+	// whatever it does not know from the pod and container names.
+	MetadataKube MetadataStrategy = "kube"
+	// MetadataNames derives the metadata from the pod and container names
+	// only.
+	MetadataNames MetadataStrategy = "names"
+	// MetadataNode treats the log as one of a component of the node, named
+	// by the container, which also serves as its app ID. It is forwarded as
+	// the logs of unmatched containers are under UnmatchedOperator.
+	MetadataNode MetadataStrategy = "node"
+)
+
+// ParseMetadataStrategy converts a strategy name into a MetadataStrategy. An
+// empty name means MetadataKube.
+func ParseMetadataStrategy(name string) (MetadataStrategy, error) {
+	switch strategy := MetadataStrategy(name); strategy {
+	case "":
+		return MetadataKube, nil
+	case MetadataKube, MetadataNames, MetadataNode:
+		return strategy, nil
+	default:
+		return "", fmt.Errorf("unknown metadata strategy %q", name)
+	}
+}
+
+// A MetadataResolver looks up the metadata of the app running in a pod. It
+// reports false when it knows nothing about the pod.
+type MetadataResolver interface {
+	Resolve(namespace, pod, container string) (Metadata, bool)
+}
+
+// resolve looks the pod up through the configured resolver when the strategy
+// allows it.
+func (p *Proxy) resolve(strategy MetadataStrategy, namespace, pod, container string) Metadata {
+	var meta Metadata
+	if p.config.MetadataResolver != nil && (strategy == "" || strategy == MetadataKube) {
+		meta, _ = p.config.MetadataResolver.Resolve(namespace, pod, container)
+	}
+	return meta
+}
+
+// metadata fills in whatever the resolver could not supply from the pod and
+// container names. It reports whether the logs belong to the operator rather
+// than to an app. The caller holds p.mu.
+func (p *Proxy) metadata(logger lager.Logger, strategy MetadataStrategy, meta Metadata, pod, container string) (Metadata, bool, error) {
+	unmatched := p.config.Unmatched
+	if strategy == MetadataNode {
+		unmatched = UnmatchedOperator
+	}
+
+	operator := strategy == MetadataNode
+	if meta.SourceType == "" {
+		source, ok := p.sourceType(container)
+		if !ok {
+			switch unmatched {
+			case UnmatchedDefault:
+				source = p.config.DefaultSource
+			case UnmatchedOperator:
+				source = p.config.DefaultSource
+				operator = true
+			default:
+				return Metadata{}, false, errors.New("unsupported-container-name")
+			}
+		}
+		meta.SourceType = source
+	}
+
+	// the logs of the node are not named after a pod; each component keeps
+	// its own counters and rate limit.
+	switch {
+	case meta.AppID != "":
+	case strategy == MetadataNode:
+		meta.AppID = container
+	default:
+		appID, err := appIDFromPod(logger, pod)
+		if err != nil && !operator {
+			return Metadata{}, false, err
+		}
+		meta.AppID = appID
+	}
+
+	// the pod name alone cannot tell a StatefulSet ordinal from the random
+	// suffix of a ReplicaSet pod, so only the resolver supplies the index.
+	if meta.InstanceIndex == "" {
+		meta.InstanceIndex = retriever.UnknownSourceInstance
+	}
+
+	return meta, operator, nil
+}
+
+// appIDFromPod decodes the app GUID from the process GUID at the start of the
+// pod name.
+func appIDFromPod(logger lager.Logger, pod string) (string, error) {
+	randomBits := strings.LastIndexByte(pod, '-')
+	if randomBits == -1 {
+		logger.Error("pod-name-failure", nil)
+		return "", errors.New("invalid-pod-name")
+	}
+
+	pguid, err := cloudfoundry.DecodeProcessGuid(pod[:randomBits])
+	if err != nil {
+		logger.Error("process-guid-failure", err, lager.Data{"shortened-guid": pod[:randomBits]})
+		return "", errors.New("invalid-process-guid")
+	}
+
+	return pguid.AppGuid.String(), nil
+}
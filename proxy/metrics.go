@@ -0,0 +1,232 @@
+package proxy
+
+import (
+	"sync/atomic"
+	"time"
+
+	"github.com/cf-furnace/loggingAgent/retriever"
+	"github.com/cloudfoundry/sonde-go/events"
+)
+
+// Names of the metrics the proxy reports about itself.
+const (
+	LinesReadMetric       = "linesRead"
+	BytesReadMetric       = "bytesRead"
+	DecodeErrorsMetric    = "decodeErrors"
+	DroppedMetric         = "messagesDropped"
+	ThrottledMetric       = "messagesThrottled"
+	FilteredMetric        = "messagesFiltered"
+	MessagesEmittedMetric = "messagesEmitted"
+	EmitFailuresMetric    = "emitFailures"
+	ActiveReadersMetric   = "activeReaders"
+	BacklogMetric         = "backlog"
+)
+
+// Stats counts the work done by every reader the proxy has started.
+// ActiveReaders and Backlog describe the readers that are still running.
+type Stats struct {
+	retriever.Stats
+	MessagesEmitted uint64
+	// EmitFailures also counts the messages that were emitted but failed
+	// to send afterwards, as part of a batch.
+	EmitFailures uint64
+	// Throttled is the number of messages discarded by the rate limit.
+	Throttled uint64
+	// Filtered is the number of messages discarded because their container
+	// stopped matching the source rules after a reconfiguration.
+	Filtered uint64
+
+	ActiveReaders int
+	// Backlog is the number of messages read but not yet emitted.
+	Backlog int
+}
+
+// A MetricSender sends the proxy's metrics. Counters are sent as the change
+// since the previous report.
+type MetricSender interface {
+	SendValue(name string, value float64, unit string) error
+	AddToCounter(name string, delta uint64) error
+}
+
+// Add returns the sum of s and other.
+func (s Stats) Add(other Stats) Stats {
+	return Stats{
+		Stats:           s.Stats.Add(other.Stats),
+		MessagesEmitted: s.MessagesEmitted + other.MessagesEmitted,
+		EmitFailures:    s.EmitFailures + other.EmitFailures,
+		Throttled:       s.Throttled + other.Throttled,
+		Filtered:        s.Filtered + other.Filtered,
+		ActiveReaders:   s.ActiveReaders + other.ActiveReaders,
+		Backlog:         s.Backlog + other.Backlog,
+	}
+}
+
+// appCounters holds the counters of an app that outlive its readers.
+type appCounters struct {
+	// retired sums the stats of the app's finished readers. It is guarded
+	// by the proxy's mutex.
+	retired      retriever.Stats
+	emitted      uint64
+	emitFailures uint64
+	throttled    uint64
+	filtered     uint64
+	// limiter and drains are shared by the app's readers. rateLimit is the
+	// override given by the app's metadata.
+	limiter   limiter
+	rateLimit *RateLimit
+	drains    appDrains
+}
+
+// retire folds the counters of a reader that has finished into the app's
+// totals. The caller holds the proxy's mutex.
+func (c *appCounters) retire(r *retriever.LogReader) {
+	c.retired = c.retired.Add(r.Stats())
+}
+
+// prune folds the counters of appID into the proxy's totals once the app has
+// no readers left, so that the apps that come and go do not pile up. The
+// caller holds p.mu.
+func (p *Proxy) prune(appID string, c *appCounters) {
+	if c.drains.readers > 0 || p.apps[appID] != c {
+		return
+	}
+
+	p.pruned = p.pruned.Add(c.stats())
+	delete(p.apps, appID)
+}
+
+// stats returns the counters of the app's finished readers and of its
+// messages.
+func (c *appCounters) stats() Stats {
+	return Stats{
+		Stats:           c.retired,
+		MessagesEmitted: atomic.LoadUint64(&c.emitted),
+		EmitFailures:    atomic.LoadUint64(&c.emitFailures),
+		Throttled:       atomic.LoadUint64(&c.throttled),
+		Filtered:        atomic.LoadUint64(&c.filtered),
+	}
+}
+
+// appCounters returns the counters of appID, creating them if needed. The
+// caller holds p.mu.
+func (p *Proxy) appCounters(appID string) *appCounters {
+	c, ok := p.apps[appID]
+	if !ok {
+		c = &appCounters{}
+		p.apps[appID] = c
+	}
+	return c
+}
+
+// EmitFailed counts the messages of envelopes as failed to emit, for sinks
+// that report failures after accepting a message, such as the Failed option
+// of a BatchingEmitter.
+func (p *Proxy) EmitFailed(envelopes []*events.Envelope) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	for _, envelope := range envelopes {
+		msg := envelope.GetLogMessage()
+		if msg == nil {
+			continue
+		}
+		if c, ok := p.apps[msg.GetAppId()]; ok {
+			atomic.AddUint64(&c.emitFailures, 1)
+		} else {
+			p.pruned.EmitFailures++
+		}
+	}
+}
+
+// Stats returns the proxy's counters summed over every app, including the
+// apps it no longer reads logs for.
+func (p *Proxy) Stats() Stats {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	stats := p.pruned
+	for _, app := range p.appStats() {
+		stats = stats.Add(app)
+	}
+	return stats
+}
+
+// AppStats returns the proxy's counters for each app it is reading logs for.
+func (p *Proxy) AppStats() map[string]Stats {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	return p.appStats()
+}
+
+// appStats returns the counters of each app. The caller holds p.mu.
+func (p *Proxy) appStats() map[string]Stats {
+	stats := map[string]Stats{}
+	for appID, c := range p.apps {
+		stats[appID] = c.stats()
+	}
+	for _, r := range p.readers {
+		app := stats[r.appID]
+		app.Stats = app.Stats.Add(r.Stats())
+		app.ActiveReaders++
+		app.Backlog += r.Backlog()
+		stats[r.appID] = app
+	}
+	return stats
+}
+
+// ReportMetrics sends the proxy's stats every interval until stop is closed.
+func (p *Proxy) ReportMetrics(sender MetricSender, interval time.Duration, stop <-chan struct{}) {
+	logger := p.logger.Session("report-metrics")
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	var last Stats
+	for {
+		select {
+		case <-ticker.C:
+			stats := p.Stats()
+			err := sendStats(sender, last, stats)
+			if err != nil {
+				logger.Error("failed-to-send-metrics", err)
+			}
+			last = stats
+		case <-stop:
+			return
+		}
+	}
+}
+
+func sendStats(sender MetricSender, last, stats Stats) error {
+	counters := []struct {
+		name        string
+		last, value uint64
+	}{
+		{LinesReadMetric, last.LinesRead, stats.LinesRead},
+		{BytesReadMetric, last.BytesRead, stats.BytesRead},
+		{DecodeErrorsMetric, last.DecodeErrors, stats.DecodeErrors},
+		{DroppedMetric, last.Dropped, stats.Dropped},
+		{MessagesEmittedMetric, last.MessagesEmitted, stats.MessagesEmitted},
+		{EmitFailuresMetric, last.EmitFailures, stats.EmitFailures},
+		{ThrottledMetric, last.Throttled, stats.Throttled},
+		{FilteredMetric, last.Filtered, stats.Filtered},
+	}
+
+	var firstErr error
+	record := func(err error) {
+		if err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+
+	for _, c := range counters {
+		if c.value > c.last {
+			record(sender.AddToCounter(c.name, c.value-c.last))
+		}
+	}
+	record(sender.SendValue(ActiveReadersMetric, float64(stats.ActiveReaders), "count"))
+	record(sender.SendValue(BacklogMetric, float64(stats.Backlog), "count"))
+
+	return firstErr
+}
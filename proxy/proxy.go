@@ -2,57 +2,192 @@ package proxy
 
 import (
 	"errors"
-	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"code.cloudfoundry.org/lager"
 
+	"github.com/cf-furnace/loggingAgent/notify"
 	"github.com/cf-furnace/loggingAgent/retriever"
-	"github.com/cf-furnace/pkg/cloudfoundry"
-	"github.com/cloudfoundry/dropsonde"
+	"github.com/cloudfoundry/sonde-go/events"
+	"github.com/gogo/protobuf/proto"
 )
 
+// Config holds the settings applied to every log the proxy reads.
+type Config struct {
+	// Checkpoints, if set, persists read offsets across restarts.
+	Checkpoints *retriever.Checkpoints
+	// Format is the encoding of the logs. retriever.FormatAuto detects it
+	// for each file.
+	Format retriever.Format
+	// MaxMessageSize limits the size of a message. Longer lines are cut
+	// short and end with TruncationMarker. Zero means no limit.
+	MaxMessageSize   int
+	TruncationMarker string
+	// Multiline joins continuation lines, such as the frames of a stack
+	// trace, into a single message. AppMultiline overrides it for the apps
+	// whose GUIDs it contains.
+	Multiline    *retriever.MultilineRule
+	AppMultiline map[string]*retriever.MultilineRule
+	// SourceRules map container names to source types. DefaultSourceRules
+	// are used when it is nil.
+	SourceRules []SourceRule
+	// Unmatched decides what happens to containers no rule matches.
+	// DefaultSource is the source type used when they are forwarded, and
+	// OperatorSink receives them under UnmatchedOperator; the proxy's sink
+	// is used when it is nil.
+	Unmatched     UnmatchedPolicy
+	DefaultSource string
+	OperatorSink  Sink
+	// QueueSize, Policy and Budget bound the messages each reader holds
+	// while the emitter catches up. See retriever.Config.
+	QueueSize int
+	Policy    retriever.Policy
+	Budget    *retriever.Budget
+	// Mux, if set, shares one file system watcher between the readers.
+	// Otherwise each reader creates its own as Notify describes.
+	Mux    *notify.Mux
+	Notify notify.Options
+	// RateLimit limits the messages emitted for each app. AppRateLimits and
+	// then Metadata.RateLimit override it for single apps. Messages over the
+	// limit are discarded and the app is sent a notice, at most once a
+	// second.
+	RateLimit     RateLimit
+	AppRateLimits map[string]*RateLimit
+	// AppDrains lists syslog drain URLs of apps in addition to the ones in
+	// their Metadata. NewDrain creates the sink forwarding an app's messages
+	// to a drain; drains are ignored when it is nil. The drains of an app
+	// are open while its logs are being read.
+	AppDrains map[string][]string
+	NewDrain  func(url string) (Sink, error)
+	// MetadataResolver, if set, supplies the app metadata of a pod. The
+	// pod and container names are used for anything it does not know.
+	MetadataResolver MetadataResolver
+	// Flush, if set, sends the messages the sinks have accepted but hold
+	// back, such as a BatchingEmitter's current batch. The checkpoints are
+	// only saved once it succeeds.
+	Flush func() error
+}
+
 type Proxy struct {
-	logger       lager.Logger
-	eventEmitter dropsonde.EventEmitter
+	logger lager.Logger
+	sink   Sink
+	config Config
+
+	mu      sync.Mutex
+	readers map[string]*reader
+	apps    map[string]*appCounters
+	// pruned sums the counters of the apps that no longer have readers.
+	pruned  Stats
+	stopped bool
+	copying sync.WaitGroup
+	// sending is held for reading while a message is sent on a route and
+	// committed, so that Reconfigure can wait for the old routes to be
+	// unused and SaveCheckpoints for the messages to reach the sinks.
+	sending sync.RWMutex
+}
+
+// reader is a running log reader and where its messages go.
+type reader struct {
+	*retriever.LogReader
+	appID    string
+	tags     map[string]string
+	counters *appCounters
+
+	// pod, container, strategy and resolved are kept to route the
+	// messages again when the proxy is reconfigured.
+	pod       string
+	container string
+	strategy  MetadataStrategy
+	resolved  Metadata
+	// route holds a *route.
+	route atomic.Value
+}
 
-	mu          sync.Mutex
-	inodesToApp map[uint64]*retriever.LogReader
+// route is where the messages of a reader go. It is replaced, never
+// modified, when the proxy is reconfigured.
+type route struct {
+	sink   Sink
+	source string
+	// filtered is set when the container no longer matches a source rule
+	// and its messages are discarded.
+	filtered bool
 }
 
-func New(logger lager.Logger, eventEmitter dropsonde.EventEmitter) *Proxy {
+// New creates a proxy sending the messages it reads to sink.
+func New(logger lager.Logger, sink Sink, config Config) *Proxy {
 	return &Proxy{
-		logger:       logger.Session("proxy"),
-		eventEmitter: eventEmitter,
-		inodesToApp:  map[uint64]*retriever.LogReader{},
+		logger:  logger.Session("proxy"),
+		sink:    sink,
+		config:  config,
+		readers: map[string]*reader{},
+		apps:    map[string]*appCounters{},
 	}
 }
 
-func (p *Proxy) Add(pod, container, path string, tail bool) error {
-	var source string
-	if strings.HasPrefix(container, "application-") {
-		source = "APP"
-	} else if strings.HasPrefix(container, "staging-") {
-		source = "STG"
-	} else {
-		return errors.New("unsupported-container-name")
+// LogOptions override the proxy's settings for a single log, such as the
+// logs of one watched directory.
+type LogOptions struct {
+	// Format replaces Config.Format when set.
+	Format retriever.Format
+	// Metadata is MetadataKube when empty.
+	Metadata MetadataStrategy
+}
+
+func (p *Proxy) Add(pod, namespace, container, path string, tail bool) error {
+	return p.AddWithOptions(pod, namespace, container, path, tail, LogOptions{})
+}
+
+// AddWithOptions reads a log as Add does, with opts applied.
+func (p *Proxy) AddWithOptions(pod, namespace, container, path string, tail bool, opts LogOptions) error {
+	logger := p.logger.WithData(lager.Data{"pod": pod, "namespace": namespace, "path": path})
+
+	resolved := p.resolve(opts.Metadata, namespace, pod, container)
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	meta, operator, err := p.metadata(logger, opts.Metadata, resolved, pod, container)
+	if err != nil {
+		return err
 	}
+	appID := meta.AppID
 
-	logger := p.logger.WithData(lager.Data{"pod": pod, "path": path})
-	randomBits := strings.LastIndexByte(pod, '-')
-	if randomBits == -1 {
-		logger.Error("pod-name-failure", nil)
-		return errors.New("invalid-pod-name")
+	if p.stopped {
+		return errors.New("proxy-stopped")
 	}
 
-	pguid, err := cloudfoundry.DecodeProcessGuid(pod[:randomBits])
-	if err != nil {
-		logger.Error("process-guid-failure", err, lager.Data{"shortened-guid": pod[:randomBits]})
-		return errors.New("invalid-process-guid")
+	// readers follow rotation, so the file that replaces a rotated log is
+	// already being read.
+	if _, exists := p.readers[path]; exists {
+		logger.Info("already-reading")
+		return nil
+	}
+
+	format := p.config.Format
+	if opts.Format != "" {
+		format = opts.Format
 	}
 
-	appID := pguid.AppGuid.String()
-	r, err := retriever.New(source, appID, path, tail)
+	r, err := retriever.New(retriever.Config{
+		Source:         meta.SourceType,
+		SourceInstance: meta.InstanceIndex,
+		AppID:          appID,
+		Filename:       path,
+		Tail:           tail,
+		Format:         format,
+		Checkpoints:    p.config.Checkpoints,
+		Mux:            p.config.Mux,
+		QueueSize:      p.config.QueueSize,
+		Policy:         p.config.Policy,
+		Budget:         p.config.Budget,
+		Notify:         p.config.Notify,
+
+		MaxMessageSize:   p.config.MaxMessageSize,
+		TruncationMarker: p.config.TruncationMarker,
+		Multiline:        p.multilineRule(appID),
+	})
 	if err != nil {
 		logger.Error("new-retriever", err)
 		return err
@@ -64,42 +199,239 @@ func (p *Proxy) Add(pod, container, path string, tail bool) error {
 		return errors.New("invalid-inode")
 	}
 
-	p.mu.Lock()
-	if _, exists := p.inodesToApp[ino]; !exists {
-		p.inodesToApp[ino] = r
-	} else {
-		r = nil
+	// the override applies to the whole app, so a pod whose metadata does
+	// not carry one leaves it in place.
+	counters := p.appCounters(appID)
+	if meta.RateLimit != nil {
+		counters.rateLimit = meta.RateLimit
 	}
-	p.mu.Unlock()
+	counters.limiter.set(p.rateLimit(appID, counters))
+
+	rdr := &reader{
+		LogReader: r,
+		appID:     appID,
+		tags:      meta.Tags,
+		counters:  counters,
+		pod:       pod,
+		container: container,
+		strategy:  opts.Metadata,
+		resolved:  resolved,
+	}
+	counters.drains.readers++
+	rdr.route.Store(p.route(logger, rdr, meta, operator))
+	p.readers[path] = rdr
+	p.copying.Add(1)
 
 	logger.Info("read-logs")
 	go func() {
-		p.copyEvents(logger, appID, r)
+		defer p.copying.Done()
+		p.copyEvents(logger, rdr)
 		p.mu.Lock()
-		delete(p.inodesToApp, ino)
+		delete(p.readers, path)
+		rdr.counters.retire(r)
+		drains := p.releaseDrains(rdr.counters)
+		p.prune(appID, rdr.counters)
 		p.mu.Unlock()
+		closeDrains(logger, drains)
 	}()
 
 	return nil
 }
 
-func (p *Proxy) copyEvents(logger lager.Logger, appID string, logReader *retriever.LogReader) {
-	logger = logger.WithData(lager.Data{"appID": appID})
-	for {
-		select {
-		case msg, ok := <-logReader.Msg:
-			if !ok {
-				logger.Info("closed")
-				return
-			}
+// Reconfigure replaces the proxy's sink and the settings of config that can
+// change while logs are being read: the rate limits, the source rules and
+// what happens to unmatched containers, the operator sink, and the drains.
+// The other fields of config are ignored.
+//
+// Open readers are kept, and the messages they read from then on follow the
+// new settings. The messages of a container that no longer matches a source
+// rule are discarded until the proxy is reconfigured again.
+//
+// It returns once no message is being sent to the previous sinks, which the
+// caller may then close.
+func (p *Proxy) Reconfigure(sink Sink, config Config) {
+	logger := p.logger.Session("reconfigure")
 
-			err := p.eventEmitter.Emit(msg)
-			if err != nil {
-				logger.Error("failed-to-emit-event", err)
+	p.mu.Lock()
+	p.sink = sink
+	p.config.RateLimit = config.RateLimit
+	p.config.AppRateLimits = config.AppRateLimits
+	p.config.SourceRules = config.SourceRules
+	p.config.Unmatched = config.Unmatched
+	p.config.DefaultSource = config.DefaultSource
+	p.config.OperatorSink = config.OperatorSink
+	p.config.AppDrains = config.AppDrains
+	p.config.NewDrain = config.NewDrain
+
+	drains := map[*appCounters]map[string]bool{}
+	for path, r := range p.readers {
+		meta, operator, err := p.metadata(logger, r.strategy, r.resolved, r.pod, r.container)
+		if err != nil {
+			logger.Info("filtering-logs", lager.Data{"path": path, "reason": err.Error()})
+			r.route.Store(&route{filtered: true})
+			continue
+		}
+
+		if drains[r.counters] == nil {
+			drains[r.counters] = map[string]bool{}
+		}
+		if p.config.NewDrain != nil {
+			for _, url := range p.drainURLs(r.appID, meta) {
+				drains[r.counters][url] = true
 			}
-		case err := <-logReader.Err:
-			logger.Error("failed-to-copy-events", err)
+		}
+		r.route.Store(p.route(logger, r, meta, operator))
+	}
+
+	var closed []Sink
+	for appID, c := range p.apps {
+		c.limiter.set(p.rateLimit(appID, c))
+		closed = append(closed, p.pruneDrains(c, drains[c])...)
+	}
+	p.mu.Unlock()
+
+	// messages already on their way to the old routes are sent before the
+	// drains they use are closed.
+	p.sending.Lock()
+	p.sending.Unlock()
+
+	closeDrains(logger, closed)
+	logger.Info("reconfigured")
+}
+
+// Stop stops every reader and waits up to timeout for the messages they have
+// read to be emitted. Logs added afterwards are rejected. The read offsets are
+// saved as SaveCheckpoints does before it returns, even when the timeout
+// expires.
+func (p *Proxy) Stop(timeout time.Duration) error {
+	logger := p.logger.Session("stop")
+
+	p.mu.Lock()
+	p.stopped = true
+	for _, r := range p.readers {
+		r.Stop()
+	}
+	p.mu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		p.copying.Wait()
+		close(done)
+	}()
+
+	var err error
+	select {
+	case <-done:
+		logger.Info("drained")
+	case <-time.After(timeout):
+		logger.Error("timed-out", nil)
+		err = errors.New("stop-timed-out")
+	}
+
+	// readers only checkpoint what has been sent, so what was still queued
+	// when the timeout hit is read again after a restart.
+	if serr := p.SaveCheckpoints(); serr != nil && err == nil {
+		err = serr
+	}
+
+	return err
+}
+
+// SaveCheckpoints writes the read offsets of the messages the sinks have
+// sent to disk, flushing the sinks first. When the flush fails nothing is
+// saved, so that the messages that were held back are read again after a
+// restart.
+func (p *Proxy) SaveCheckpoints() error {
+	logger := p.logger.Session("save-checkpoints")
+
+	p.sending.Lock()
+	defer p.sending.Unlock()
+
+	if p.config.Flush != nil {
+		if err := p.config.Flush(); err != nil {
+			logger.Error("failed-to-flush", err)
+			return err
+		}
+	}
+
+	if err := p.config.Checkpoints.Save(); err != nil {
+		logger.Error("failed-to-save-checkpoints", err)
+		return err
+	}
+	return nil
+}
+
+// route decides where the messages of a reader go. The caller holds p.mu.
+func (p *Proxy) route(logger lager.Logger, r *reader, meta Metadata, operator bool) *route {
+	sink := p.sink
+	if operator && p.config.OperatorSink != nil {
+		sink = p.config.OperatorSink
+	}
+
+	return &route{
+		sink:   p.drainSink(logger, r.counters, sink, p.drainURLs(r.appID, meta)),
+		source: meta.SourceType,
+	}
+}
+
+// rateLimit returns the rate limit of an app. The caller holds p.mu.
+func (p *Proxy) rateLimit(appID string, c *appCounters) RateLimit {
+	return p.config.RateLimit.Merge(p.config.AppRateLimits[appID]).Merge(c.rateLimit)
+}
+
+func (p *Proxy) multilineRule(appID string) *retriever.MultilineRule {
+	if rule, ok := p.config.AppMultiline[appID]; ok {
+		return rule
+	}
+	return p.config.Multiline
+}
+
+func (p *Proxy) copyEvents(logger lager.Logger, r *reader) {
+	logger = logger.WithData(lager.Data{"appID": r.appID})
+	for msg := range r.Msg {
+		p.copyEvent(logger, r, msg)
+	}
+
+	// the reader reports why it stopped before closing Msg.
+	select {
+	case err := <-r.Err:
+		logger.Error("failed-to-copy-events", err)
+	default:
+		logger.Info("closed")
+	}
+}
+
+// copyEvent sends one message of the reader to its route.
+func (p *Proxy) copyEvent(logger lager.Logger, r *reader, msg *events.LogMessage) {
+	p.sending.RLock()
+	defer p.sending.RUnlock()
+	// the checkpoint only moves past messages the sink is done with.
+	defer r.Commit(msg)
+
+	route := r.route.Load().(*route)
+	if route.filtered {
+		atomic.AddUint64(&r.counters.filtered, 1)
+		return
+	}
+	if msg.GetSourceType() != route.source {
+		msg.SourceType = proto.String(route.source)
+	}
+
+	allowed, notice := r.counters.limiter.allow(msg, time.Now())
+	if !allowed {
+		atomic.AddUint64(&r.counters.throttled, 1)
+		if notice == nil {
 			return
 		}
+		logger.Info("rate-limited")
+		msg = notice
+	}
+
+	err := route.sink.Send(msg, r.tags)
+	if err != nil {
+		atomic.AddUint64(&r.counters.emitFailures, 1)
+		logger.Error("failed-to-emit-event", err)
+	} else {
+		atomic.AddUint64(&r.counters.emitted, 1)
 	}
 }
@@ -3,6 +3,9 @@ package proxy_test
 import (
 	"io/ioutil"
 	"os"
+	"time"
+
+	"github.com/cf-furnace/loggingAgent/retriever"
 
 	. "github.com/onsi/ginkgo"
 	. "github.com/onsi/gomega"
@@ -18,6 +21,8 @@ func TestProxy(t *testing.T) {
 }
 
 var _ = BeforeSuite(func() {
+	retriever.OpenRetryInterval = 10 * time.Millisecond
+
 	var err error
 	tmpDir, err = ioutil.TempDir("", "retriever")
 	Expect(err).NotTo(HaveOccurred())
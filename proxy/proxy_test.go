@@ -1,11 +1,17 @@
 package proxy_test
 
 import (
+	"errors"
 	"io/ioutil"
 	"os"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
 
 	"code.cloudfoundry.org/lager/lagertest"
 	. "github.com/cf-furnace/loggingAgent/proxy"
+	"github.com/cf-furnace/loggingAgent/retriever"
 	"github.com/cloudfoundry-incubator/nsync/helpers"
 	"github.com/cloudfoundry/dropsonde/emitter/fake"
 	"github.com/cloudfoundry/sonde-go/events"
@@ -21,22 +27,29 @@ var _ = Describe("Proxy", func() {
 		logger  *lagertest.TestLogger
 		emitter *fake.FakeEventEmitter
 
-		proxy *Proxy
+		config Config
+		proxy  *Proxy
 	)
 
 	BeforeEach(func() {
 		logger = lagertest.NewTestLogger("")
 		emitter = fake.NewFakeEventEmitter("proxy")
-		proxy = New(logger, emitter)
+		config = Config{}
+	})
+
+	JustBeforeEach(func() {
+		proxy = New(logger, NewEmitterSink(emitter), config)
 	})
 
 	Describe("Add", func() {
 		var (
 			appGuid   *uuid.UUID
 			podName   string
+			namespace string
 			container string
 			logPath   string
 			tail      bool
+			opts      LogOptions
 
 			addError error
 		)
@@ -50,13 +63,15 @@ var _ = Describe("Proxy", func() {
 			Expect(err).NotTo(HaveOccurred())
 
 			podName = pg.ShortenedGuid() + "-rand"
+			namespace = "namespace"
 			container = "application-XXX"
 			logPath = "path"
 			tail = false
+			opts = LogOptions{}
 		})
 
 		JustBeforeEach(func() {
-			addError = proxy.Add(podName, container, logPath, tail)
+			addError = proxy.AddWithOptions(podName, namespace, container, logPath, tail, opts)
 		})
 
 		Context("with an unsupported container name", func() {
@@ -100,12 +115,12 @@ var _ = Describe("Proxy", func() {
 				Expect(err).NotTo(HaveOccurred())
 				logPath = logFile.Name()
 				logFile.WriteString(`{
-					"log": "a stdout message",
+					"log": "a stdout message\n",
 					"stream": "out",
 					"time": "2009-11-10T23:00:00Z"
 				}
 				{
-					"log": "a stderr message",
+					"log": "a stderr message\n",
 					"stream": "err",
 					"time": "2009-11-10T23:00:00Z"
 				}`)
@@ -164,6 +179,513 @@ var _ = Describe("Proxy", func() {
 				})
 			})
 
+			Context("with a task container", func() {
+				BeforeEach(func() {
+					container = "task-migrate"
+				})
+
+				It("emits TASK log messages", func() {
+					Eventually(emitter.GetEvents).Should(HaveLen(2))
+					msg := emitter.GetEvents()[0].(*events.LogMessage)
+					Expect(msg.GetSourceType()).To(Equal("TASK"))
+				})
+			})
+
+			Context("with source rules", func() {
+				BeforeEach(func() {
+					container = "sidecar-envoy"
+					config.SourceRules = []SourceRule{
+						{Pattern: regexp.MustCompile(`^sidecar-`), SourceType: "SIDECAR"},
+					}
+				})
+
+				It("uses the matching rule", func() {
+					Eventually(emitter.GetEvents).Should(HaveLen(2))
+					msg := emitter.GetEvents()[0].(*events.LogMessage)
+					Expect(msg.GetSourceType()).To(Equal("SIDECAR"))
+				})
+			})
+
+			Context("with an unmatched container", func() {
+				BeforeEach(func() {
+					container = "istio-proxy"
+					config.DefaultSource = "OPS"
+				})
+
+				Context("and the default policy", func() {
+					BeforeEach(func() {
+						config.Unmatched = UnmatchedDefault
+					})
+
+					It("emits messages with the default source", func() {
+						Eventually(emitter.GetEvents).Should(HaveLen(2))
+						msg := emitter.GetEvents()[0].(*events.LogMessage)
+						Expect(msg.GetSourceType()).To(Equal("OPS"))
+						Expect(msg.GetAppId()).To(Equal(appGuid.String()))
+					})
+				})
+
+				Context("and the operator policy", func() {
+					var operatorEmitter *fake.FakeEventEmitter
+
+					BeforeEach(func() {
+						operatorEmitter = fake.NewFakeEventEmitter("operator")
+						config.Unmatched = UnmatchedOperator
+						config.OperatorSink = NewEmitterSink(operatorEmitter)
+						podName = "kube-dns"
+					})
+
+					It("emits the messages to the operator emitter", func() {
+						Expect(addError).NotTo(HaveOccurred())
+						Eventually(operatorEmitter.GetEvents).Should(HaveLen(2))
+						msg := operatorEmitter.GetEvents()[0].(*events.LogMessage)
+						Expect(msg.GetSourceType()).To(Equal("OPS"))
+						Expect(msg.GetAppId()).To(BeEmpty())
+						Consistently(emitter.GetEvents).Should(BeEmpty())
+					})
+				})
+			})
+
+			Context("with a format for the log", func() {
+				BeforeEach(func() {
+					config.Format = retriever.FormatCRI
+					opts.Format = retriever.FormatJSON
+				})
+
+				It("decodes the log with it", func() {
+					Eventually(emitter.GetEvents).Should(HaveLen(2))
+					msg := emitter.GetEvents()[0].(*events.LogMessage)
+					Expect(string(msg.Message)).To(Equal("a stdout message"))
+				})
+			})
+
+			Context("with a node log", func() {
+				var operatorEmitter *fake.FakeEventEmitter
+
+				BeforeEach(func() {
+					operatorEmitter = fake.NewFakeEventEmitter("operator")
+					config.DefaultSource = "NODE"
+					config.OperatorSink = NewEmitterSink(operatorEmitter)
+					podName = ""
+					container = "kubelet"
+					opts.Metadata = MetadataNode
+				})
+
+				It("emits the messages to the operator emitter", func() {
+					Expect(addError).NotTo(HaveOccurred())
+					Eventually(operatorEmitter.GetEvents).Should(HaveLen(2))
+					msg := operatorEmitter.GetEvents()[0].(*events.LogMessage)
+					Expect(msg.GetSourceType()).To(Equal("NODE"))
+					Expect(msg.GetAppId()).To(Equal("kubelet"))
+					Expect(logger.LogMessages()).NotTo(ContainElement(".proxy.pod-name-failure"))
+				})
+
+				It("counts the messages of each component apart", func() {
+					otherLog, err := ioutil.TempFile(tmpDir, "node")
+					Expect(err).NotTo(HaveOccurred())
+					defer os.Remove(otherLog.Name())
+					otherLog.WriteString(`{"log": "started\n", "stream": "out", "time": "2009-11-10T23:00:00Z"}` + "\n")
+					otherLog.Close()
+
+					Expect(proxy.AddWithOptions("", "", "containerd", otherLog.Name(), tail, opts)).To(Succeed())
+
+					Eventually(operatorEmitter.GetEvents).Should(HaveLen(3))
+					Eventually(func() uint64 { return proxy.AppStats()["containerd"].MessagesEmitted }).Should(Equal(uint64(1)))
+					Expect(proxy.AppStats()["kubelet"].MessagesEmitted).To(Equal(uint64(2)))
+				})
+			})
+
+			Context("with a pod name ending in digits", func() {
+				BeforeEach(func() {
+					podName = podName[:strings.LastIndex(podName, "-")] + "-2"
+				})
+
+				It("does not take them for the instance index", func() {
+					Eventually(emitter.GetEvents).Should(HaveLen(2))
+					msg := emitter.GetEvents()[0].(*events.LogMessage)
+					Expect(msg.GetSourceInstance()).To(Equal("??"))
+				})
+			})
+
+			Context("with a metadata resolver", func() {
+				var resolver fakeMetadataResolver
+
+				BeforeEach(func() {
+					resolver = fakeMetadataResolver{"namespace/" + podName: {InstanceIndex: "7"}}
+					config.MetadataResolver = resolver
+				})
+
+				It("uses the resolved instance index", func() {
+					Eventually(emitter.GetEvents).Should(HaveLen(2))
+					msg := emitter.GetEvents()[0].(*events.LogMessage)
+					Expect(msg.GetSourceInstance()).To(Equal("7"))
+					Expect(msg.GetSourceType()).To(Equal("APP"))
+					Expect(msg.GetAppId()).To(Equal(appGuid.String()))
+				})
+
+				Context("when the log's metadata comes from its name", func() {
+					BeforeEach(func() {
+						opts.Metadata = MetadataNames
+					})
+
+					It("does not ask the resolver", func() {
+						Eventually(emitter.GetEvents).Should(HaveLen(2))
+						msg := emitter.GetEvents()[0].(*events.LogMessage)
+						Expect(msg.GetSourceInstance()).To(Equal("??"))
+					})
+				})
+
+				Context("when it supplies the app and source", func() {
+					BeforeEach(func() {
+						resolver["namespace/"+podName] = Metadata{AppID: "resolved-app", SourceType: "TASK"}
+						container = "sidecar"
+					})
+
+					It("does not need the pod or container names", func() {
+						Expect(addError).NotTo(HaveOccurred())
+						Eventually(emitter.GetEvents).Should(HaveLen(2))
+						msg := emitter.GetEvents()[0].(*events.LogMessage)
+						Expect(msg.GetAppId()).To(Equal("resolved-app"))
+						Expect(msg.GetSourceType()).To(Equal("TASK"))
+					})
+				})
+
+				Context("when it supplies tags", func() {
+					BeforeEach(func() {
+						resolver["namespace/"+podName] = Metadata{Tags: map[string]string{"space_name": "dev"}}
+					})
+
+					It("emits tagged envelopes", func() {
+						Eventually(emitter.GetEnvelopes).Should(HaveLen(2))
+						envelope := emitter.GetEnvelopes()[0]
+						Expect(envelope.Tags).To(Equal(map[string]string{"space_name": "dev"}))
+						Expect(envelope.LogMessage.GetAppId()).To(Equal(appGuid.String()))
+					})
+				})
+			})
+
+			Context("with a multiline rule for the app", func() {
+				BeforeEach(func() {
+					err := ioutil.WriteFile(logPath, []byte(
+						`{"log": "a stdout message\n", "stream": "out", "time": "2009-11-10T23:00:00Z"}
+						{"log": "  continued\n", "stream": "out", "time": "2009-11-10T23:00:00Z"}`,
+					), 0644)
+					Expect(err).NotTo(HaveOccurred())
+
+					config.AppMultiline = map[string]*retriever.MultilineRule{
+						appGuid.String(): {
+							Continuation: retriever.DefaultContinuation,
+							FlushTimeout: 10 * time.Millisecond,
+						},
+					}
+				})
+
+				It("joins the lines", func() {
+					Eventually(emitter.GetEvents).Should(HaveLen(1))
+					msg := emitter.GetEvents()[0].(*events.LogMessage)
+					Expect(string(msg.Message)).To(Equal("a stdout message\n  continued"))
+				})
+			})
+
+			Context("with a rate limit", func() {
+				BeforeEach(func() {
+					config.RateLimit = RateLimit{LinesPerSecond: 1}
+				})
+
+				It("replaces the messages over the limit with a notice", func() {
+					Eventually(emitter.GetEvents).Should(HaveLen(2))
+					Consistently(emitter.GetEvents).Should(HaveLen(2))
+
+					msgs := emitter.GetEvents()
+					Expect(string(msgs[0].(*events.LogMessage).Message)).To(Equal("a stdout message"))
+
+					notice := msgs[1].(*events.LogMessage)
+					Expect(string(notice.Message)).To(Equal("app instance exceeded log rate limit (1 log-lines/sec) set by platform operator"))
+					Expect(notice.GetMessageType()).To(Equal(events.LogMessage_ERR))
+					Expect(notice.GetAppId()).To(Equal(appGuid.String()))
+					Expect(notice.GetSourceType()).To(Equal("APP"))
+
+					Expect(proxy.Stats().Throttled).To(Equal(uint64(1)))
+				})
+
+				Context("when the app has its own limit", func() {
+					BeforeEach(func() {
+						config.AppRateLimits = map[string]*RateLimit{appGuid.String(): {LinesPerSecond: 100}}
+					})
+
+					It("applies the app's limit", func() {
+						Eventually(emitter.GetEvents).Should(HaveLen(2))
+						Expect(proxy.Stats().Throttled).To(BeZero())
+					})
+				})
+
+				Context("when the app turns it off", func() {
+					BeforeEach(func() {
+						config.AppRateLimits = map[string]*RateLimit{appGuid.String(): {LinesPerSecond: Unlimited}}
+					})
+
+					It("does not limit the app", func() {
+						Eventually(emitter.GetEvents).Should(HaveLen(2))
+						Expect(proxy.Stats().Throttled).To(BeZero())
+					})
+				})
+
+				Context("when the app overrides it", func() {
+					BeforeEach(func() {
+						config.MetadataResolver = fakeMetadataResolver{
+							"namespace/" + podName: {RateLimit: &RateLimit{LinesPerSecond: 100}},
+						}
+					})
+
+					It("applies the app's limit", func() {
+						Eventually(emitter.GetEvents).Should(HaveLen(2))
+						msg := emitter.GetEvents()[1].(*events.LogMessage)
+						Expect(string(msg.Message)).To(Equal("a stderr message"))
+						Expect(proxy.Stats().Throttled).To(BeZero())
+					})
+
+					It("keeps the override when another pod of the app has none", func() {
+						Eventually(emitter.GetEvents).Should(HaveLen(2))
+
+						otherLog, err := ioutil.TempFile(tmpDir, "logfile")
+						Expect(err).NotTo(HaveOccurred())
+						defer os.Remove(otherLog.Name())
+						otherLog.WriteString(`{"log": "another message\n", "stream": "out", "time": "2009-11-10T23:00:00Z"}
+							{"log": "and another\n", "stream": "out", "time": "2009-11-10T23:00:00Z"}`)
+						otherLog.Close()
+
+						otherPod := strings.TrimSuffix(podName, "-rand") + "-other"
+						Expect(proxy.Add(otherPod, namespace, container, otherLog.Name(), tail)).To(Succeed())
+
+						Eventually(emitter.GetEvents).Should(HaveLen(4))
+						Expect(proxy.Stats().Throttled).To(BeZero())
+					})
+				})
+			})
+
+			Context("with syslog drains", func() {
+				var drains map[string]*fakeSink
+
+				BeforeEach(func() {
+					drains = map[string]*fakeSink{}
+					config.NewDrain = func(url string) (Sink, error) {
+						if url == "invalid" {
+							return nil, errors.New("invalid drain")
+						}
+						drains[url] = &fakeSink{}
+						return drains[url], nil
+					}
+					config.AppDrains = map[string][]string{appGuid.String(): {"syslog://one", "invalid"}}
+					config.MetadataResolver = fakeMetadataResolver{
+						"namespace/" + podName: {
+							Drains: []string{"syslog://two", "syslog://one"},
+							Tags:   map[string]string{"app_name": "app"},
+						},
+					}
+				})
+
+				It("forwards the messages to every drain of the app", func() {
+					Eventually(emitter.GetEnvelopes).Should(HaveLen(2))
+					Expect(drains).To(HaveLen(2))
+					for _, drain := range drains {
+						Expect(drain.messages()).To(HaveLen(2))
+						Expect(drain.tags[0]).To(Equal(map[string]string{"app_name": "app"}))
+					}
+					Expect(logger.LogMessages()).To(ContainElement(".proxy.invalid-drain"))
+				})
+
+				It("closes the drains it no longer uses when reconfigured", func() {
+					Eventually(emitter.GetEnvelopes).Should(HaveLen(2))
+
+					proxy.Reconfigure(NewEmitterSink(emitter), Config{})
+					Expect(drains["syslog://one"].isClosed()).To(BeTrue())
+					Expect(drains["syslog://two"].isClosed()).To(BeTrue())
+				})
+
+				It("closes the drains when the app's logs are gone", func() {
+					Eventually(emitter.GetEnvelopes).Should(HaveLen(2))
+					Expect(drains["syslog://one"].isClosed()).To(BeFalse())
+
+					os.Remove(logFile.Name())
+					Eventually(drains["syslog://one"].isClosed).Should(BeTrue())
+					Expect(drains["syslog://two"].isClosed()).To(BeTrue())
+				})
+			})
+
+			Context("when the proxy is reconfigured", func() {
+				appendLog := func() {
+					f, err := os.OpenFile(logFile.Name(), os.O_APPEND|os.O_WRONLY, 0644)
+					Expect(err).NotTo(HaveOccurred())
+					defer f.Close()
+					_, err = f.WriteString(`{"log": "another message\n", "stream": "out", "time": "2009-11-10T23:00:01Z"}` + "\n")
+					Expect(err).NotTo(HaveOccurred())
+				}
+
+				It("sends the next messages as the new settings say", func() {
+					Eventually(emitter.GetEvents).Should(HaveLen(2))
+
+					newEmitter := fake.NewFakeEventEmitter("new")
+					proxy.Reconfigure(NewEmitterSink(newEmitter), Config{
+						SourceRules: []SourceRule{{Prefix: "application-", SourceType: "WEB"}},
+					})
+					appendLog()
+
+					Eventually(newEmitter.GetEvents).Should(HaveLen(1))
+					msg := newEmitter.GetEvents()[0].(*events.LogMessage)
+					Expect(string(msg.Message)).To(Equal("another message"))
+					Expect(msg.GetSourceType()).To(Equal("WEB"))
+					Expect(emitter.GetEvents()).To(HaveLen(2))
+				})
+
+				It("waits for the messages being sent to the old sink", func() {
+					Eventually(emitter.GetEvents).Should(HaveLen(2))
+
+					old := &blockingSink{sending: make(chan struct{}), release: make(chan struct{})}
+					proxy.Reconfigure(old, Config{})
+					appendLog()
+					Eventually(old.sending).Should(BeClosed())
+
+					reconfigured := make(chan struct{})
+					go func(proxy *Proxy, reconfigured chan struct{}) {
+						proxy.Reconfigure(NewEmitterSink(emitter), Config{})
+						close(reconfigured)
+					}(proxy, reconfigured)
+
+					Consistently(reconfigured).ShouldNot(BeClosed())
+					close(old.release)
+					Eventually(reconfigured).Should(BeClosed())
+				})
+
+				It("discards the messages of containers that no longer match", func() {
+					Eventually(emitter.GetEvents).Should(HaveLen(2))
+
+					proxy.Reconfigure(NewEmitterSink(emitter), Config{
+						SourceRules: []SourceRule{{Prefix: "staging-", SourceType: "STG"}},
+					})
+					appendLog()
+
+					Eventually(func() uint64 { return proxy.Stats().Filtered }).Should(Equal(uint64(1)))
+					Expect(emitter.GetEvents()).To(HaveLen(2))
+					Expect(proxy.Stats().ActiveReaders).To(Equal(1))
+				})
+			})
+
+			Context("when the log is already being read", func() {
+				It("does not read it again", func() {
+					Eventually(emitter.GetEvents).Should(HaveLen(2))
+
+					Expect(proxy.Add(podName, namespace, container, logPath, tail)).To(Succeed())
+					Consistently(emitter.GetEvents).Should(HaveLen(2))
+					Expect(logger.LogMessages()).To(ContainElement(".proxy.already-reading"))
+				})
+			})
+
+			Context("when reporting metrics", func() {
+				var (
+					sender *fakeMetricSender
+					stop   chan struct{}
+				)
+
+				BeforeEach(func() {
+					sender = &fakeMetricSender{counters: map[string]uint64{}, values: map[string]float64{}}
+					stop = make(chan struct{})
+				})
+
+				AfterEach(func() {
+					close(stop)
+				})
+
+				It("counts the messages it reads and emits", func() {
+					Eventually(proxy.Stats).Should(And(
+						HaveField("MessagesEmitted", uint64(2)),
+						HaveField("ActiveReaders", 1),
+					))
+					stats := proxy.Stats()
+					Expect(stats.LinesRead).To(Equal(uint64(2)))
+					Expect(stats.EmitFailures).To(BeZero())
+				})
+
+				It("counts the messages of failed batches as emit failures", func() {
+					Eventually(emitter.GetEvents).Should(HaveLen(2))
+					var envelopes []*events.Envelope
+					for _, event := range emitter.GetEvents() {
+						envelopes = append(envelopes, &events.Envelope{LogMessage: event.(*events.LogMessage)})
+					}
+					proxy.EmitFailed(envelopes)
+
+					Expect(proxy.AppStats()[appGuid.String()].EmitFailures).To(Equal(uint64(2)))
+				})
+
+				It("sends them to the metric sender", func() {
+					Eventually(emitter.GetEvents).Should(HaveLen(2))
+					go proxy.ReportMetrics(sender, 10*time.Millisecond, stop)
+
+					Eventually(func() uint64 { return sender.counter(MessagesEmittedMetric) }).Should(Equal(uint64(2)))
+					Consistently(func() uint64 { return sender.counter(LinesReadMetric) }).Should(Equal(uint64(2)))
+					Expect(sender.value(ActiveReadersMetric)).To(Equal(float64(1)))
+				})
+			})
+
+			Context("when the proxy is stopped", func() {
+				var checkpointFile string
+
+				BeforeEach(func() {
+					checkpointFile = logPath + ".checkpoints"
+					checkpoints, err := retriever.LoadCheckpoints(checkpointFile)
+					Expect(err).NotTo(HaveOccurred())
+
+					config.Checkpoints = checkpoints
+					config.Multiline = &retriever.MultilineRule{
+						Continuation: retriever.DefaultContinuation,
+						FlushTimeout: time.Hour,
+					}
+				})
+
+				AfterEach(func() {
+					os.Remove(checkpointFile)
+				})
+
+				It("emits the held back messages and saves the offsets", func() {
+					Eventually(emitter.GetEvents).Should(HaveLen(1))
+
+					Expect(proxy.Stop(time.Second)).To(Succeed())
+					Expect(emitter.GetEvents()).To(HaveLen(2))
+					Expect(logger.LogMessages()).To(ContainElement(".proxy.closed"))
+					Expect(checkpointFile).To(BeARegularFile())
+				})
+
+				Context("when the sink holds messages back", func() {
+					var flushErr error
+
+					BeforeEach(func() {
+						flushErr = nil
+						config.Flush = func() error {
+							if flushErr == nil {
+								_, err := os.Stat(checkpointFile)
+								Expect(os.IsNotExist(err)).To(BeTrue())
+							}
+							return flushErr
+						}
+					})
+
+					It("flushes the sink before saving the offsets", func() {
+						Expect(proxy.Stop(time.Second)).To(Succeed())
+						Expect(checkpointFile).To(BeARegularFile())
+					})
+
+					It("does not save the offsets when the flush fails", func() {
+						flushErr = errors.New("flush failed")
+						Expect(proxy.Stop(time.Second)).To(MatchError("flush failed"))
+						Expect(checkpointFile).NotTo(BeAnExistingFile())
+					})
+				})
+
+				It("rejects new logs", func() {
+					Expect(proxy.Stop(time.Second)).To(Succeed())
+					Expect(proxy.Add(podName, namespace, container, logPath, tail)).To(MatchError("proxy-stopped"))
+				})
+			})
+
 			Context("when the log is deleted", func() {
 				It("closes the proxy", func() {
 					Eventually(emitter.GetEvents).Should(HaveLen(2))
@@ -171,7 +693,73 @@ var _ = Describe("Proxy", func() {
 					os.Remove(logFile.Name())
 					Eventually(logger.LogMessages).Should(ContainElement(".proxy.closed"))
 				})
+
+				It("folds the counters of the app into the totals", func() {
+					Eventually(emitter.GetEvents).Should(HaveLen(2))
+
+					os.Remove(logFile.Name())
+					Eventually(proxy.AppStats).Should(BeEmpty())
+					Expect(proxy.Stats().MessagesEmitted).To(Equal(uint64(2)))
+					Expect(proxy.Stats().LinesRead).To(Equal(uint64(2)))
+				})
 			})
 		})
 	})
 })
+
+// blockingSink closes sending when a message is sent to it and holds the
+// message until release is closed.
+type blockingSink struct {
+	sending chan struct{}
+	release chan struct{}
+	once    sync.Once
+}
+
+func (s *blockingSink) Send(msg *events.LogMessage, tags map[string]string) error {
+	s.once.Do(func() { close(s.sending) })
+	<-s.release
+	return nil
+}
+
+func (s *blockingSink) Close() error {
+	return nil
+}
+
+type fakeMetadataResolver map[string]Metadata
+
+func (f fakeMetadataResolver) Resolve(namespace, pod, container string) (Metadata, bool) {
+	meta, ok := f[namespace+"/"+pod]
+	return meta, ok
+}
+
+type fakeMetricSender struct {
+	mu       sync.Mutex
+	counters map[string]uint64
+	values   map[string]float64
+}
+
+func (f *fakeMetricSender) SendValue(name string, value float64, unit string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.values[name] = value
+	return nil
+}
+
+func (f *fakeMetricSender) AddToCounter(name string, delta uint64) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.counters[name] += delta
+	return nil
+}
+
+func (f *fakeMetricSender) counter(name string) uint64 {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.counters[name]
+}
+
+func (f *fakeMetricSender) value(name string) float64 {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.values[name]
+}
@@ -0,0 +1,170 @@
+package proxy
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/cloudfoundry/sonde-go/events"
+	"github.com/gogo/protobuf/proto"
+)
+
+// RateLimit bounds how fast the messages of an app are emitted, across all
+// of its containers on the node. A zero or negative rate is not enforced,
+// and a zero or negative burst allows one second's worth of messages.
+type RateLimit struct {
+	LinesPerSecond float64
+	LineBurst      float64
+	BytesPerSecond float64
+	ByteBurst      float64
+}
+
+// Unlimited, given for a rate in an override, turns off the limit the
+// override is merged into. Zero leaves it in place.
+const Unlimited = -1
+
+// Merge returns limit with the non-zero fields of override applied, so that
+// a negative field such as Unlimited turns the limit off.
+func (limit RateLimit) Merge(override *RateLimit) RateLimit {
+	if override == nil {
+		return limit
+	}
+
+	merged := limit
+	for _, f := range []struct{ dst, src *float64 }{
+		{&merged.LinesPerSecond, &override.LinesPerSecond},
+		{&merged.LineBurst, &override.LineBurst},
+		{&merged.BytesPerSecond, &override.BytesPerSecond},
+		{&merged.ByteBurst, &override.ByteBurst},
+	} {
+		if *f.src != 0 {
+			*f.dst = *f.src
+		}
+	}
+	return merged
+}
+
+func (limit RateLimit) String() string {
+	var limits []string
+	if limit.LinesPerSecond > 0 {
+		limits = append(limits, fmt.Sprintf("%g log-lines/sec", limit.LinesPerSecond))
+	}
+	if limit.BytesPerSecond > 0 {
+		limits = append(limits, fmt.Sprintf("%g bytes/sec", limit.BytesPerSecond))
+	}
+	return strings.Join(limits, ", ")
+}
+
+// noticeInterval is the least time between two rate limit notices sent to
+// an app.
+const noticeInterval = time.Second
+
+// limiter applies a RateLimit with a token bucket for lines and one for
+// bytes.
+type limiter struct {
+	mu     sync.Mutex
+	limit  RateLimit
+	lines  bucket
+	bytes  bucket
+	notice time.Time
+}
+
+func (l *limiter) set(limit RateLimit) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.limit == limit {
+		return
+	}
+	l.limit = limit
+	l.lines.update(limit.LinesPerSecond, limit.LineBurst)
+	l.bytes.update(limit.BytesPerSecond, limit.ByteBurst)
+}
+
+// allow reports whether msg may be emitted now. When it may not, it also
+// returns a notice for the app unless one was returned recently.
+func (l *limiter) allow(msg *events.LogMessage, now time.Time) (bool, *events.LogMessage) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	size := float64(len(msg.Message))
+	if l.lines.allows(1, now) && l.bytes.allows(size, now) {
+		l.lines.take(1)
+		l.bytes.take(size)
+		return true, nil
+	}
+
+	if now.Sub(l.notice) < noticeInterval {
+		return false, nil
+	}
+	l.notice = now
+
+	msgType := events.LogMessage_ERR
+	return false, &events.LogMessage{
+		Message:        []byte(fmt.Sprintf("app instance exceeded log rate limit (%s) set by platform operator", l.limit)),
+		AppId:          msg.AppId,
+		MessageType:    &msgType,
+		SourceType:     msg.SourceType,
+		SourceInstance: msg.SourceInstance,
+		Timestamp:      proto.Int64(now.UnixNano()),
+	}
+}
+
+// bucket is a token bucket. A bucket with no rate allows everything.
+type bucket struct {
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+func newBucket(rate, burst float64) bucket {
+	if burst <= 0 {
+		burst = rate
+	}
+	return bucket{rate: rate, burst: burst, tokens: burst}
+}
+
+// update changes the rate and burst of the bucket. The tokens it holds are
+// kept, up to the new burst, so that changing the limit does not grant a
+// fresh burst. A bucket that had no rate starts full.
+func (b *bucket) update(rate, burst float64) {
+	if b.rate <= 0 {
+		*b = newBucket(rate, burst)
+		return
+	}
+
+	if burst <= 0 {
+		burst = rate
+	}
+	b.rate, b.burst = rate, burst
+	if b.tokens > burst {
+		b.tokens = burst
+	}
+}
+
+// allows refills the bucket and reports whether n tokens may be taken. A
+// request larger than the burst is allowed when the bucket is full, leaving
+// it in debt.
+func (b *bucket) allows(n float64, now time.Time) bool {
+	if b.rate <= 0 {
+		return true
+	}
+
+	if !b.last.IsZero() {
+		b.tokens += now.Sub(b.last).Seconds() * b.rate
+		if b.tokens > b.burst {
+			b.tokens = b.burst
+		}
+	}
+	b.last = now
+
+	return b.tokens >= n || b.tokens >= b.burst
+}
+
+func (b *bucket) take(n float64) {
+	if b.rate > 0 {
+		b.tokens -= n
+	}
+}
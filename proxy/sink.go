@@ -0,0 +1,71 @@
+package proxy
+
+import (
+	"io"
+
+	"github.com/cloudfoundry/dropsonde"
+	"github.com/cloudfoundry/dropsonde/emitter"
+	"github.com/cloudfoundry/sonde-go/events"
+)
+
+// A Sink delivers the messages the proxy reads. Tags describe the app the
+// message belongs to, for example its space and organization, and may be
+// nil.
+type Sink interface {
+	Send(msg *events.LogMessage, tags map[string]string) error
+}
+
+// EmitterSink sends messages through a dropsonde emitter, wrapping them in
+// an envelope carrying the tags when there are any.
+type EmitterSink struct {
+	Emitter dropsonde.EventEmitter
+}
+
+func NewEmitterSink(eventEmitter dropsonde.EventEmitter) *EmitterSink {
+	return &EmitterSink{Emitter: eventEmitter}
+}
+
+func (s *EmitterSink) Send(msg *events.LogMessage, tags map[string]string) error {
+	if len(tags) == 0 {
+		return s.Emitter.Emit(msg)
+	}
+
+	envelope, err := emitter.Wrap(msg, s.Emitter.Origin())
+	if err != nil {
+		return err
+	}
+	envelope.Tags = tags
+
+	return s.Emitter.EmitEnvelope(envelope)
+}
+
+// FanOut sends every message to each of its sinks. A failing sink does not
+// keep the message from the others.
+type FanOut []Sink
+
+// Send returns the first error reported by a sink.
+func (f FanOut) Send(msg *events.LogMessage, tags map[string]string) error {
+	var firstErr error
+	for _, sink := range f {
+		err := sink.Send(msg, tags)
+		if err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+// Close closes the sinks that implement io.Closer and returns the first
+// error.
+func (f FanOut) Close() error {
+	var firstErr error
+	for _, sink := range f {
+		if closer, ok := sink.(io.Closer); ok {
+			err := closer.Close()
+			if err != nil && firstErr == nil {
+				firstErr = err
+			}
+		}
+	}
+	return firstErr
+}
@@ -0,0 +1,107 @@
+package proxy_test
+
+import (
+	"errors"
+	"sync"
+
+	. "github.com/cf-furnace/loggingAgent/proxy"
+	"github.com/cloudfoundry/dropsonde/emitter/fake"
+	"github.com/cloudfoundry/sonde-go/events"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Sinks", func() {
+	var msg *events.LogMessage
+
+	BeforeEach(func() {
+		msg = &events.LogMessage{Message: []byte("a message")}
+	})
+
+	Describe("EmitterSink", func() {
+		var emitter *fake.FakeEventEmitter
+
+		BeforeEach(func() {
+			emitter = fake.NewFakeEventEmitter("origin")
+		})
+
+		It("emits untagged messages as events", func() {
+			Expect(NewEmitterSink(emitter).Send(msg, nil)).To(Succeed())
+			Expect(emitter.GetEvents()).To(ConsistOf(msg))
+		})
+
+		It("emits tagged messages in envelopes", func() {
+			Expect(NewEmitterSink(emitter).Send(msg, map[string]string{"space_name": "dev"})).To(Succeed())
+			Expect(emitter.GetEnvelopes()).To(HaveLen(1))
+
+			envelope := emitter.GetEnvelopes()[0]
+			Expect(envelope.GetOrigin()).To(Equal("origin"))
+			Expect(envelope.Tags).To(Equal(map[string]string{"space_name": "dev"}))
+			Expect(envelope.LogMessage).To(Equal(msg))
+		})
+	})
+
+	Describe("FanOut", func() {
+		var first, second *fake.FakeEventEmitter
+
+		BeforeEach(func() {
+			first = fake.NewFakeEventEmitter("first")
+			second = fake.NewFakeEventEmitter("second")
+		})
+
+		It("sends messages to every sink", func() {
+			fanOut := FanOut{NewEmitterSink(first), NewEmitterSink(second)}
+			Expect(fanOut.Send(msg, nil)).To(Succeed())
+			Expect(first.GetEvents()).To(ConsistOf(msg))
+			Expect(second.GetEvents()).To(ConsistOf(msg))
+		})
+
+		It("keeps sending when a sink fails", func() {
+			first.ReturnError = errors.New("boom")
+			fanOut := FanOut{NewEmitterSink(first), NewEmitterSink(second)}
+			Expect(fanOut.Send(msg, nil)).To(MatchError("boom"))
+			Expect(second.GetEvents()).To(ConsistOf(msg))
+		})
+
+		It("closes the sinks that can be closed", func() {
+			closer := &fakeSink{}
+			Expect(FanOut{NewEmitterSink(first), closer}.Close()).To(Succeed())
+			Expect(closer.isClosed()).To(BeTrue())
+		})
+	})
+})
+
+type fakeSink struct {
+	mu     sync.Mutex
+	msgs   []*events.LogMessage
+	tags   []map[string]string
+	closed bool
+}
+
+func (s *fakeSink) Send(msg *events.LogMessage, tags map[string]string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.msgs = append(s.msgs, msg)
+	s.tags = append(s.tags, tags)
+	return nil
+}
+
+func (s *fakeSink) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.closed = true
+	return nil
+}
+
+func (s *fakeSink) messages() []*events.LogMessage {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]*events.LogMessage{}, s.msgs...)
+}
+
+func (s *fakeSink) isClosed() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.closed
+}
@@ -0,0 +1,94 @@
+package proxy
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// A SourceRule gives the containers whose names match it a source type. A
+// rule matches either by name prefix or by regular expression.
+type SourceRule struct {
+	Prefix     string
+	Pattern    *regexp.Regexp
+	SourceType string
+}
+
+func (r SourceRule) matches(container string) bool {
+	if r.Pattern != nil {
+		return r.Pattern.MatchString(container)
+	}
+	return strings.HasPrefix(container, r.Prefix)
+}
+
+// DefaultSourceRules are used when no rules are configured.
+var DefaultSourceRules = []SourceRule{
+	{Prefix: "application-", SourceType: "APP"},
+	{Prefix: "staging-", SourceType: "STG"},
+	{Prefix: "task-", SourceType: "TASK"},
+}
+
+// ParseSourceRule parses a rule written as prefix:<prefix>=<SOURCE> or
+// regexp:<pattern>=<SOURCE>.
+func ParseSourceRule(value string) (SourceRule, error) {
+	colon := strings.Index(value, ":")
+	equals := strings.LastIndex(value, "=")
+	if colon == -1 || equals < colon || equals == len(value)-1 {
+		return SourceRule{}, fmt.Errorf("expected prefix:<prefix>=<SOURCE> or regexp:<pattern>=<SOURCE>, got %q", value)
+	}
+
+	kind, match, source := value[:colon], value[colon+1:equals], value[equals+1:]
+	switch kind {
+	case "prefix":
+		return SourceRule{Prefix: match, SourceType: source}, nil
+	case "regexp":
+		pattern, err := regexp.Compile(match)
+		if err != nil {
+			return SourceRule{}, err
+		}
+		return SourceRule{Pattern: pattern, SourceType: source}, nil
+	default:
+		return SourceRule{}, fmt.Errorf("unknown source rule kind %q", kind)
+	}
+}
+
+// UnmatchedPolicy decides what happens to the logs of containers that no
+// source rule matches.
+type UnmatchedPolicy string
+
+const (
+	// UnmatchedDrop ignores the container.
+	UnmatchedDrop UnmatchedPolicy = "drop"
+	// UnmatchedDefault forwards the logs with the default source type.
+	UnmatchedDefault UnmatchedPolicy = "default"
+	// UnmatchedOperator forwards the logs with the default source type to
+	// the operator emitter. They do not need to belong to an app.
+	UnmatchedOperator UnmatchedPolicy = "operator"
+)
+
+// ParseUnmatchedPolicy converts a policy name into an UnmatchedPolicy. An
+// empty name means UnmatchedDrop.
+func ParseUnmatchedPolicy(name string) (UnmatchedPolicy, error) {
+	switch policy := UnmatchedPolicy(name); policy {
+	case "":
+		return UnmatchedDrop, nil
+	case UnmatchedDrop, UnmatchedDefault, UnmatchedOperator:
+		return policy, nil
+	default:
+		return "", fmt.Errorf("unknown unmatched container policy %q", name)
+	}
+}
+
+func (p *Proxy) sourceType(container string) (string, bool) {
+	rules := p.config.SourceRules
+	if rules == nil {
+		rules = DefaultSourceRules
+	}
+
+	for _, rule := range rules {
+		if rule.matches(container) {
+			return rule.SourceType, true
+		}
+	}
+	return "", false
+}
@@ -0,0 +1,54 @@
+package proxy_test
+
+import (
+	. "github.com/cf-furnace/loggingAgent/proxy"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Sources", func() {
+	Describe("ParseSourceRule", func() {
+		It("parses prefix rules", func() {
+			rule, err := ParseSourceRule("prefix:task-=TASK")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(rule).To(Equal(SourceRule{Prefix: "task-", SourceType: "TASK"}))
+		})
+
+		It("parses regexp rules", func() {
+			rule, err := ParseSourceRule("regexp:^(init|sidecar)-=OPS")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(rule.Pattern.String()).To(Equal("^(init|sidecar)-"))
+			Expect(rule.SourceType).To(Equal("OPS"))
+		})
+
+		It("rejects malformed rules", func() {
+			_, err := ParseSourceRule("task-=TASK")
+			Expect(err).To(HaveOccurred())
+
+			_, err = ParseSourceRule("prefix:task-=")
+			Expect(err).To(HaveOccurred())
+
+			_, err = ParseSourceRule("suffix:-task=TASK")
+			Expect(err).To(MatchError(`unknown source rule kind "suffix"`))
+
+			_, err = ParseSourceRule("regexp:(=TASK")
+			Expect(err).To(HaveOccurred())
+		})
+	})
+
+	Describe("ParseUnmatchedPolicy", func() {
+		It("defaults to drop", func() {
+			Expect(ParseUnmatchedPolicy("")).To(Equal(UnmatchedDrop))
+		})
+
+		It("accepts the known policies", func() {
+			Expect(ParseUnmatchedPolicy("operator")).To(Equal(UnmatchedOperator))
+		})
+
+		It("rejects unknown policies", func() {
+			_, err := ParseUnmatchedPolicy("bogus")
+			Expect(err).To(MatchError(`unknown unmatched container policy "bogus"`))
+		})
+	})
+})
@@ -0,0 +1,162 @@
+package retriever
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"syscall"
+)
+
+type checkpointKey struct {
+	Inode uint64
+	Path  string
+}
+
+type checkpoint struct {
+	Inode  uint64 `json:"inode"`
+	Path   string `json:"path"`
+	Offset int64  `json:"offset"`
+}
+
+// Checkpoints records how far each log file has been read so that readers
+// can resume at the same byte offset after the agent restarts. Entries are
+// keyed by inode and path.
+type Checkpoints struct {
+	filename string
+
+	mu      sync.Mutex
+	offsets map[checkpointKey]int64
+}
+
+// LoadCheckpoints reads the checkpoint file at filename. A missing file is
+// not an error; it yields an empty set of checkpoints. Entries for files
+// that no longer exist are dropped.
+func LoadCheckpoints(filename string) (*Checkpoints, error) {
+	c := &Checkpoints{
+		filename: filename,
+		offsets:  map[checkpointKey]int64{},
+	}
+
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return c, nil
+		}
+		return nil, err
+	}
+
+	var entries []checkpoint
+	err = json.Unmarshal(data, &entries)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, e := range entries {
+		c.offsets[checkpointKey{Inode: e.Inode, Path: e.Path}] = e.Offset
+	}
+	c.prune()
+
+	return c, nil
+}
+
+// Get returns the recorded offset for the file.
+func (c *Checkpoints) Get(ino uint64, path string) (int64, bool) {
+	if c == nil {
+		return 0, false
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	offset, ok := c.offsets[checkpointKey{Inode: ino, Path: path}]
+	return offset, ok
+}
+
+// Set records the offset for the file.
+func (c *Checkpoints) Set(ino uint64, path string, offset int64) {
+	if c == nil {
+		return
+	}
+
+	c.mu.Lock()
+	c.offsets[checkpointKey{Inode: ino, Path: path}] = offset
+	c.mu.Unlock()
+}
+
+// Remove forgets the offset for the file.
+func (c *Checkpoints) Remove(ino uint64, path string) {
+	if c == nil {
+		return
+	}
+
+	c.mu.Lock()
+	delete(c.offsets, checkpointKey{Inode: ino, Path: path})
+	c.mu.Unlock()
+}
+
+// Save drops stale entries and atomically writes the remaining checkpoints
+// to disk.
+func (c *Checkpoints) Save() error {
+	if c == nil {
+		return nil
+	}
+
+	c.mu.Lock()
+	c.prune()
+	entries := make([]checkpoint, 0, len(c.offsets))
+	for key, offset := range c.offsets {
+		entries = append(entries, checkpoint{Inode: key.Inode, Path: key.Path, Offset: offset})
+	}
+	c.mu.Unlock()
+
+	data, err := json.Marshal(entries)
+	if err != nil {
+		return err
+	}
+
+	tmp, err := ioutil.TempFile(filepath.Dir(c.filename), filepath.Base(c.filename))
+	if err != nil {
+		return err
+	}
+
+	_, err = tmp.Write(data)
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+
+	return os.Rename(tmp.Name(), c.filename)
+}
+
+// prune drops entries whose inode is no longer found at the recorded path.
+// The caller must hold the lock.
+func (c *Checkpoints) prune() {
+	for key := range c.offsets {
+		if inode(key.Path) != key.Inode {
+			delete(c.offsets, key)
+		}
+	}
+}
+
+func inode(path string) uint64 {
+	fi, err := os.Stat(path)
+	if err != nil {
+		return 0
+	}
+	return fileInode(fi)
+}
+
+func fileInode(fi os.FileInfo) uint64 {
+	if st, ok := fi.Sys().(*syscall.Stat_t); ok {
+		return st.Ino
+	}
+	return 0
+}
@@ -0,0 +1,99 @@
+package retriever_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	. "github.com/cf-furnace/loggingAgent/retriever"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Checkpoints", func() {
+	var filename string
+	var logFile *os.File
+
+	BeforeEach(func() {
+		filename = filepath.Join(tmpDir, "checkpoints")
+
+		var err error
+		logFile, err = ioutil.TempFile(tmpDir, "logfile")
+		Expect(err).NotTo(HaveOccurred())
+		logFile.Close()
+	})
+
+	AfterEach(func() {
+		os.Remove(filename)
+		os.Remove(logFile.Name())
+	})
+
+	Context("when the checkpoint file does not exist", func() {
+		It("returns empty checkpoints", func() {
+			checkpoints, err := LoadCheckpoints(filename)
+			Expect(err).NotTo(HaveOccurred())
+
+			_, ok := checkpoints.Get(inode(logFile.Name()), logFile.Name())
+			Expect(ok).To(BeFalse())
+		})
+	})
+
+	Context("when the checkpoint file is corrupt", func() {
+		BeforeEach(func() {
+			err := ioutil.WriteFile(filename, []byte("{"), 0644)
+			Expect(err).NotTo(HaveOccurred())
+		})
+
+		It("fails with an error", func() {
+			_, err := LoadCheckpoints(filename)
+			Expect(err).To(HaveOccurred())
+		})
+	})
+
+	Context("when checkpoints are saved", func() {
+		var checkpoints *Checkpoints
+
+		BeforeEach(func() {
+			var err error
+			checkpoints, err = LoadCheckpoints(filename)
+			Expect(err).NotTo(HaveOccurred())
+
+			checkpoints.Set(inode(logFile.Name()), logFile.Name(), 42)
+			Expect(checkpoints.Save()).To(Succeed())
+		})
+
+		It("restores them on load", func() {
+			loaded, err := LoadCheckpoints(filename)
+			Expect(err).NotTo(HaveOccurred())
+
+			offset, ok := loaded.Get(inode(logFile.Name()), logFile.Name())
+			Expect(ok).To(BeTrue())
+			Expect(offset).To(Equal(int64(42)))
+		})
+
+		Context("when the file is removed", func() {
+			var ino uint64
+
+			BeforeEach(func() {
+				ino = inode(logFile.Name())
+				os.Remove(logFile.Name())
+			})
+
+			It("drops the entry on load", func() {
+				loaded, err := LoadCheckpoints(filename)
+				Expect(err).NotTo(HaveOccurred())
+
+				_, ok := loaded.Get(ino, logFile.Name())
+				Expect(ok).To(BeFalse())
+			})
+
+			It("drops the entry on save", func() {
+				Expect(checkpoints.Save()).To(Succeed())
+
+				_, ok := checkpoints.Get(ino, logFile.Name())
+				Expect(ok).To(BeFalse())
+			})
+		})
+	})
+})
@@ -0,0 +1,84 @@
+package retriever
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"time"
+)
+
+const (
+	criTagPartial = "P"
+	criTagFull    = "F"
+)
+
+// criDecoder decodes the CRI log format, one entry per line:
+//
+//	2016-10-06T00:17:09.669794202Z stdout F message
+type criDecoder struct {
+	rdr     *bufio.Reader
+	offset  int64
+	pending []byte
+}
+
+func newCRIDecoder(r io.Reader) Decoder {
+	return &criDecoder{rdr: bufio.NewReader(r)}
+}
+
+func (d *criDecoder) Decode(e *Entry) error {
+	line, err := d.rdr.ReadBytes('\n')
+	if err != nil {
+		if err == io.EOF && len(line) > 0 {
+			d.pending = line
+			return io.ErrUnexpectedEOF
+		}
+		return err
+	}
+	d.offset += int64(len(line))
+
+	return parseCRILine(line[:len(line)-1], e)
+}
+
+// Buffered returns the incomplete line read before the end of the input.
+// The underlying reader has been drained at that point, so anything read
+// from it now would have been appended after the caller's position.
+func (d *criDecoder) Buffered() io.Reader {
+	return bytes.NewReader(d.pending)
+}
+
+func (d *criDecoder) InputOffset() int64 {
+	return d.offset
+}
+
+func parseCRILine(line []byte, e *Entry) error {
+	fields := bytes.SplitN(line, []byte(" "), 4)
+	if len(fields) < 3 {
+		return ErrMalformed
+	}
+
+	created, err := time.Parse(time.RFC3339Nano, string(fields[0]))
+	if err != nil {
+		return ErrMalformed
+	}
+
+	// the tag field is a ':' separated list whose first element marks
+	// partial lines.
+	tags := bytes.SplitN(fields[2], []byte(":"), 2)
+	switch string(tags[0]) {
+	case criTagPartial:
+		e.Partial = true
+	case criTagFull:
+		e.Partial = false
+	default:
+		return ErrMalformed
+	}
+
+	e.Created = created
+	e.Stream = string(fields[1])
+	e.Log = nil
+	if len(fields) == 4 {
+		e.Log = fields[3]
+	}
+
+	return nil
+}
@@ -0,0 +1,198 @@
+package retriever_test
+
+import (
+	"io/ioutil"
+	"os"
+
+	. "github.com/cf-furnace/loggingAgent/retriever"
+	"github.com/cloudfoundry/sonde-go/events"
+	"github.com/gogo/protobuf/proto"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("CRILogFile", func() {
+	var source string
+	var format Format
+	var criLog *os.File
+
+	var reader *LogReader
+
+	BeforeEach(func() {
+		source = "src"
+		format = FormatCRI
+
+		var err error
+		criLog, err = ioutil.TempFile(tmpDir, "crilog")
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	JustBeforeEach(func() {
+		var err error
+		reader, err = New(Config{
+			Source:   source,
+			AppID:    "appID",
+			Filename: criLog.Name(),
+			Format:   format,
+		})
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	AfterEach(func() {
+		os.Remove(criLog.Name())
+	})
+
+	Context("with full lines", func() {
+		BeforeEach(func() {
+			criLog.WriteString("2009-11-10T23:00:00Z stdout F a stdout message\n")
+			criLog.WriteString("2009-11-10T23:00:00.5Z stderr F a stderr message\n")
+			criLog.Close()
+		})
+
+		It("reads until the end of the file", func() {
+			var e *events.LogMessage
+			Eventually(reader.Msg).Should(Receive(&e))
+			msgType := events.LogMessage_OUT
+			Expect(e).To(Equal(&events.LogMessage{
+				Message:        []byte("a stdout message"),
+				MessageType:    &msgType,
+				Timestamp:      proto.Int64(1257894000000000000),
+				AppId:          proto.String("appID"),
+				SourceType:     &source,
+				SourceInstance: proto.String("??"),
+			}))
+			Eventually(reader.Msg).Should(Receive(&e))
+			msgType = events.LogMessage_ERR
+			Expect(e).To(Equal(&events.LogMessage{
+				Message:        []byte("a stderr message"),
+				MessageType:    &msgType,
+				Timestamp:      proto.Int64(1257894000500000000),
+				AppId:          proto.String("appID"),
+				SourceType:     &source,
+				SourceInstance: proto.String("??"),
+			}))
+		})
+	})
+
+	Context("with partial lines", func() {
+		BeforeEach(func() {
+			criLog.WriteString("2009-11-10T23:00:00Z stdout P a long \n")
+			criLog.WriteString("2009-11-10T23:00:01Z stdout P stdout \n")
+		})
+
+		It("joins them with the full line", func() {
+			Consistently(reader.Msg).ShouldNot(Receive())
+			criLog.WriteString("2009-11-10T23:00:02Z stdout F message\n")
+			criLog.Close()
+
+			var e *events.LogMessage
+			Eventually(reader.Msg).Should(Receive(&e))
+			Expect(e.Message).To(Equal([]byte("a long stdout message")))
+			Expect(e.Timestamp).To(Equal(proto.Int64(1257894000000000000)))
+		})
+	})
+
+	Context("with partial lines interleaved with another stream", func() {
+		BeforeEach(func() {
+			criLog.WriteString("2009-11-10T23:00:00Z stdout P a long \n")
+			criLog.WriteString("2009-11-10T23:00:01Z stderr F a stderr message\n")
+			criLog.WriteString("2009-11-10T23:00:02Z stdout F stdout message\n")
+			criLog.Close()
+		})
+
+		It("joins the parts of each stream separately", func() {
+			var e *events.LogMessage
+			Eventually(reader.Msg).Should(Receive(&e))
+			Expect(e.Message).To(Equal([]byte("a stderr message")))
+			Expect(e.MessageType).To(Equal(events.LogMessage_ERR.Enum()))
+
+			Eventually(reader.Msg).Should(Receive(&e))
+			Expect(e.Message).To(Equal([]byte("a long stdout message")))
+			Expect(e.MessageType).To(Equal(events.LogMessage_OUT.Enum()))
+			Expect(e.Timestamp).To(Equal(proto.Int64(1257894000000000000)))
+		})
+	})
+
+	Context("with a line that is still being written", func() {
+		BeforeEach(func() {
+			criLog.WriteString("2009-11-10T23:00:00Z stdout F a stdout")
+		})
+
+		It("waits for the end of the line", func() {
+			Consistently(reader.Msg).ShouldNot(Receive())
+			criLog.WriteString(" message\n")
+			criLog.Close()
+
+			var e *events.LogMessage
+			Eventually(reader.Msg).Should(Receive(&e))
+			Expect(e.Message).To(Equal([]byte("a stdout message")))
+		})
+	})
+
+	Context("with a malformed line", func() {
+		BeforeEach(func() {
+			criLog.WriteString("garbage\n")
+			criLog.WriteString("2009-11-10T23:00:00Z stdout F a stdout message\n")
+			criLog.Close()
+		})
+
+		It("skips it", func() {
+			var e *events.LogMessage
+			Eventually(reader.Msg).Should(Receive(&e))
+			Expect(e.Message).To(Equal([]byte("a stdout message")))
+		})
+
+		It("counts it as a decode error", func() {
+			Eventually(reader.Msg).Should(Receive())
+			Expect(reader.Stats()).To(Equal(Stats{
+				LinesRead:    1,
+				BytesRead:    uint64(len("garbage\n2009-11-10T23:00:00Z stdout F a stdout message\n")),
+				DecodeErrors: 1,
+			}))
+		})
+	})
+
+	Context("when the format is detected", func() {
+		BeforeEach(func() {
+			format = FormatAuto
+		})
+
+		It("waits for data before deciding", func() {
+			Consistently(reader.Msg).ShouldNot(Receive())
+			criLog.WriteString("2009-11-10T23:00:00Z stdout F a stdout message\n")
+			criLog.Close()
+
+			var e *events.LogMessage
+			Eventually(reader.Msg).Should(Receive(&e))
+			Expect(e.Message).To(Equal([]byte("a stdout message")))
+		})
+
+		Context("with a json log", func() {
+			BeforeEach(func() {
+				criLog.WriteString(`{"log": "a json message\n", "stream": "stdout", "time": "2009-11-10T23:00:00Z"}`)
+				criLog.Close()
+			})
+
+			It("decodes json", func() {
+				var e *events.LogMessage
+				Eventually(reader.Msg).Should(Receive(&e))
+				Expect(e.Message).To(Equal([]byte("a json message")))
+			})
+		})
+	})
+})
+
+var _ = Describe("ParseFormat", func() {
+	It("accepts the known formats", func() {
+		Expect(ParseFormat("")).To(Equal(FormatAuto))
+		Expect(ParseFormat("auto")).To(Equal(FormatAuto))
+		Expect(ParseFormat("json")).To(Equal(FormatJSON))
+		Expect(ParseFormat("cri")).To(Equal(FormatCRI))
+	})
+
+	It("rejects unknown formats", func() {
+		_, err := ParseFormat("syslog")
+		Expect(err).To(MatchError(`unknown log format "syslog"`))
+	})
+})
@@ -0,0 +1,96 @@
+package retriever
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"time"
+)
+
+// Format identifies how a container runtime encodes log lines on disk.
+type Format string
+
+const (
+	// FormatAuto detects the format from the first entry in the file.
+	FormatAuto Format = "auto"
+	// FormatJSON is the Docker json-file format.
+	FormatJSON Format = "json"
+	// FormatCRI is the format written by CRI runtimes such as containerd and
+	// CRI-O.
+	FormatCRI Format = "cri"
+)
+
+// ErrMalformed is returned by a Decoder for an entry it could not parse. The
+// entry has been consumed and decoding can continue with the next one.
+var ErrMalformed = errors.New("malformed log entry")
+
+var decoders = map[Format]func(io.Reader) Decoder{
+	FormatJSON: newJSONDecoder,
+	FormatCRI:  newCRIDecoder,
+}
+
+// ParseFormat converts a format name into a Format. An empty name means
+// FormatAuto.
+func ParseFormat(name string) (Format, error) {
+	format := Format(name)
+	if name == "" || format == FormatAuto {
+		return FormatAuto, nil
+	}
+
+	if _, ok := decoders[format]; !ok {
+		return "", fmt.Errorf("unknown log format %q", name)
+	}
+	return format, nil
+}
+
+// Entry is a single decoded log line.
+type Entry struct {
+	Log     []byte
+	Stream  string
+	Created time.Time
+	// Partial is set when the line continues in the next entry.
+	Partial bool
+}
+
+// A Decoder decodes log entries from a stream.
+type Decoder interface {
+	// Decode reads the next entry. It returns io.ErrUnexpectedEOF when the
+	// stream ends part way through an entry.
+	Decode(*Entry) error
+	// Buffered returns the data that was read but not yet decoded.
+	Buffered() io.Reader
+	// InputOffset returns the stream offset just past the last decoded entry.
+	InputOffset() int64
+}
+
+// NewDecoder returns a decoder for format reading from r.
+func NewDecoder(format Format, r io.Reader) Decoder {
+	newDecoder, ok := decoders[format]
+	if !ok {
+		return nil
+	}
+	return newDecoder(r)
+}
+
+// detectFormat guesses the format from the first non-blank byte at offset.
+// It returns FormatAuto when nothing has been written there yet.
+func detectFormat(f io.ReaderAt, offset int64) Format {
+	buf := make([]byte, 512)
+	for {
+		n, err := f.ReadAt(buf, offset)
+		for _, b := range buf[:n] {
+			switch b {
+			case ' ', '\t', '\r', '\n':
+				continue
+			case '{':
+				return FormatJSON
+			default:
+				return FormatCRI
+			}
+		}
+		if err != nil {
+			return FormatAuto
+		}
+		offset += int64(n)
+	}
+}
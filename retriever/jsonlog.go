@@ -3,22 +3,32 @@ package retriever
 import (
 	"bytes"
 	"encoding/json"
+	"fmt"
 	"io"
 	"os"
-	"syscall"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
+	"github.com/cf-furnace/loggingAgent/notify"
 	"github.com/cloudfoundry/sonde-go/events"
-	"github.com/fsnotify/fsnotify"
 	"github.com/gogo/protobuf/proto"
 )
 
-const (
+var (
+	// OpenRetryInterval is how long a reader waits between attempts to
+	// reopen a rotated file.
 	OpenRetryInterval = 1 * time.Second
+	// OpenRetries is how many times a reader tries to reopen a rotated file
+	// before giving up.
+	OpenRetries = 5
 )
 
-var (
-	sourceInstance = "??"
+const (
+	// UnknownSourceInstance is reported when the instance index of the app
+	// is not known.
+	UnknownSourceInstance = "??"
 )
 
 type jsonLog struct {
@@ -36,45 +46,224 @@ func (j *jsonLog) Reset() {
 	j.Created = time.Time{}
 }
 
-func decodeLine(dec *json.Decoder, l *jsonLog) error {
-	err := dec.Decode(&l)
-	if err != nil {
+// jsonDecoder decodes the Docker json-file format.
+type jsonDecoder struct {
+	src io.Reader
+	dec *json.Decoder
+	// base is the input offset at which dec started reading src.
+	base int64
+	log  jsonLog
+}
+
+func newJSONDecoder(r io.Reader) Decoder {
+	return &jsonDecoder{src: r, dec: json.NewDecoder(r)}
+}
+
+func (d *jsonDecoder) Decode(e *Entry) error {
+	d.log.Reset()
+	err := d.dec.Decode(&d.log)
+	switch err.(type) {
+	case nil:
+	case *json.SyntaxError:
+		return d.resync()
+	case *os.PathError:
+		// the file could not be read.
 		return err
+	default:
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return err
+		}
+		// the whole value has been read; only its content is wrong, e.g.
+		// a time that is not a string.
+		return ErrMalformed
 	}
+
+	// docker splits long lines into several entries; only the last one
+	// ends with a newline.
+	e.Partial = !strings.HasSuffix(d.log.Log, "\n")
+	e.Log = []byte(strings.TrimSuffix(d.log.Log, "\n"))
+	e.Stream = d.log.Stream
+	e.Created = d.log.Created
 	return nil
 }
 
+// resync skips past the end of the line holding a syntax error and restarts
+// decoding there, since a json.Decoder cannot carry on after one.
+func (d *jsonDecoder) resync() error {
+	offset := d.InputOffset()
+	rdr := io.MultiReader(d.dec.Buffered(), d.src)
+
+	// the decoder stops before the whitespace preceding the bad value, which
+	// usually holds the newline ending the previous entry.
+	blank := true
+	b := make([]byte, 1)
+	for {
+		n, err := rdr.Read(b)
+		offset += int64(n)
+		if n > 0 {
+			if b[0] == '\n' && !blank {
+				break
+			}
+			blank = blank && strings.IndexByte(" \t\r\n", b[0]) >= 0
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	d.src = rdr
+	d.dec = json.NewDecoder(rdr)
+	d.base = offset
+	return ErrMalformed
+}
+
+func (d *jsonDecoder) Buffered() io.Reader {
+	return d.dec.Buffered()
+}
+
+func (d *jsonDecoder) InputOffset() int64 {
+	return d.base + d.dec.InputOffset()
+}
+
+// Config describes the log file a LogReader reads.
+type Config struct {
+	Source   string
+	AppID    string
+	Filename string
+	// SourceInstance is the index of the app instance writing the file.
+	// It defaults to UnknownSourceInstance.
+	SourceInstance string
+	// Tail starts reading at the end of the file instead of the beginning
+	// when there is no checkpoint for it.
+	Tail bool
+	// Format is the encoding of the file. FormatAuto detects it.
+	Format Format
+	// MaxMessageSize limits the size of a message. Longer lines are cut
+	// short and end with TruncationMarker. Zero means no limit.
+	MaxMessageSize   int
+	TruncationMarker string
+	// Multiline, if set, joins continuation lines into a single message.
+	Multiline *MultilineRule
+	// Checkpoints, if set, records read offsets and resumes from them.
+	Checkpoints *Checkpoints
+	// Mux, if set, supplies the watcher detecting changes to the file.
+	// Otherwise the reader creates its own as Notify describes.
+	Mux    *notify.Mux
+	Notify notify.Options
+	// QueueSize is the number of messages queued until they are received
+	// from Msg. Policy decides what happens when the queue, or the Budget
+	// shared with other readers, is full.
+	QueueSize int
+	Policy    Policy
+	Budget    *Budget
+}
+
 type LogReader struct {
 	Msg chan *events.LogMessage
 	Err chan error
 
-	source   string
-	appID    string
-	filename string
-	file     *os.File
-	tail     bool
+	source         string
+	sourceInstance string
+	appID          string
+	filename       string
+	file           *os.File
+	tail           bool
+	format         Format
+
+	maxMessageSize   int
+	truncationMarker string
+
+	ino         uint64
+	offset      int64
+	checkpoints *Checkpoints
+
+	watcher   notify.Watcher
+	queue     *queue
+	buf       *bytes.Buffer
+	partial   map[string]*partialLine
+	multiline *aggregator
 
-	watcher *fsnotify.Watcher
-	buf     *bytes.Buffer
+	stop     chan struct{}
+	stopOnce sync.Once
+
+	// delivered holds the messages sent on Msg that have not been
+	// committed yet, oldest first.
+	deliveredMu sync.Mutex
+	delivered   []queued
+
+	stats Stats
 }
 
-func New(source, appID, filename string, tail bool) (*LogReader, error) {
-	watcher, err := fsnotify.NewWatcher()
-	if err != nil {
-		return nil, err
+// Stats counts the work a reader has done.
+type Stats struct {
+	LinesRead    uint64
+	BytesRead    uint64
+	DecodeErrors uint64
+	// Dropped counts the messages dropped because the queue was full.
+	Dropped uint64
+}
+
+// Add returns the sum of s and other.
+func (s Stats) Add(other Stats) Stats {
+	return Stats{
+		LinesRead:    s.LinesRead + other.LinesRead,
+		BytesRead:    s.BytesRead + other.BytesRead,
+		DecodeErrors: s.DecodeErrors + other.DecodeErrors,
+		Dropped:      s.Dropped + other.Dropped,
+	}
+}
+
+// partialLine collects the parts of a line split across several entries of
+// the same stream.
+type partialLine struct {
+	log     []byte
+	created time.Time
+	start   int64
+}
+
+// New starts reading the configured file. If the checkpoints hold an offset
+// for the file, reading resumes there; otherwise it starts at the end of the
+// file when Tail is set and at the beginning when it is not.
+func New(config Config) (*LogReader, error) {
+	var watcher notify.Watcher
+	if config.Mux != nil {
+		watcher = config.Mux.Watcher()
+	} else {
+		var err error
+		watcher, err = notify.New(config.Notify)
+		if err != nil {
+			return nil, err
+		}
 	}
-	watcher.Add(filename)
 
 	r := &LogReader{
-		Msg: make(chan *events.LogMessage, 4096),
+		Msg: make(chan *events.LogMessage),
 		Err: make(chan error, 1),
 
-		source:   source,
-		appID:    appID,
-		filename: filename,
-		tail:     tail,
+		source:         config.Source,
+		sourceInstance: config.SourceInstance,
+		appID:          config.AppID,
+		filename:       config.Filename,
+		tail:           config.Tail,
+		format:         config.Format,
+
+		maxMessageSize:   config.MaxMessageSize,
+		truncationMarker: config.TruncationMarker,
+
+		checkpoints: config.Checkpoints,
+
+		watcher:   watcher,
+		queue:     newQueue(config.QueueSize, config.Policy, config.Budget),
+		multiline: newAggregator(config.Multiline, config.MaxMessageSize),
 
-		watcher: watcher,
+		stop: make(chan struct{}),
+	}
+
+	if r.sourceInstance == "" {
+		r.sourceInstance = UnknownSourceInstance
 	}
 
 	seek := os.SEEK_SET
@@ -82,27 +271,44 @@ func New(source, appID, filename string, tail bool) (*LogReader, error) {
 		seek = os.SEEK_END
 	}
 
-	err = r.open(seek)
+	err := r.open(seek)
 	if err != nil {
+		watcher.Close()
 		r.Err <- err
 	} else {
 		go r.tailLog()
+		go r.forward()
 	}
 	return r, nil
 }
 
 func (r *LogReader) ID() uint64 {
-	fi, err := r.file.Stat()
+	return atomic.LoadUint64(&r.ino)
+}
 
-	if err != nil {
-		return 0
+// Stats returns the reader's counters. It is safe to call while the reader
+// is running.
+func (r *LogReader) Stats() Stats {
+	return Stats{
+		LinesRead:    atomic.LoadUint64(&r.stats.LinesRead),
+		BytesRead:    atomic.LoadUint64(&r.stats.BytesRead),
+		DecodeErrors: atomic.LoadUint64(&r.stats.DecodeErrors),
+		Dropped:      atomic.LoadUint64(&r.stats.Dropped),
 	}
+}
 
-	if st, ok := fi.Sys().(*syscall.Stat_t); ok {
-		return st.Ino
-	}
+// Backlog returns the number of messages read but not yet received from Msg.
+func (r *LogReader) Backlog() int {
+	return r.queue.len()
+}
 
-	return 0
+// Stop makes the reader send what has been written to the file so far,
+// including a message held back for continuation lines and the parts of a
+// line still being written, and close Msg once they have been received.
+func (r *LogReader) Stop() {
+	r.stopOnce.Do(func() {
+		close(r.stop)
+	})
 }
 
 func (r *LogReader) tailLog() {
@@ -110,16 +316,80 @@ func (r *LogReader) tailLog() {
 		if r.watcher != nil {
 			r.watcher.Close()
 		}
-		close(r.Msg)
+		r.queue.close()
 	}()
 
 	err := r.eventLoop()
+	r.flushPartial()
+	r.flush()
 	if err != nil {
 		r.Err <- err
 		return
 	}
 }
 
+// forward passes the queued messages on to Msg, reporting any that were
+// dropped, and closes Msg when the reader is done.
+func (r *LogReader) forward() {
+	defer close(r.Msg)
+
+	for {
+		item, dropped, ok := r.queue.pop()
+		if dropped > 0 {
+			r.Msg <- r.droppedNotice(dropped)
+		}
+		if item.msg != nil {
+			if r.checkpoints != nil {
+				r.deliveredMu.Lock()
+				r.delivered = append(r.delivered, item)
+				r.deliveredMu.Unlock()
+			}
+			r.Msg <- item.msg
+			r.queue.done(item.msg)
+		}
+		if !ok {
+			return
+		}
+	}
+}
+
+// Commit records that msg, received from Msg, has been delivered, so that
+// the checkpoint moves past it and every message received before it. Until a
+// message is committed, a restart reads it again.
+func (r *LogReader) Commit(msg *events.LogMessage) {
+	if r.checkpoints == nil {
+		return
+	}
+
+	r.deliveredMu.Lock()
+	defer r.deliveredMu.Unlock()
+
+	for i, item := range r.delivered {
+		if item.msg == msg {
+			r.checkpoints.Set(item.mark.ino, r.filename, item.mark.offset)
+			n := copy(r.delivered, r.delivered[i+1:])
+			for j := n; j < len(r.delivered); j++ {
+				r.delivered[j] = queued{}
+			}
+			r.delivered = r.delivered[:n]
+			return
+		}
+	}
+}
+
+// droppedNotice tells the app how many of its messages were dropped.
+func (r *LogReader) droppedNotice(dropped uint64) *events.LogMessage {
+	msgType := events.LogMessage_ERR
+	return &events.LogMessage{
+		Message:        []byte(fmt.Sprintf("Log message output too high. We've dropped %d messages", dropped)),
+		AppId:          proto.String(r.appID),
+		MessageType:    &msgType,
+		SourceType:     &r.source,
+		SourceInstance: &r.sourceInstance,
+		Timestamp:      proto.Int64(time.Now().UnixNano()),
+	}
+}
+
 func (r *LogReader) open(seek int) error {
 	fin, err := os.Open(r.filename)
 
@@ -127,15 +397,42 @@ func (r *LogReader) open(seek int) error {
 		return err
 	}
 
+	fi, err := fin.Stat()
+	if err != nil {
+		fin.Close()
+		return err
+	}
+	ino := fileInode(fi)
+
+	var pos int64
+	if offset, ok := r.checkpoints.Get(ino, r.filename); ok && offset <= fi.Size() {
+		pos, err = fin.Seek(offset, os.SEEK_SET)
+	} else {
+		pos, err = fin.Seek(0, seek)
+	}
+	if err != nil {
+		fin.Close()
+		return err
+	}
+
+	err = r.watcher.Add(r.filename)
+	if err != nil {
+		fin.Close()
+		return err
+	}
+
 	// success
-	fin.Seek(0, seek)
 	r.file = fin
-	r.watcher.Add(r.filename)
+	atomic.StoreUint64(&r.ino, ino)
+	r.offset = pos
 	return nil
 }
 
 func (r *LogReader) eventLoop() error {
-	defer r.file.Close()
+	defer func() {
+		r.file.Close()
+	}()
+
 	for {
 		err := r.parse()
 		if !(err == nil || err == io.EOF) {
@@ -143,17 +440,97 @@ func (r *LogReader) eventLoop() error {
 		}
 		// wait events
 		select {
-		case event := <-r.watcher.Events:
-			if event.Op&(fsnotify.Remove|fsnotify.Rename) != 0 {
-				// watching file is removed. return for reopening.
-				return nil
+		case event := <-r.watcher.Events():
+			// an open file that is unlinked only reports a change to its
+			// link count, so check the path whenever its metadata changes.
+			if event.Op&(notify.Remove|notify.Rename|notify.Chmod) == 0 || !r.rotated() {
+				continue
 			}
-		case err := <-r.watcher.Errors:
-			return err
+
+			if ok, err := r.rotate(); !ok {
+				return err
+			}
+		case <-r.watcher.Errors():
+			// events may have been lost, e.g. when the event queue
+			// overflowed: look for a rotation that went unnoticed, or else
+			// watch the file afresh and read what was written meanwhile.
+			if !r.rotated() {
+				r.watcher.Remove(r.filename)
+				err := r.watcher.Add(r.filename)
+				if err == nil {
+					continue
+				}
+				if !os.IsNotExist(err) {
+					return err
+				}
+			}
+
+			if ok, err := r.rotate(); !ok {
+				return err
+			}
+		case <-r.multiline.timeout():
+			r.flush()
+		case <-r.stop:
+			err := r.parse()
+			if !(err == nil || err == io.EOF) {
+				return err
+			}
+			return nil
 		}
 	}
 }
 
+// rotate reads what was written to the rotated file before it was replaced
+// and switches to the new file. It returns false when the reader has to stop.
+func (r *LogReader) rotate() (bool, error) {
+	err := r.parse()
+	if !(err == nil || err == io.EOF) {
+		return false, err
+	}
+
+	r.flushPartial()
+	r.flush()
+
+	return r.reopen()
+}
+
+// rotated reports whether the path no longer refers to the open file.
+func (r *LogReader) rotated() bool {
+	return inode(r.filename) != r.ID()
+}
+
+// reopen switches to the file that replaced the rotated one. It returns false
+// when no new file shows up at the path.
+func (r *LogReader) reopen() (bool, error) {
+	oldFile, oldIno := r.file, r.ID()
+
+	r.watcher.Remove(r.filename)
+	r.buf = nil
+	r.partial = nil
+
+	for i := 0; i < OpenRetries; i++ {
+		if i > 0 {
+			select {
+			case <-time.After(OpenRetryInterval):
+			case <-r.stop:
+				return false, nil
+			}
+		}
+
+		err := r.open(os.SEEK_SET)
+		if err == nil {
+			oldFile.Close()
+			r.checkpoints.Remove(oldIno, r.filename)
+			return true, nil
+		}
+		if !os.IsNotExist(err) {
+			return false, err
+		}
+	}
+
+	return false, nil
+}
+
 func (r *LogReader) restrict() error {
 	stat, err := r.file.Stat()
 	if err != nil {
@@ -174,50 +551,196 @@ func (r *LogReader) restrict() error {
 }
 
 func (r *LogReader) parse() error {
+	if _, ok := decoders[r.format]; !ok {
+		r.format = detectFormat(r.file, r.offset)
+		if r.format == FormatAuto {
+			return io.EOF
+		}
+	}
+
 	var rdr io.Reader = r.file
 
 	if r.buf != nil {
 		rdr = io.MultiReader(r.buf, r.file)
 	}
 
-	dec := json.NewDecoder(rdr)
-	log := &jsonLog{}
+	// r.offset is the position just past the last decoded entry; anything
+	// between it and the file position is held in r.buf.
+	base := r.offset
+	dec := NewDecoder(r.format, rdr)
+	log := &Entry{}
 
 	for {
-		err := decodeLine(dec, log)
+		start := r.offset
+		err := dec.Decode(log)
+		if err == ErrMalformed {
+			r.offset = base + dec.InputOffset()
+			atomic.AddUint64(&r.stats.DecodeErrors, 1)
+			atomic.AddUint64(&r.stats.BytesRead, uint64(r.offset-start))
+			continue
+		}
+
 		if err != nil {
+			if pos, serr := r.file.Seek(0, os.SEEK_CUR); serr == nil {
+				r.offset = pos
+			}
+
 			if err == io.EOF {
+				r.buf = nil
 				return err
 			}
 
-			// io.ErrUnexpectedEOF is returned from json.Decoder when there is
+			// io.ErrUnexpectedEOF is returned from the decoder when there is
 			// remaining data in the parser's buffer while an io.EOF occurs.
-			// If the json logger writes a partial json log entry to the disk
-			// while at the same time the decoder tries to decode it, the race condition happens.
+			// If the logger writes a partial log entry to the disk while at
+			// the same time the decoder tries to decode it, the race
+			// condition happens.
 			if err == io.ErrUnexpectedEOF {
 				if r.buf == nil {
 					r.buf = &bytes.Buffer{}
 				}
 				r.buf.ReadFrom(dec.Buffered())
+				r.offset -= int64(r.buf.Len())
 			}
 
 			return io.EOF
 		}
 
 		r.buf = nil
+		r.offset = base + dec.InputOffset()
+		atomic.AddUint64(&r.stats.LinesRead, 1)
+		atomic.AddUint64(&r.stats.BytesRead, uint64(r.offset-start))
+
+		partial := r.partial[log.Stream]
+		if log.Partial {
+			if partial == nil {
+				if r.partial == nil {
+					r.partial = map[string]*partialLine{}
+				}
+				partial = &partialLine{created: log.Created, start: start}
+				r.partial[log.Stream] = partial
+			}
+			partial.log = appendLimited(partial.log, log.Log, r.maxMessageSize)
+			continue
+		}
+
+		message, created := log.Log, log.Created
+		if partial != nil {
+			message = appendLimited(partial.log, log.Log, r.maxMessageSize)
+			created = partial.created
+			start = partial.start
+			delete(r.partial, log.Stream)
+		}
+
+		r.emit(r.newMessage(log.Stream, message, created), start)
+	}
+}
+
+// newMessage builds the message holding a line of stream.
+func (r *LogReader) newMessage(stream string, message []byte, created time.Time) *events.LogMessage {
+	msgType := events.LogMessage_OUT
+	if stream == "err" || stream == "stderr" {
+		msgType = events.LogMessage_ERR
+	}
+
+	return &events.LogMessage{
+		Message:        message,
+		AppId:          proto.String(r.appID),
+		MessageType:    &msgType,
+		SourceType:     &r.source,
+		SourceInstance: &r.sourceInstance,
+		Timestamp:      proto.Int64(created.UnixNano()),
+	}
+}
+
+// flushPartial sends the lines whose last part has not been written, oldest
+// first, since it will not be once the file is rotated or the reader stops.
+func (r *LogReader) flushPartial() {
+	for len(r.partial) > 0 {
+		var stream string
+		var oldest *partialLine
+		for s, partial := range r.partial {
+			if oldest == nil || partial.start < oldest.start {
+				stream, oldest = s, partial
+			}
+		}
+
+		delete(r.partial, stream)
+		if len(oldest.log) > 0 {
+			r.emit(r.newMessage(stream, oldest.log, oldest.created), oldest.start)
+		}
+	}
+}
 
-		msgType := events.LogMessage_OUT
-		if log.Stream == "err" {
-			msgType = events.LogMessage_ERR
+// emit sends a message that starts at offset start, holding it back first
+// when it may be continued by the following lines.
+func (r *LogReader) emit(msg *events.LogMessage, start int64) {
+	if r.multiline != nil {
+		if completed := r.multiline.add(msg, start); completed != nil {
+			r.send(completed)
 		}
+		if r.multiline.full() {
+			r.flush()
+		}
+		return
+	}
+	r.send(msg)
+}
 
-		r.Msg <- &events.LogMessage{
-			Message:        []byte(log.Log),
-			AppId:          proto.String(r.appID),
-			MessageType:    &msgType,
-			SourceType:     &r.source,
-			SourceInstance: &sourceInstance,
-			Timestamp:      proto.Int64(log.Created.UnixNano()),
+// flush sends the message held back for continuation lines.
+func (r *LogReader) flush() {
+	if msg := r.multiline.flush(); msg != nil {
+		r.send(msg)
+	}
+}
+
+func (r *LogReader) send(msg *events.LogMessage) {
+	msg.Message = r.truncate(msg.Message)
+	m := mark{ino: r.ino, offset: r.committed()}
+	if dropped := r.queue.push(msg, m); dropped > 0 {
+		atomic.AddUint64(&r.stats.Dropped, dropped)
+	}
+}
+
+// committed returns the offset before which every entry has been sent.
+func (r *LogReader) committed() int64 {
+	offset := r.offset
+	for _, partial := range r.partial {
+		if partial.start < offset {
+			offset = partial.start
 		}
 	}
+	if start, ok := r.multiline.pendingStart(); ok && start < offset {
+		offset = start
+	}
+	return offset
+}
+
+// appendLimited appends data to message, keeping no more than one byte past
+// maxMessageSize so that truncation can still be detected. Zero means no
+// limit.
+func appendLimited(message, data []byte, maxMessageSize int) []byte {
+	if maxMessageSize > 0 {
+		if room := maxMessageSize + 1 - len(message); room < len(data) {
+			if room < 0 {
+				room = 0
+			}
+			data = data[:room]
+		}
+	}
+	return append(message, data...)
+}
+
+// truncate cuts message down to the maximum message size, ending it with the
+// truncation marker.
+func (r *LogReader) truncate(message []byte) []byte {
+	if r.maxMessageSize <= 0 || len(message) <= r.maxMessageSize {
+		return message
+	}
+
+	cut := r.maxMessageSize - len(r.truncationMarker)
+	if cut < 0 {
+		cut = 0
+	}
+	return append(message[:cut], r.truncationMarker...)
 }
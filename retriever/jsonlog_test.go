@@ -1,9 +1,13 @@
 package retriever_test
 
 import (
+	"errors"
 	"io/ioutil"
 	"os"
+	"path/filepath"
+	"time"
 
+	"github.com/cf-furnace/loggingAgent/notify"
 	. "github.com/cf-furnace/loggingAgent/retriever"
 	"github.com/cloudfoundry/sonde-go/events"
 	"github.com/gogo/protobuf/proto"
@@ -17,6 +21,10 @@ var _ = Describe("JsonLogFile", func() {
 	var appID string
 	var jsonLog *os.File
 	var tail bool
+	var checkpoints *Checkpoints
+	var maxMessageSize int
+	var notifyOptions notify.Options
+	var mux *notify.Mux
 
 	var reader *LogReader
 
@@ -24,6 +32,10 @@ var _ = Describe("JsonLogFile", func() {
 		source = "src"
 		appID = "appID"
 		tail = false
+		checkpoints = nil
+		maxMessageSize = 0
+		notifyOptions = notify.Options{}
+		mux = nil
 
 		var err error
 		jsonLog, err = ioutil.TempFile(tmpDir, "jsonlog")
@@ -32,7 +44,19 @@ var _ = Describe("JsonLogFile", func() {
 
 	JustBeforeEach(func() {
 		var err error
-		reader, err = New(source, appID, jsonLog.Name(), tail)
+		reader, err = New(Config{
+			Source:      source,
+			AppID:       appID,
+			Filename:    jsonLog.Name(),
+			Tail:        tail,
+			Format:      FormatJSON,
+			Checkpoints: checkpoints,
+			Notify:      notifyOptions,
+			Mux:         mux,
+
+			MaxMessageSize:   maxMessageSize,
+			TruncationMarker: "...",
+		})
 		Expect(err).NotTo(HaveOccurred())
 	})
 
@@ -56,12 +80,12 @@ var _ = Describe("JsonLogFile", func() {
 	Context("with valid json", func() {
 		BeforeEach(func() {
 			jsonLog.WriteString(`{
-					"log": "a stdout message",
+					"log": "a stdout message\n",
 					"stream": "out",
 					"time": "2009-11-10T23:00:00Z"
 				}
 				{
-					"log": "a stderr message",
+					"log": "a stderr message\n",
 					"stream": "err",
 					"time": "2009-11-10T23:00:00Z"
 				}`)
@@ -93,10 +117,123 @@ var _ = Describe("JsonLogFile", func() {
 		})
 	})
 
+	Context("with a line split across several entries", func() {
+		BeforeEach(func() {
+			jsonLog.WriteString(`{"log": "a long ", "stream": "out", "time": "2009-11-10T23:00:00Z"}` + "\n")
+			jsonLog.WriteString(`{"log": "stdout ", "stream": "out", "time": "2009-11-10T23:00:01Z"}` + "\n")
+		})
+
+		It("emits a single message once the line is complete", func() {
+			Consistently(reader.Msg).ShouldNot(Receive())
+			jsonLog.WriteString(`{"log": "message\n", "stream": "out", "time": "2009-11-10T23:00:02Z"}`)
+			jsonLog.Close()
+
+			var e *events.LogMessage
+			Eventually(reader.Msg).Should(Receive(&e))
+			Expect(e.Message).To(Equal([]byte("a long stdout message")))
+			Expect(e.Timestamp).To(Equal(proto.Int64(1257894000000000000)))
+		})
+
+		It("emits the parts read so far when the reader is stopped", func() {
+			Consistently(reader.Msg).ShouldNot(Receive())
+			reader.Stop()
+
+			var e *events.LogMessage
+			Eventually(reader.Msg).Should(Receive(&e))
+			Expect(e.Message).To(Equal([]byte("a long stdout ")))
+			Expect(e.Timestamp).To(Equal(proto.Int64(1257894000000000000)))
+			Eventually(reader.Msg).Should(BeClosed())
+		})
+
+		It("emits the parts read so far when the file is rotated", func() {
+			Consistently(reader.Msg).ShouldNot(Receive())
+			Expect(os.Rename(jsonLog.Name(), jsonLog.Name()+".1")).To(Succeed())
+			defer os.Remove(jsonLog.Name() + ".1")
+			newLog, err := os.Create(jsonLog.Name())
+			Expect(err).NotTo(HaveOccurred())
+			newLog.WriteString(`{"log": "message\n", "stream": "out", "time": "2009-11-10T23:00:02Z"}`)
+			newLog.Close()
+
+			var e *events.LogMessage
+			Eventually(reader.Msg).Should(Receive(&e))
+			Expect(e.Message).To(Equal([]byte("a long stdout ")))
+			Eventually(reader.Msg).Should(Receive(&e))
+			Expect(e.Message).To(Equal([]byte("message")))
+		})
+
+		Context("when the line exceeds the maximum message size", func() {
+			BeforeEach(func() {
+				maxMessageSize = 10
+			})
+
+			It("truncates the message", func() {
+				jsonLog.WriteString(`{"log": "message\n", "stream": "out", "time": "2009-11-10T23:00:02Z"}`)
+				jsonLog.Close()
+
+				var e *events.LogMessage
+				Eventually(reader.Msg).Should(Receive(&e))
+				Expect(e.Message).To(Equal([]byte("a long ...")))
+			})
+		})
+	})
+
+	Context("with a checkpoint", func() {
+		var first string
+
+		BeforeEach(func() {
+			first = `{"log": "a stdout message\n", "stream": "out", "time": "2009-11-10T23:00:00Z"}`
+			jsonLog.WriteString(first + "\n")
+			jsonLog.WriteString(`{"log": "a stderr message\n", "stream": "err", "time": "2009-11-10T23:00:00Z"}`)
+			jsonLog.Close()
+
+			var err error
+			checkpoints, err = LoadCheckpoints(filepath.Join(tmpDir, "checkpoints"))
+			Expect(err).NotTo(HaveOccurred())
+			checkpoints.Set(inode(jsonLog.Name()), jsonLog.Name(), int64(len(first)))
+		})
+
+		It("resumes reading at the recorded offset", func() {
+			var e *events.LogMessage
+			Eventually(reader.Msg).Should(Receive(&e))
+			Expect(e.Message).To(Equal([]byte("a stderr message")))
+		})
+
+		It("records the offset of each committed message", func() {
+			var e *events.LogMessage
+			Eventually(reader.Msg).Should(Receive(&e))
+			reader.Commit(e)
+
+			fi, err := os.Stat(jsonLog.Name())
+			Expect(err).NotTo(HaveOccurred())
+			offset, _ := checkpoints.Get(inode(jsonLog.Name()), jsonLog.Name())
+			Expect(offset).To(Equal(fi.Size()))
+		})
+
+		It("keeps the offset until the message is committed", func() {
+			Eventually(reader.Msg).Should(Receive())
+			Consistently(func() int64 {
+				offset, _ := checkpoints.Get(inode(jsonLog.Name()), jsonLog.Name())
+				return offset
+			}).Should(Equal(int64(len(first))))
+		})
+
+		Context("when the file is shorter than the offset", func() {
+			BeforeEach(func() {
+				checkpoints.Set(inode(jsonLog.Name()), jsonLog.Name(), 1<<20)
+			})
+
+			It("reads from the start of the file", func() {
+				var e *events.LogMessage
+				Eventually(reader.Msg).Should(Receive(&e))
+				Expect(e.Message).To(Equal([]byte("a stdout message")))
+			})
+		})
+	})
+
 	Context("with a partial json line", func() {
 		BeforeEach(func() {
 			jsonLog.WriteString(`{
-					"log": "a stdout message",
+					"log": "a stdout message\n",
 					"stream": "out",
 					"time": "2009-11-10T23:00:00Z"`)
 		})
@@ -109,15 +246,87 @@ var _ = Describe("JsonLogFile", func() {
 		})
 	})
 
+	Context("with malformed json", func() {
+		BeforeEach(func() {
+			jsonLog.WriteString(`{"log": "first\n", "stream": "out", "time": "2009-11-10T23:00:00Z"}` + "\n")
+			jsonLog.WriteString(`{"log": garbage` + "\n")
+			jsonLog.WriteString(`{"log": 42, "stream": "out", "time": "2009-11-10T23:00:00Z"}` + "\n")
+			jsonLog.WriteString(`{"log": "bad time\n", "stream": "out", "time": 5}` + "\n")
+			jsonLog.WriteString(`{"log": "second\n", "stream": "out", "time": "2009-11-10T23:00:00Z"}` + "\n")
+			jsonLog.Close()
+		})
+
+		It("skips the bad entries and counts them as decode errors", func() {
+			var e *events.LogMessage
+			Eventually(reader.Msg).Should(Receive(&e))
+			Expect(e.Message).To(Equal([]byte("first")))
+			Eventually(reader.Msg).Should(Receive(&e))
+			Expect(e.Message).To(Equal([]byte("second")))
+
+			Expect(reader.Stats().LinesRead).To(Equal(uint64(2)))
+			Expect(reader.Stats().DecodeErrors).To(Equal(uint64(3)))
+		})
+	})
+
+	Context("when the shared watcher reports an error", func() {
+		var (
+			errs     chan error
+			otherLog *os.File
+			other    *LogReader
+		)
+
+		BeforeEach(func() {
+			watcher, err := notify.New(notify.Options{Backend: notify.BackendInotify})
+			Expect(err).NotTo(HaveOccurred())
+			errs = make(chan error)
+			mux = notify.Share(&failingWatcher{Watcher: watcher, errs: errs})
+
+			otherLog, err = ioutil.TempFile(tmpDir, "jsonlog")
+			Expect(err).NotTo(HaveOccurred())
+			other, err = New(Config{
+				Source:   source,
+				AppID:    "otherAppID",
+				Filename: otherLog.Name(),
+				Format:   FormatJSON,
+				Mux:      mux,
+			})
+			Expect(err).NotTo(HaveOccurred())
+		})
+
+		AfterEach(func() {
+			reader.Stop()
+			other.Stop()
+			mux.Close()
+			otherLog.Close()
+			os.Remove(otherLog.Name())
+		})
+
+		It("keeps every reader running", func() {
+			errs <- errors.New("event queue overflow")
+
+			jsonLog.WriteString(`{"log": "a stdout message\n", "stream": "out", "time": "2009-11-10T23:00:00Z"}` + "\n")
+			otherLog.WriteString(`{"log": "another message\n", "stream": "out", "time": "2009-11-10T23:00:00Z"}` + "\n")
+
+			var e *events.LogMessage
+			Eventually(reader.Msg).Should(Receive(&e))
+			Expect(e.Message).To(Equal([]byte("a stdout message")))
+			Eventually(other.Msg).Should(Receive(&e))
+			Expect(e.Message).To(Equal([]byte("another message")))
+
+			Consistently(reader.Err).ShouldNot(Receive())
+			Consistently(other.Err).ShouldNot(Receive())
+		})
+	})
+
 	Context("when the file is rolled", func() {
 		BeforeEach(func() {
 			jsonLog.WriteString(`{
-					"log": "a stdout message",
+					"log": "a stdout message\n",
 					"stream": "out",
 					"time": "2009-11-10T23:00:00Z"
 				}
 				{
-					"log": "a stderr message",
+					"log": "a stderr message\n",
 					"stream": "err",
 					"time": "2009-11-10T23:00:00Z"`)
 		})
@@ -128,10 +337,86 @@ var _ = Describe("JsonLogFile", func() {
 			Expect(err).NotTo(HaveOccurred())
 			jsonLog.WriteString(`}`)
 			jsonLog.Close()
+
+			newLog, err := os.Create(jsonLog.Name())
+			Expect(err).NotTo(HaveOccurred())
+			newLog.WriteString(`{"log": "a new message\n", "stream": "out", "time": "2009-11-10T23:00:00Z"}`)
+			newLog.Close()
+		})
+
+		AfterEach(func() {
+			os.Remove(jsonLog.Name() + ".1")
+		})
+
+		It("reads the rest of the rotated file and follows the new file", func() {
+			var e *events.LogMessage
+			Eventually(reader.Msg).Should(Receive(&e))
+			Expect(e.Message).To(Equal([]byte("a stderr message")))
+			Eventually(reader.Msg).Should(Receive(&e))
+			Expect(e.Message).To(Equal([]byte("a new message")))
+			Expect(e.AppId).To(Equal(proto.String(appID)))
+			Expect(e.SourceType).To(Equal(&source))
+		})
+
+		Context("with a shared watcher", func() {
+			BeforeEach(func() {
+				var err error
+				mux, err = notify.NewMux(notify.Options{})
+				Expect(err).NotTo(HaveOccurred())
+			})
+
+			AfterEach(func() {
+				mux.Close()
+			})
+
+			It("follows the new file", func() {
+				var e *events.LogMessage
+				Eventually(reader.Msg).Should(Receive(&e))
+				Eventually(reader.Msg).Should(Receive(&e))
+				Expect(e.Message).To(Equal([]byte("a new message")))
+			})
+		})
+	})
+
+	Context("when polling for changes", func() {
+		BeforeEach(func() {
+			notifyOptions = notify.Options{Backend: notify.BackendPoll, PollInterval: 10 * time.Millisecond}
+		})
+
+		It("reads lines as they are appended", func() {
+			Consistently(reader.Msg).ShouldNot(Receive())
+			jsonLog.WriteString(`{"log": "a polled message\n", "stream": "out", "time": "2009-11-10T23:00:00Z"}`)
+
+			var e *events.LogMessage
+			Eventually(reader.Msg).Should(Receive(&e))
+			Expect(e.Message).To(Equal([]byte("a polled message")))
+		})
+	})
+
+	Context("when the file is removed", func() {
+		BeforeEach(func() {
+			jsonLog.WriteString(`{"log": "a stdout message\n", "stream": "out", "time": "2009-11-10T23:00:00Z"}`)
+			jsonLog.Close()
 		})
 
-		It("BROKEN: loses the last line", func() {
+		JustBeforeEach(func() {
+			Eventually(reader.Msg).Should(Receive())
+			os.Remove(jsonLog.Name())
+		})
+
+		It("closes the reader when no new file appears", func() {
 			Eventually(reader.Msg).Should(BeClosed())
 		})
 	})
 })
+
+// failingWatcher reports the errors sent on errs instead of those of the
+// watcher it wraps.
+type failingWatcher struct {
+	notify.Watcher
+	errs chan error
+}
+
+func (w *failingWatcher) Errors() <-chan error {
+	return w.errs
+}
@@ -0,0 +1,103 @@
+package retriever
+
+import (
+	"regexp"
+	"time"
+
+	"github.com/cloudfoundry/sonde-go/events"
+)
+
+// DefaultContinuation matches lines that start with whitespace or
+// "Caused by:", as the frames of Java and Ruby stack traces do.
+var DefaultContinuation = regexp.MustCompile(`^(\s|Caused by:)`)
+
+// MultilineRule joins lines that continue the previous event, such as the
+// frames of a stack trace, into a single message.
+type MultilineRule struct {
+	// Continuation matches lines that belong to the previous event.
+	Continuation *regexp.Regexp
+	// FlushTimeout is how long after its first line an event is sent at
+	// the latest. Events longer than the reader's MaxMessageSize are sent
+	// as soon as they reach it.
+	FlushTimeout time.Duration
+}
+
+// aggregator holds back the most recent message until a line that does not
+// continue it arrives, it outgrows the maximum message size, or the flush
+// timeout, counted from its first line, expires.
+type aggregator struct {
+	rule MultilineRule
+	// maxMessageSize is the reader's; zero means no limit.
+	maxMessageSize int
+
+	pending *events.LogMessage
+	start   int64
+	timer   *time.Timer
+}
+
+func newAggregator(rule *MultilineRule, maxMessageSize int) *aggregator {
+	if rule == nil || rule.Continuation == nil {
+		return nil
+	}
+
+	timer := time.NewTimer(rule.FlushTimeout)
+	timer.Stop()
+
+	return &aggregator{
+		rule:           *rule,
+		maxMessageSize: maxMessageSize,
+		timer:          timer,
+	}
+}
+
+// add appends msg to the pending event or starts a new one at offset start.
+// It returns the event that msg completed, if any.
+func (a *aggregator) add(msg *events.LogMessage, start int64) *events.LogMessage {
+	if a.pending != nil &&
+		a.pending.GetMessageType() == msg.GetMessageType() &&
+		a.rule.Continuation.Match(msg.Message) {
+		message := appendLimited(a.pending.Message, []byte{'\n'}, a.maxMessageSize)
+		a.pending.Message = appendLimited(message, msg.Message, a.maxMessageSize)
+		return nil
+	}
+
+	completed := a.pending
+	a.pending, a.start = msg, start
+	a.timer.Reset(a.rule.FlushTimeout)
+	return completed
+}
+
+// full reports whether the pending event is already too long to be sent
+// whole, so that further lines would be cut off anyway.
+func (a *aggregator) full() bool {
+	return a != nil && a.pending != nil &&
+		a.maxMessageSize > 0 && len(a.pending.Message) > a.maxMessageSize
+}
+
+// flush returns the pending event, if any.
+func (a *aggregator) flush() *events.LogMessage {
+	if a == nil {
+		return nil
+	}
+
+	a.timer.Stop()
+	pending := a.pending
+	a.pending = nil
+	return pending
+}
+
+// pendingStart returns the offset at which the pending event starts.
+func (a *aggregator) pendingStart() (int64, bool) {
+	if a == nil || a.pending == nil {
+		return 0, false
+	}
+	return a.start, true
+}
+
+// timeout fires when the pending event should be flushed.
+func (a *aggregator) timeout() <-chan time.Time {
+	if a == nil || a.pending == nil {
+		return nil
+	}
+	return a.timer.C
+}
@@ -0,0 +1,160 @@
+package retriever_test
+
+import (
+	"io/ioutil"
+	"os"
+	"time"
+
+	. "github.com/cf-furnace/loggingAgent/retriever"
+	"github.com/cloudfoundry/sonde-go/events"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Multiline", func() {
+	var logFile *os.File
+	var flushTimeout time.Duration
+	var maxMessageSize int
+	var checkpoints *Checkpoints
+
+	var reader *LogReader
+
+	BeforeEach(func() {
+		flushTimeout = 100 * time.Millisecond
+		maxMessageSize = 0
+
+		var err error
+		logFile, err = ioutil.TempFile(tmpDir, "multiline")
+		Expect(err).NotTo(HaveOccurred())
+
+		checkpoints, err = LoadCheckpoints(logFile.Name() + ".checkpoints")
+		Expect(err).NotTo(HaveOccurred())
+
+		logFile.WriteString("2009-11-10T23:00:00Z stderr F java.lang.RuntimeException: boom\n")
+		logFile.WriteString("2009-11-10T23:00:01Z stderr F \tat Main.main(Main.java:1)\n")
+		logFile.WriteString("2009-11-10T23:00:02Z stderr F Caused by: java.io.IOException\n")
+	})
+
+	JustBeforeEach(func() {
+		var err error
+		reader, err = New(Config{
+			Source:   "APP",
+			AppID:    "appID",
+			Filename: logFile.Name(),
+			Format:   FormatCRI,
+			Multiline: &MultilineRule{
+				Continuation: DefaultContinuation,
+				FlushTimeout: flushTimeout,
+			},
+			MaxMessageSize:   maxMessageSize,
+			TruncationMarker: "...",
+			Checkpoints:      checkpoints,
+		})
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	AfterEach(func() {
+		os.Remove(logFile.Name())
+	})
+
+	It("joins continuation lines into one message", func() {
+		var e *events.LogMessage
+		Eventually(reader.Msg).Should(Receive(&e))
+		Expect(string(e.Message)).To(Equal("java.lang.RuntimeException: boom\n\tat Main.main(Main.java:1)\nCaused by: java.io.IOException"))
+		Expect(e.GetTimestamp()).To(Equal(int64(1257894000000000000)))
+	})
+
+	Context("when a line does not continue the message", func() {
+		BeforeEach(func() {
+			flushTimeout = time.Hour
+			logFile.WriteString("2009-11-10T23:00:03Z stderr F next message\n")
+		})
+
+		It("sends the previous message right away", func() {
+			var e *events.LogMessage
+			Eventually(reader.Msg).Should(Receive(&e))
+			Expect(string(e.Message)).To(HavePrefix("java.lang.RuntimeException"))
+			Consistently(reader.Msg).ShouldNot(Receive())
+		})
+
+		It("sends the held back message when the reader is stopped", func() {
+			Eventually(reader.Msg).Should(Receive())
+			reader.Stop()
+
+			var e *events.LogMessage
+			Eventually(reader.Msg).Should(Receive(&e))
+			Expect(string(e.Message)).To(Equal("next message"))
+			Eventually(reader.Msg).Should(BeClosed())
+		})
+
+		It("does not checkpoint past the held back message", func() {
+			var e *events.LogMessage
+			Eventually(reader.Msg).Should(Receive(&e))
+			reader.Commit(e)
+			Consistently(func() int64 {
+				offset, _ := checkpoints.Get(inode(logFile.Name()), logFile.Name())
+				return offset
+			}).Should(BeNumerically("<", fileSize(logFile.Name())))
+		})
+	})
+
+	Context("when continuation lines keep coming", func() {
+		It("sends the message when the flush timeout expires", func() {
+			done := make(chan struct{})
+			defer close(done)
+			go func(logFile *os.File, done chan struct{}) {
+				for {
+					select {
+					case <-done:
+						return
+					case <-time.After(10 * time.Millisecond):
+						logFile.WriteString("2009-11-10T23:00:03Z stderr F \tat Main.loop(Main.java:2)\n")
+					}
+				}
+			}(logFile, done)
+
+			var e *events.LogMessage
+			Eventually(reader.Msg, time.Second).Should(Receive(&e))
+			Expect(string(e.Message)).To(HavePrefix("java.lang.RuntimeException: boom\n"))
+		})
+	})
+
+	Context("when the message outgrows the maximum message size", func() {
+		BeforeEach(func() {
+			flushTimeout = time.Hour
+			maxMessageSize = 64
+			for i := 0; i < 10; i++ {
+				logFile.WriteString("2009-11-10T23:00:03Z stderr F \tat Main.loop(Main.java:2)\n")
+			}
+		})
+
+		It("sends it truncated right away", func() {
+			var e *events.LogMessage
+			Eventually(reader.Msg).Should(Receive(&e))
+			Expect(e.Message).To(HaveLen(64))
+			Expect(string(e.Message)).To(HavePrefix("java.lang.RuntimeException: boom\n"))
+			Expect(string(e.Message)).To(HaveSuffix("..."))
+		})
+	})
+
+	Context("when the message is on another stream", func() {
+		BeforeEach(func() {
+			logFile.WriteString("2009-11-10T23:00:03Z stdout F \tindented stdout\n")
+		})
+
+		It("does not join it", func() {
+			var e *events.LogMessage
+			Eventually(reader.Msg).Should(Receive(&e))
+			Expect(e.GetMessageType()).To(Equal(events.LogMessage_ERR))
+			Eventually(reader.Msg).Should(Receive(&e))
+			Expect(string(e.Message)).To(Equal("\tindented stdout"))
+		})
+	})
+})
+
+func fileSize(path string) int64 {
+	fi, err := os.Stat(path)
+	Expect(err).NotTo(HaveOccurred())
+	return fi.Size()
+}
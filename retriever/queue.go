@@ -0,0 +1,262 @@
+package retriever
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/cloudfoundry/sonde-go/events"
+)
+
+// Policy decides what a reader does with a message when its queue or the
+// memory budget is full.
+type Policy string
+
+const (
+	// PolicyBlock stops reading until there is room.
+	PolicyBlock Policy = "block"
+	// PolicyDropOldest drops queued messages, oldest first, to make room.
+	PolicyDropOldest Policy = "drop-oldest"
+	// PolicyDropNewest drops the message.
+	PolicyDropNewest Policy = "drop-newest"
+)
+
+// DefaultQueueSize is the number of messages a reader queues when
+// Config.QueueSize is not set.
+const DefaultQueueSize = 4096
+
+// ParsePolicy converts a policy name into a Policy. An empty name means
+// PolicyBlock.
+func ParsePolicy(name string) (Policy, error) {
+	switch policy := Policy(name); policy {
+	case "":
+		return PolicyBlock, nil
+	case PolicyBlock, PolicyDropOldest, PolicyDropNewest:
+		return policy, nil
+	default:
+		return "", fmt.Errorf("unknown back-pressure policy %q", name)
+	}
+}
+
+// Budget limits the bytes of the messages queued by all the readers sharing
+// it. A nil Budget has no limit.
+type Budget struct {
+	max int64
+
+	mu       sync.Mutex
+	used     int64
+	released chan struct{}
+}
+
+// NewBudget creates a budget of max bytes.
+func NewBudget(max int64) *Budget {
+	return &Budget{
+		max:      max,
+		released: make(chan struct{}),
+	}
+}
+
+// Used returns the number of bytes held by queued messages.
+func (b *Budget) Used() int64 {
+	if b == nil {
+		return 0
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.used
+}
+
+// acquire takes n bytes from the budget if they are available. A message
+// larger than the whole budget is let through when nothing else is queued.
+func (b *Budget) acquire(n int64) bool {
+	if b == nil {
+		return true
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.used > 0 && b.used+n > b.max {
+		return false
+	}
+	b.used += n
+	return true
+}
+
+func (b *Budget) release(n int64) {
+	if b == nil {
+		return
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.used -= n
+	close(b.released)
+	b.released = make(chan struct{})
+}
+
+// wait returns a channel that is closed the next time bytes are released.
+func (b *Budget) wait() <-chan struct{} {
+	if b == nil {
+		return nil
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.released
+}
+
+// mark is the checkpoint a reader records once a message has been delivered.
+type mark struct {
+	ino    uint64
+	offset int64
+}
+
+// queued is a message waiting in the queue along with its mark.
+type queued struct {
+	msg  *events.LogMessage
+	mark mark
+}
+
+// queue holds the messages a reader has read until they are received from
+// Msg, and counts the ones dropped in the meantime.
+type queue struct {
+	size   int
+	policy Policy
+	budget *Budget
+
+	mu      sync.Mutex
+	msgs    []queued
+	dropped uint64
+	closed  bool
+
+	ready chan struct{}
+	space chan struct{}
+}
+
+func newQueue(size int, policy Policy, budget *Budget) *queue {
+	if size <= 0 {
+		size = DefaultQueueSize
+	}
+
+	return &queue{
+		size:   size,
+		policy: policy,
+		budget: budget,
+		ready:  make(chan struct{}, 1),
+		space:  make(chan struct{}, 1),
+	}
+}
+
+func messageSize(msg *events.LogMessage) int64 {
+	return int64(len(msg.Message))
+}
+
+// push queues msg as the policy allows. It returns the number of messages
+// dropped to do so.
+func (q *queue) push(msg *events.LogMessage, m mark) uint64 {
+	n := messageSize(msg)
+	item := queued{msg: msg, mark: m}
+
+	for {
+		wait := q.budget.wait()
+
+		q.mu.Lock()
+		if len(q.msgs) < q.size && q.budget.acquire(n) {
+			q.msgs = append(q.msgs, item)
+			q.mu.Unlock()
+			signal(q.ready)
+			return 0
+		}
+
+		switch q.policy {
+		case PolicyDropNewest:
+			q.dropped++
+			q.mu.Unlock()
+			return 1
+		case PolicyDropOldest:
+			var dropped uint64
+			for {
+				dropped++
+				q.dropped++
+				if len(q.msgs) == 0 {
+					// the budget is held by other readers.
+					q.mu.Unlock()
+					return dropped
+				}
+
+				oldest := q.msgs[0]
+				q.msgs[0] = queued{}
+				q.msgs = q.msgs[1:]
+				q.budget.release(messageSize(oldest.msg))
+
+				if q.budget.acquire(n) {
+					q.msgs = append(q.msgs, item)
+					q.mu.Unlock()
+					signal(q.ready)
+					return dropped
+				}
+			}
+		default:
+			q.mu.Unlock()
+			select {
+			case <-q.space:
+			case <-wait:
+			}
+		}
+	}
+}
+
+// pop waits for the next message. It also returns the number of messages
+// dropped since the previous call, and false once the queue is closed and
+// empty. The message is nil when there is none to return.
+func (q *queue) pop() (queued, uint64, bool) {
+	for {
+		q.mu.Lock()
+		dropped := q.dropped
+		q.dropped = 0
+
+		if len(q.msgs) > 0 {
+			item := q.msgs[0]
+			q.msgs[0] = queued{}
+			q.msgs = q.msgs[1:]
+			q.mu.Unlock()
+			return item, dropped, true
+		}
+
+		closed := q.closed
+		q.mu.Unlock()
+
+		if dropped > 0 || closed {
+			return queued{}, dropped, !closed
+		}
+		<-q.ready
+	}
+}
+
+// done releases the budget held by a message that was popped and received.
+func (q *queue) done(msg *events.LogMessage) {
+	q.budget.release(messageSize(msg))
+	signal(q.space)
+}
+
+func (q *queue) len() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return len(q.msgs)
+}
+
+func (q *queue) close() {
+	q.mu.Lock()
+	q.closed = true
+	q.mu.Unlock()
+	signal(q.ready)
+}
+
+func signal(ch chan struct{}) {
+	select {
+	case ch <- struct{}{}:
+	default:
+	}
+}
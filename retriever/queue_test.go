@@ -0,0 +1,152 @@
+package retriever_test
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"time"
+
+	. "github.com/cf-furnace/loggingAgent/retriever"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Back-pressure", func() {
+	const lines = 10
+
+	var (
+		logFile *os.File
+		policy  Policy
+		budget  *Budget
+
+		reader *LogReader
+	)
+
+	BeforeEach(func() {
+		policy = PolicyBlock
+		budget = nil
+
+		var err error
+		logFile, err = ioutil.TempFile(tmpDir, "backpressure")
+		Expect(err).NotTo(HaveOccurred())
+
+		for i := 0; i < lines; i++ {
+			fmt.Fprintf(logFile, "2009-11-10T23:00:00Z stdout F line %d\n", i)
+		}
+		logFile.Close()
+	})
+
+	JustBeforeEach(func() {
+		var err error
+		reader, err = New(Config{
+			Source:    "APP",
+			AppID:     "appID",
+			Filename:  logFile.Name(),
+			Format:    FormatCRI,
+			QueueSize: 2,
+			Policy:    policy,
+			Budget:    budget,
+		})
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	AfterEach(func() {
+		os.Remove(logFile.Name())
+	})
+
+	receiveAll := func() []string {
+		var messages []string
+		for {
+			select {
+			case msg := <-reader.Msg:
+				messages = append(messages, string(msg.Message))
+			case <-time.After(100 * time.Millisecond):
+				return messages
+			}
+		}
+	}
+
+	isNotice := func(message string) bool {
+		return strings.HasPrefix(message, "Log message output too high")
+	}
+
+	Context("when blocking", func() {
+		It("stops reading until there is room", func() {
+			Consistently(reader.Stats).Should(HaveField("LinesRead", BeNumerically("<", lines)))
+		})
+
+		It("delivers every message in order", func() {
+			messages := receiveAll()
+			Expect(messages).To(HaveLen(lines))
+			Expect(messages[0]).To(Equal("line 0"))
+			Expect(messages[lines-1]).To(Equal(fmt.Sprintf("line %d", lines-1)))
+			Expect(reader.Stats().Dropped).To(BeZero())
+		})
+	})
+
+	Context("when dropping the newest messages", func() {
+		BeforeEach(func() {
+			policy = PolicyDropNewest
+		})
+
+		It("tells the app how many messages were dropped", func() {
+			Eventually(reader.Stats).Should(HaveField("LinesRead", uint64(lines)))
+			messages := receiveAll()
+			dropped := reader.Stats().Dropped
+			Expect(dropped).NotTo(BeZero())
+
+			Expect(messages).To(ContainElement(fmt.Sprintf("Log message output too high. We've dropped %d messages", dropped)))
+			Expect(messages).To(HaveLen(lines - int(dropped) + 1))
+			Expect(messages).NotTo(ContainElement(fmt.Sprintf("line %d", lines-1)))
+		})
+	})
+
+	Context("when dropping the oldest messages", func() {
+		BeforeEach(func() {
+			policy = PolicyDropOldest
+		})
+
+		It("keeps the newest messages", func() {
+			Eventually(reader.Stats).Should(HaveField("LinesRead", uint64(lines)))
+			messages := receiveAll()
+			Expect(reader.Stats().Dropped).NotTo(BeZero())
+			Expect(messages).To(ContainElement(fmt.Sprintf("line %d", lines-1)))
+
+			notices := 0
+			for _, message := range messages {
+				if isNotice(message) {
+					notices++
+				}
+			}
+			Expect(notices).NotTo(BeZero())
+		})
+	})
+
+	Context("with a memory budget", func() {
+		BeforeEach(func() {
+			policy = PolicyDropNewest
+			budget = NewBudget(int64(len("line 0")))
+		})
+
+		It("drops what does not fit and releases it once received", func() {
+			Eventually(reader.Stats).Should(HaveField("LinesRead", uint64(lines)))
+			messages := receiveAll()
+			Expect(reader.Stats().Dropped).NotTo(BeZero())
+			Expect(messages).To(ContainElement(WithTransform(isNotice, BeTrue())))
+			Expect(budget.Used()).To(BeZero())
+		})
+	})
+})
+
+var _ = Describe("ParsePolicy", func() {
+	It("defaults to blocking", func() {
+		Expect(ParsePolicy("")).To(Equal(PolicyBlock))
+	})
+
+	It("rejects unknown policies", func() {
+		_, err := ParsePolicy("spill")
+		Expect(err).To(MatchError(`unknown back-pressure policy "spill"`))
+	})
+})
@@ -2,11 +2,15 @@ package retriever_test
 
 import (
 	"os"
+	"time"
+
+	. "github.com/cf-furnace/loggingAgent/retriever"
 
 	. "github.com/onsi/ginkgo"
 	. "github.com/onsi/gomega"
 
 	"io/ioutil"
+	"syscall"
 	"testing"
 )
 
@@ -18,6 +22,8 @@ func TestRetriever(t *testing.T) {
 }
 
 var _ = BeforeSuite(func() {
+	OpenRetryInterval = 10 * time.Millisecond
+
 	var err error
 	tmpDir, err = ioutil.TempDir("", "retriever")
 	Expect(err).NotTo(HaveOccurred())
@@ -26,3 +32,9 @@ var _ = BeforeSuite(func() {
 var _ = AfterSuite(func() {
 	os.RemoveAll(tmpDir)
 })
+
+func inode(path string) uint64 {
+	fi, err := os.Stat(path)
+	Expect(err).NotTo(HaveOccurred())
+	return fi.Sys().(*syscall.Stat_t).Ino
+}
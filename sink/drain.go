@@ -0,0 +1,275 @@
+package sink
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"code.cloudfoundry.org/lager"
+	"code.cloudfoundry.org/rfc5424"
+
+	"github.com/cloudfoundry/sonde-go/events"
+)
+
+// DefaultDrainBufferSize is the number of messages a drain holds while its
+// destination is unreachable, when no size is given.
+const DefaultDrainBufferSize = 1000
+
+// The time a drain waits before sending again after a failure. It doubles
+// after each failure in a row, up to MaxRetryInterval.
+var (
+	RetryInterval    = time.Second
+	MaxRetryInterval = time.Minute
+)
+
+// transport delivers syslog messages to a destination.
+type transport interface {
+	write(message rfc5424.Message) error
+	Close() error
+}
+
+// Drain forwards the messages of an app to one of its syslog drains. The
+// messages are sent in the background and retried until they are delivered;
+// the oldest are dropped when more than the buffer holds are waiting.
+//
+// As on Diego, the hostname of each message is made of the app's
+// organization, space and name tags, and the app name is the app GUID.
+type Drain struct {
+	logger    lager.Logger
+	transport transport
+	size      int
+
+	mu      sync.Mutex
+	buffer  []rfc5424.Message
+	dropped uint64
+	// sending is set while the first message in the buffer is being sent,
+	// and cleared if that message is dropped in the meantime.
+	sending bool
+	ready   chan struct{}
+
+	done      chan struct{}
+	closeOnce sync.Once
+	stopped   chan struct{}
+}
+
+// NewDrain creates a drain for a syslog://, syslog-tls:// or https:// URL.
+// TLS connections use tlsConfig, which may be nil to trust the system's
+// certificate authorities.
+func NewDrain(logger lager.Logger, rawURL string, tlsConfig *tls.Config, bufferSize int) (*Drain, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, err
+	}
+	logger = logger.Session("drain", lager.Data{"host": u.Host})
+
+	var t transport
+	if u.Scheme == "https" {
+		ctx, cancel := context.WithCancel(context.Background())
+		t = &httpsTransport{
+			url:    rawURL,
+			client: &http.Client{Timeout: DialTimeout, Transport: &http.Transport{TLSClientConfig: tlsConfig}},
+			ctx:    ctx,
+			cancel: cancel,
+		}
+	} else {
+		config, err := ParseSyslogURL(rawURL, tlsConfig)
+		if err != nil {
+			return nil, err
+		}
+		t = NewSyslog(logger, config)
+	}
+
+	if bufferSize <= 0 {
+		bufferSize = DefaultDrainBufferSize
+	}
+
+	d := &Drain{
+		logger:    logger,
+		transport: t,
+		size:      bufferSize,
+		ready:     make(chan struct{}, 1),
+		done:      make(chan struct{}),
+		stopped:   make(chan struct{}),
+	}
+	go d.run()
+
+	return d, nil
+}
+
+// Send queues msg for delivery. It does not wait for it to be sent, but
+// rejects messages that cannot be encoded.
+func (d *Drain) Send(msg *events.LogMessage, tags map[string]string) error {
+	message := SyslogMessage(msg, tags, DrainHostname(msg.GetAppId(), tags))
+	if _, err := message.MarshalBinary(); err != nil {
+		return err
+	}
+
+	d.mu.Lock()
+	if len(d.buffer) == d.size {
+		d.buffer[0] = rfc5424.Message{}
+		d.buffer = d.buffer[1:]
+		d.dropped++
+		d.sending = false
+	}
+	d.buffer = append(d.buffer, message)
+	d.mu.Unlock()
+
+	signal(d.ready)
+	return nil
+}
+
+// Dropped returns the number of messages dropped because the buffer was
+// full.
+func (d *Drain) Dropped() uint64 {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.dropped
+}
+
+// Close stops sending. Messages that have not been sent are discarded.
+func (d *Drain) Close() error {
+	d.closeOnce.Do(func() {
+		close(d.done)
+	})
+	// closing the transport fails a message being sent, so that run can
+	// return.
+	err := d.transport.Close()
+	<-d.stopped
+	return err
+}
+
+func (d *Drain) run() {
+	defer close(d.stopped)
+
+	retry := RetryInterval
+	for {
+		d.mu.Lock()
+		if len(d.buffer) == 0 {
+			d.mu.Unlock()
+			select {
+			case <-d.ready:
+				continue
+			case <-d.done:
+				return
+			}
+		}
+		message := d.buffer[0]
+		d.sending = true
+		d.mu.Unlock()
+
+		err := d.transport.write(message)
+		if err != nil {
+			d.logger.Error("failed-to-send", err, lager.Data{"retry-in": retry.String()})
+			select {
+			case <-time.After(retry):
+			case <-d.done:
+				return
+			}
+			retry *= 2
+			if retry > MaxRetryInterval {
+				retry = MaxRetryInterval
+			}
+			continue
+		}
+		retry = RetryInterval
+
+		d.mu.Lock()
+		if d.sending {
+			d.buffer[0] = rfc5424.Message{}
+			d.buffer = d.buffer[1:]
+			d.sending = false
+		}
+		d.mu.Unlock()
+	}
+}
+
+var hostnameUnsafe = regexp.MustCompile(`[^a-zA-Z0-9-]+`)
+
+// DrainHostname returns the hostname Diego gives the messages of an app:
+// "organization.space.app", with each part reduced to letters, digits and
+// dashes. It is the app GUID when the names are not known.
+func DrainHostname(appID string, tags map[string]string) string {
+	var parts []string
+	for _, tag := range []string{"organization_name", "space_name", "app_name"} {
+		part := strings.Trim(hostnameUnsafe.ReplaceAllString(tags[tag], "-"), "-")
+		if part == "" {
+			return appID
+		}
+		if len(part) > 63 {
+			part = part[:63]
+		}
+		parts = append(parts, part)
+	}
+	return strings.Join(parts, ".")
+}
+
+// LoadDrainURLs reads the drain URLs of apps from a JSON file mapping app
+// GUIDs to lists of URLs.
+func LoadDrainURLs(path string) (map[string][]string, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	drains := map[string][]string{}
+	err = json.Unmarshal(data, &drains)
+	if err != nil {
+		return nil, fmt.Errorf("invalid drains file %s: %s", path, err)
+	}
+	return drains, nil
+}
+
+// httpsTransport posts each message to a URL. Closing it cancels the
+// request in progress.
+type httpsTransport struct {
+	url    string
+	client *http.Client
+
+	ctx    context.Context
+	cancel context.CancelFunc
+}
+
+func (t *httpsTransport) write(message rfc5424.Message) error {
+	body, err := message.MarshalBinary()
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(t.ctx, "POST", t.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "text/plain")
+
+	resp, err := t.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("drain responded with %s", resp.Status)
+	}
+	return nil
+}
+
+func (t *httpsTransport) Close() error {
+	t.cancel()
+	return nil
+}
+
+func signal(ch chan struct{}) {
+	select {
+	case ch <- struct{}{}:
+	default:
+	}
+}
@@ -0,0 +1,264 @@
+package sink_test
+
+import (
+	"bufio"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"code.cloudfoundry.org/lager/lagertest"
+	"code.cloudfoundry.org/rfc5424"
+	"github.com/cf-furnace/loggingAgent/sink"
+	"github.com/cloudfoundry/sonde-go/events"
+	"github.com/gogo/protobuf/proto"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Drain", func() {
+	var (
+		logger *lagertest.TestLogger
+		msg    *events.LogMessage
+		tags   map[string]string
+
+		drain *sink.Drain
+	)
+
+	BeforeEach(func() {
+		logger = lagertest.NewTestLogger("")
+		sink.RetryInterval = 10 * time.Millisecond
+		drain = nil
+
+		msg = &events.LogMessage{
+			Message:        []byte("a message"),
+			MessageType:    events.LogMessage_OUT.Enum(),
+			Timestamp:      proto.Int64(1257894000000000000),
+			AppId:          proto.String("app-guid"),
+			SourceType:     proto.String("APP"),
+			SourceInstance: proto.String("0"),
+		}
+		tags = map[string]string{
+			"organization_name": "org",
+			"space_name":        "dev",
+			"app_name":          "my app",
+		}
+	})
+
+	AfterEach(func() {
+		if drain != nil {
+			drain.Close()
+		}
+	})
+
+	Context("with a syslog drain", func() {
+		var (
+			address  string
+			received chan rfc5424.Message
+		)
+
+		// listen accepts connections on address and passes on the messages
+		// they carry.
+		listen := func(address string, received chan<- rfc5424.Message) net.Listener {
+			listener, err := net.Listen("tcp", address)
+			Expect(err).NotTo(HaveOccurred())
+
+			go func() {
+				for {
+					conn, err := listener.Accept()
+					if err != nil {
+						return
+					}
+					go func() {
+						defer conn.Close()
+						r := bufio.NewReader(conn)
+						for {
+							var message rfc5424.Message
+							if _, err := message.ReadFrom(r); err != nil {
+								return
+							}
+							received <- message
+						}
+					}()
+				}
+			}()
+			return listener
+		}
+
+		BeforeEach(func() {
+			received = make(chan rfc5424.Message, 10)
+
+			listener := listen("127.0.0.1:0", received)
+			address = listener.Addr().String()
+			listener.Close()
+		})
+
+		JustBeforeEach(func() {
+			var err error
+			drain, err = sink.NewDrain(logger, "syslog://"+address, nil, 2)
+			Expect(err).NotTo(HaveOccurred())
+		})
+
+		It("retries until the drain can be reached", func() {
+			Expect(drain.Send(msg, tags)).To(Succeed())
+			Eventually(logger.LogMessages).Should(ContainElement(".drain.failed-to-send"))
+
+			listener := listen(address, received)
+			defer listener.Close()
+
+			var message rfc5424.Message
+			Eventually(received).Should(Receive(&message))
+			Expect(message.Hostname).To(Equal("org.dev.my-app"))
+			Expect(message.AppName).To(Equal("app-guid"))
+			Expect(message.ProcessID).To(Equal("[APP/0]"))
+			Expect(string(message.Message)).To(Equal("a message\n"))
+		})
+
+		It("drops the oldest messages when its buffer is full", func() {
+			for _, text := range []string{"one", "two", "three"} {
+				msg.Message = []byte(text)
+				Expect(drain.Send(msg, tags)).To(Succeed())
+			}
+			Expect(drain.Dropped()).To(Equal(uint64(1)))
+
+			listener := listen(address, received)
+			defer listener.Close()
+
+			var messages []string
+			for len(messages) < 2 {
+				var message rfc5424.Message
+				Eventually(received).Should(Receive(&message))
+				messages = append(messages, string(message.Message))
+			}
+			Expect(messages).To(Equal([]string{"two\n", "three\n"}))
+		})
+	})
+
+	Context("with an https drain", func() {
+		var (
+			server *httptest.Server
+
+			mu     sync.Mutex
+			bodies []string
+		)
+
+		received := func() []string {
+			mu.Lock()
+			defer mu.Unlock()
+			return append([]string{}, bodies...)
+		}
+
+		BeforeEach(func() {
+			bodies = nil
+			server = httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+				body, _ := ioutil.ReadAll(req.Body)
+				mu.Lock()
+				bodies = append(bodies, string(body))
+				mu.Unlock()
+			}))
+
+			var err error
+			drain, err = sink.NewDrain(logger, server.URL+"/logs", server.Client().Transport.(*http.Transport).TLSClientConfig, 0)
+			Expect(err).NotTo(HaveOccurred())
+		})
+
+		AfterEach(func() {
+			server.Close()
+		})
+
+		It("posts each message", func() {
+			Expect(drain.Send(msg, tags)).To(Succeed())
+			Eventually(received).Should(HaveLen(1))
+
+			var message rfc5424.Message
+			Expect(message.UnmarshalBinary([]byte(received()[0]))).To(Succeed())
+			Expect(message.Hostname).To(Equal("org.dev.my-app"))
+		})
+
+		Context("when the drain does not respond", func() {
+			var release chan struct{}
+
+			BeforeEach(func() {
+				release = make(chan struct{})
+				server.Config.Handler = http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+					mu.Lock()
+					bodies = append(bodies, "")
+					mu.Unlock()
+					<-release
+				})
+			})
+
+			AfterEach(func() {
+				close(release)
+			})
+
+			It("stops sending when it is closed", func() {
+				Expect(drain.Send(msg, tags)).To(Succeed())
+				Eventually(received).Should(HaveLen(1))
+
+				closed := make(chan error)
+				go func(drain *sink.Drain) {
+					closed <- drain.Close()
+				}(drain)
+				Eventually(closed).Should(Receive())
+			})
+		})
+	})
+
+	It("rejects unknown schemes", func() {
+		_, err := sink.NewDrain(logger, "ftp://logs.example.com:21", nil, 0)
+		Expect(err).To(MatchError(`unknown syslog scheme "ftp"`))
+	})
+})
+
+var _ = Describe("DrainHostname", func() {
+	It("joins the organization, space and app names", func() {
+		hostname := sink.DrainHostname("app-guid", map[string]string{
+			"organization_name": "my.org",
+			"space_name":        "dev",
+			"app_name":          "_app_",
+		})
+		Expect(hostname).To(Equal("my-org.dev.app"))
+	})
+
+	It("uses the app GUID when a name is missing", func() {
+		hostname := sink.DrainHostname("app-guid", map[string]string{"app_name": "app"})
+		Expect(hostname).To(Equal("app-guid"))
+	})
+})
+
+var _ = Describe("LoadDrainURLs", func() {
+	var dir string
+
+	BeforeEach(func() {
+		var err error
+		dir, err = ioutil.TempDir("", "drains")
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	AfterEach(func() {
+		os.RemoveAll(dir)
+	})
+
+	It("reads the drains of each app", func() {
+		path := filepath.Join(dir, "drains.json")
+		Expect(ioutil.WriteFile(path, []byte(`{"app-guid": ["syslog://logs.example.com:514"]}`), 0644)).To(Succeed())
+
+		drains, err := sink.LoadDrainURLs(path)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(drains).To(Equal(map[string][]string{"app-guid": {"syslog://logs.example.com:514"}}))
+	})
+
+	It("fails on invalid files", func() {
+		path := filepath.Join(dir, "drains.json")
+		Expect(ioutil.WriteFile(path, []byte(`[]`), 0644)).To(Succeed())
+
+		_, err := sink.LoadDrainURLs(path)
+		Expect(err).To(HaveOccurred())
+	})
+})
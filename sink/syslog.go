@@ -0,0 +1,210 @@
+// Package sink provides destinations for the logs read by the proxy other
+// than loggregator.
+package sink
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"code.cloudfoundry.org/lager"
+	"code.cloudfoundry.org/rfc5424"
+
+	"github.com/cloudfoundry/sonde-go/events"
+)
+
+// tagsID is the ID of the structured data element holding a message's tags.
+const tagsID = "tags@47450"
+
+// DialTimeout bounds the time taken to connect to a syslog server.
+var DialTimeout = 10 * time.Second
+
+// WriteTimeout bounds the time taken to send a message to a syslog server,
+// so that a server that stops reading cannot hold up the sender.
+var WriteTimeout = 10 * time.Second
+
+var errClosed = errors.New("syslog sink closed")
+
+// SyslogConfig describes a syslog server.
+type SyslogConfig struct {
+	// Address is the host and port of the server.
+	Address string
+	// TLS, if set, secures the connection.
+	TLS *tls.Config
+	// Hostname identifies the sender in each message.
+	Hostname string
+}
+
+// ParseSyslogURL parses a syslog://host:port or syslog-tls://host:port URL.
+// TLS connections use tlsConfig, which may be nil to trust the system's
+// certificate authorities.
+func ParseSyslogURL(rawURL string, tlsConfig *tls.Config) (SyslogConfig, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return SyslogConfig{}, err
+	}
+	if u.Port() == "" {
+		return SyslogConfig{}, fmt.Errorf("syslog URL %q has no port", rawURL)
+	}
+
+	switch u.Scheme {
+	case "syslog":
+		return SyslogConfig{Address: u.Host}, nil
+	case "syslog-tls":
+		if tlsConfig == nil {
+			tlsConfig = &tls.Config{}
+		}
+		tlsConfig = tlsConfig.Clone()
+		if tlsConfig.ServerName == "" {
+			tlsConfig.ServerName = u.Hostname()
+		}
+		return SyslogConfig{Address: u.Host, TLS: tlsConfig}, nil
+	default:
+		return SyslogConfig{}, fmt.Errorf("unknown syslog scheme %q", u.Scheme)
+	}
+}
+
+// Syslog sends messages to a syslog server over TCP as RFC 5424 messages
+// framed by octet counting. It connects when it is first used and again
+// after a message fails to send.
+type Syslog struct {
+	logger lager.Logger
+	config SyslogConfig
+
+	// writeMu serializes the writes; mu guards the connection so that Close
+	// does not wait for a write in progress.
+	writeMu sync.Mutex
+	mu      sync.Mutex
+	conn    net.Conn
+	closed  bool
+}
+
+func NewSyslog(logger lager.Logger, config SyslogConfig) *Syslog {
+	return &Syslog{
+		logger: logger.Session("syslog", lager.Data{"address": config.Address}),
+		config: config,
+	}
+}
+
+func (s *Syslog) Send(msg *events.LogMessage, tags map[string]string) error {
+	return s.write(SyslogMessage(msg, tags, s.config.Hostname))
+}
+
+func (s *Syslog) write(message rfc5424.Message) error {
+	// a message that cannot be encoded says nothing about the connection.
+	b, err := message.MarshalBinary()
+	if err != nil {
+		return err
+	}
+	frame := append([]byte(strconv.Itoa(len(b))+" "), b...)
+
+	s.writeMu.Lock()
+	defer s.writeMu.Unlock()
+
+	conn, err := s.connect()
+	if err != nil {
+		return err
+	}
+
+	conn.SetWriteDeadline(time.Now().Add(WriteTimeout))
+	_, err = conn.Write(frame)
+	if err != nil {
+		s.logger.Error("failed-to-send", err)
+		s.mu.Lock()
+		if s.conn == conn {
+			s.conn = nil
+		}
+		s.mu.Unlock()
+		conn.Close()
+		return err
+	}
+	return nil
+}
+
+// connect returns the current connection, dialing the server if there is
+// none. The caller holds writeMu.
+func (s *Syslog) connect() (net.Conn, error) {
+	s.mu.Lock()
+	conn, closed := s.conn, s.closed
+	s.mu.Unlock()
+
+	if closed {
+		return nil, errClosed
+	}
+	if conn != nil {
+		return conn, nil
+	}
+
+	conn, err := s.dial()
+	if err != nil {
+		s.logger.Error("failed-to-connect", err)
+		return nil, err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		conn.Close()
+		return nil, errClosed
+	}
+	s.conn = conn
+	return conn, nil
+}
+
+// Close closes the connection, making a write in progress fail.
+func (s *Syslog) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.closed = true
+	if s.conn == nil {
+		return nil
+	}
+	err := s.conn.Close()
+	s.conn = nil
+	return err
+}
+
+func (s *Syslog) dial() (net.Conn, error) {
+	dialer := &net.Dialer{Timeout: DialTimeout}
+	if s.config.TLS != nil {
+		return tls.DialWithDialer(dialer, "tcp", s.config.Address, s.config.TLS)
+	}
+	return dialer.Dial("tcp", s.config.Address)
+}
+
+// SyslogMessage converts a log message into an RFC 5424 message from the
+// app, with the source in the process ID as in "[APP/0]" and the tags as
+// structured data.
+func SyslogMessage(msg *events.LogMessage, tags map[string]string, hostname string) rfc5424.Message {
+	priority := rfc5424.User | rfc5424.Info
+	if msg.GetMessageType() == events.LogMessage_ERR {
+		priority = rfc5424.User | rfc5424.Error
+	}
+
+	message := rfc5424.Message{
+		Priority:  priority,
+		Timestamp: time.Unix(0, msg.GetTimestamp()).UTC(),
+		Hostname:  hostname,
+		AppName:   msg.GetAppId(),
+		ProcessID: fmt.Sprintf("[%s/%s]", msg.GetSourceType(), msg.GetSourceInstance()),
+		Message:   append(append([]byte{}, msg.GetMessage()...), '\n'),
+	}
+
+	keys := make([]string, 0, len(tags))
+	for key := range tags {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		message.AddDatum(tagsID, key, tags[key])
+	}
+
+	return message
+}
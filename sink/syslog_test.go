@@ -0,0 +1,222 @@
+package sink_test
+
+import (
+	"bufio"
+	"crypto/tls"
+	"net"
+	"strings"
+	"time"
+
+	"code.cloudfoundry.org/lager/lagertest"
+	"code.cloudfoundry.org/rfc5424"
+	"github.com/cf-furnace/loggingAgent/sink"
+	"github.com/cloudfoundry/sonde-go/events"
+	"github.com/gogo/protobuf/proto"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Syslog", func() {
+	var (
+		listener net.Listener
+		received chan rfc5424.Message
+		conns    chan net.Conn
+
+		syslog *sink.Syslog
+		msg    *events.LogMessage
+	)
+
+	BeforeEach(func() {
+		var err error
+		listener, err = net.Listen("tcp", "127.0.0.1:0")
+		Expect(err).NotTo(HaveOccurred())
+
+		received = make(chan rfc5424.Message, 10)
+		conns = make(chan net.Conn, 10)
+		go func(listener net.Listener, received chan<- rfc5424.Message, conns chan<- net.Conn) {
+			for {
+				conn, err := listener.Accept()
+				if err != nil {
+					return
+				}
+				conns <- conn
+
+				go func() {
+					r := bufio.NewReader(conn)
+					for {
+						var message rfc5424.Message
+						if _, err := message.ReadFrom(r); err != nil {
+							return
+						}
+						received <- message
+					}
+				}()
+			}
+		}(listener, received, conns)
+
+		syslog = sink.NewSyslog(lagertest.NewTestLogger(""), sink.SyslogConfig{
+			Address:  listener.Addr().String(),
+			Hostname: "cell",
+		})
+
+		msg = &events.LogMessage{
+			Message:        []byte("a message"),
+			MessageType:    events.LogMessage_ERR.Enum(),
+			Timestamp:      proto.Int64(1257894000000000000),
+			AppId:          proto.String("app-guid"),
+			SourceType:     proto.String("APP"),
+			SourceInstance: proto.String("3"),
+		}
+	})
+
+	AfterEach(func() {
+		syslog.Close()
+		listener.Close()
+	})
+
+	It("sends RFC 5424 messages", func() {
+		Expect(syslog.Send(msg, map[string]string{"space_name": "dev"})).To(Succeed())
+
+		var message rfc5424.Message
+		Eventually(received).Should(Receive(&message))
+		Expect(message.Priority).To(Equal(rfc5424.User | rfc5424.Error))
+		Expect(message.Timestamp.Equal(time.Unix(0, 1257894000000000000))).To(BeTrue())
+		Expect(message.Hostname).To(Equal("cell"))
+		Expect(message.AppName).To(Equal("app-guid"))
+		Expect(message.ProcessID).To(Equal("[APP/3]"))
+		Expect(string(message.Message)).To(Equal("a message\n"))
+		Expect(message.StructuredData).To(Equal([]rfc5424.StructuredData{{
+			ID:         "tags@47450",
+			Parameters: []rfc5424.SDParam{{Name: "space_name", Value: "dev"}},
+		}}))
+	})
+
+	It("does not change the message", func() {
+		msg.Message = make([]byte, 1, 10)
+		Expect(syslog.Send(msg, nil)).To(Succeed())
+		Expect(msg.Message[:2]).To(Equal([]byte{0, 0}))
+	})
+
+	Context("when a message cannot be encoded", func() {
+		It("fails to send it and keeps the connection", func() {
+			Expect(syslog.Send(msg, nil)).To(Succeed())
+			Eventually(received).Should(Receive())
+
+			invalid := *msg
+			invalid.AppId = proto.String(strings.Repeat("a", 49))
+			Expect(syslog.Send(&invalid, nil)).NotTo(Succeed())
+
+			Expect(syslog.Send(msg, nil)).To(Succeed())
+			Eventually(received).Should(Receive())
+			Eventually(conns).Should(HaveLen(1))
+			Consistently(conns).Should(HaveLen(1))
+		})
+	})
+
+	Context("when the connection is lost", func() {
+		It("connects again", func() {
+			Expect(syslog.Send(msg, nil)).To(Succeed())
+			Eventually(received).Should(Receive())
+
+			var conn net.Conn
+			Eventually(conns).Should(Receive(&conn))
+			conn.Close()
+
+			Eventually(func() error { return syslog.Send(msg, nil) }).Should(HaveOccurred())
+			Expect(syslog.Send(msg, nil)).To(Succeed())
+			Eventually(conns).Should(Receive())
+			Eventually(received).Should(Receive())
+		})
+	})
+
+	Context("when the server stops reading", func() {
+		var (
+			stalled      net.Listener
+			writeTimeout time.Duration
+		)
+
+		BeforeEach(func() {
+			writeTimeout = sink.WriteTimeout
+			sink.WriteTimeout = 50 * time.Millisecond
+
+			var err error
+			stalled, err = net.Listen("tcp", "127.0.0.1:0")
+			Expect(err).NotTo(HaveOccurred())
+			go func(stalled net.Listener, conns chan<- net.Conn) {
+				for {
+					conn, err := stalled.Accept()
+					if err != nil {
+						return
+					}
+					conns <- conn
+				}
+			}(stalled, conns)
+
+			syslog = sink.NewSyslog(lagertest.NewTestLogger(""), sink.SyslogConfig{
+				Address: stalled.Addr().String(),
+			})
+			msg.Message = make([]byte, 64*1024)
+		})
+
+		AfterEach(func() {
+			sink.WriteTimeout = writeTimeout
+			stalled.Close()
+		})
+
+		It("fails to send once the write times out", func() {
+			Eventually(func() error { return syslog.Send(msg, nil) }, 5*time.Second).Should(HaveOccurred())
+		})
+
+		It("unblocks a send in progress when it is closed", func() {
+			sink.WriteTimeout = time.Hour
+
+			sent := make(chan error)
+			go func(syslog *sink.Syslog, msg *events.LogMessage) {
+				for {
+					if err := syslog.Send(msg, nil); err != nil {
+						sent <- err
+						return
+					}
+				}
+			}(syslog, msg)
+
+			Consistently(sent).ShouldNot(Receive())
+			Expect(syslog.Close()).To(Succeed())
+			Eventually(sent).Should(Receive())
+		})
+	})
+
+	Context("when the server cannot be reached", func() {
+		It("fails to send", func() {
+			listener.Close()
+			Expect(syslog.Send(msg, nil)).To(HaveOccurred())
+		})
+	})
+})
+
+var _ = Describe("ParseSyslogURL", func() {
+	It("parses plain syslog URLs", func() {
+		config, err := sink.ParseSyslogURL("syslog://logs.example.com:514", nil)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(config).To(Equal(sink.SyslogConfig{Address: "logs.example.com:514"}))
+	})
+
+	It("parses syslog over TLS URLs", func() {
+		config, err := sink.ParseSyslogURL("syslog-tls://logs.example.com:6514", &tls.Config{MinVersion: tls.VersionTLS12})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(config.Address).To(Equal("logs.example.com:6514"))
+		Expect(config.TLS.ServerName).To(Equal("logs.example.com"))
+		Expect(config.TLS.MinVersion).To(Equal(uint16(tls.VersionTLS12)))
+	})
+
+	It("rejects URLs without a port", func() {
+		_, err := sink.ParseSyslogURL("syslog://logs.example.com", nil)
+		Expect(err).To(MatchError(`syslog URL "syslog://logs.example.com" has no port`))
+	})
+
+	It("rejects other schemes", func() {
+		_, err := sink.ParseSyslogURL("https://logs.example.com:443", nil)
+		Expect(err).To(MatchError(`unknown syslog scheme "https"`))
+	})
+})
@@ -0,0 +1,59 @@
+package sink
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/cloudfoundry/sonde-go/events"
+)
+
+// Writer writes each message on a line of text such as
+//
+//	2009-11-10T23:00:00Z app-guid [APP/0] OUT a message
+//
+// Tags are not written.
+type Writer struct {
+	mu     sync.Mutex
+	w      io.Writer
+	closer io.Closer
+}
+
+// NewWriter creates a sink writing to w, for example os.Stdout.
+func NewWriter(w io.Writer) *Writer {
+	return &Writer{w: w}
+}
+
+// NewFile creates a sink appending to the file at path.
+func NewFile(path string) (*Writer, error) {
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	return &Writer{w: file, closer: file}, nil
+}
+
+func (w *Writer) Send(msg *events.LogMessage, tags map[string]string) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	_, err := fmt.Fprintf(w.w, "%s %s [%s/%s] %s %s\n",
+		time.Unix(0, msg.GetTimestamp()).UTC().Format(time.RFC3339Nano),
+		msg.GetAppId(),
+		msg.GetSourceType(),
+		msg.GetSourceInstance(),
+		msg.GetMessageType(),
+		msg.GetMessage(),
+	)
+	return err
+}
+
+// Close closes the file written by a sink created with NewFile.
+func (w *Writer) Close() error {
+	if w.closer == nil {
+		return nil
+	}
+	return w.closer.Close()
+}
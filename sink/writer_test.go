@@ -0,0 +1,70 @@
+package sink_test
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/cf-furnace/loggingAgent/sink"
+	"github.com/cloudfoundry/sonde-go/events"
+	"github.com/gogo/protobuf/proto"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Writer", func() {
+	var msg *events.LogMessage
+
+	BeforeEach(func() {
+		msg = &events.LogMessage{
+			Message:        []byte("a message"),
+			MessageType:    events.LogMessage_OUT.Enum(),
+			Timestamp:      proto.Int64(1257894000000000000),
+			AppId:          proto.String("app-guid"),
+			SourceType:     proto.String("APP"),
+			SourceInstance: proto.String("0"),
+		}
+	})
+
+	It("writes a line for each message", func() {
+		buffer := &bytes.Buffer{}
+		writer := sink.NewWriter(buffer)
+
+		Expect(writer.Send(msg, nil)).To(Succeed())
+		Expect(writer.Send(msg, map[string]string{"space_name": "dev"})).To(Succeed())
+		Expect(buffer.String()).To(Equal(
+			"2009-11-10T23:00:00Z app-guid [APP/0] OUT a message\n" +
+				"2009-11-10T23:00:00Z app-guid [APP/0] OUT a message\n",
+		))
+	})
+
+	Context("with a file", func() {
+		var dir, path string
+
+		BeforeEach(func() {
+			var err error
+			dir, err = ioutil.TempDir("", "sink")
+			Expect(err).NotTo(HaveOccurred())
+
+			path = filepath.Join(dir, "logs")
+			Expect(ioutil.WriteFile(path, []byte("earlier\n"), 0644)).To(Succeed())
+		})
+
+		AfterEach(func() {
+			os.RemoveAll(dir)
+		})
+
+		It("appends to it", func() {
+			file, err := sink.NewFile(path)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(file.Send(msg, nil)).To(Succeed())
+			Expect(file.Close()).To(Succeed())
+
+			Expect(ioutil.ReadFile(path)).To(Equal([]byte(
+				"earlier\n2009-11-10T23:00:00Z app-guid [APP/0] OUT a message\n",
+			)))
+		})
+	})
+})
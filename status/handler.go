@@ -0,0 +1,102 @@
+package status
+
+import (
+	"fmt"
+	"net/http"
+
+	"code.cloudfoundry.org/lager"
+
+	"github.com/cf-furnace/loggingAgent/proxy"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+const namespace = "loggingagent"
+
+// StatsSource supplies the counters of each app whose logs are read.
+type StatsSource interface {
+	AppStats() map[string]proxy.Stats
+}
+
+// WatcherStatus reports the health of the log directory watcher.
+type WatcherStatus interface {
+	Errors() uint64
+	Err() error
+}
+
+// NewHandler serves the agent's metrics in the Prometheus format on /metrics
+// and its health on /healthz. The agent is unhealthy once the watcher has
+// stopped.
+func NewHandler(logger lager.Logger, stats StatsSource, watcher WatcherStatus) http.Handler {
+	logger = logger.Session("status")
+
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(newCollector(stats, watcher))
+
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.HandlerFor(registry, promhttp.HandlerOpts{}))
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, req *http.Request) {
+		if err := watcher.Err(); err != nil {
+			logger.Info("unhealthy", lager.Data{"error": err.Error()})
+			http.Error(w, fmt.Sprintf("watcher stopped: %s", err), http.StatusServiceUnavailable)
+			return
+		}
+		fmt.Fprintln(w, "ok")
+	})
+	return mux
+}
+
+type collector struct {
+	stats   StatsSource
+	watcher WatcherStatus
+
+	linesRead       *prometheus.Desc
+	bytesRead       *prometheus.Desc
+	messagesEmitted *prometheus.Desc
+	messagesDropped *prometheus.Desc
+	openFiles       *prometheus.Desc
+	watcherErrors   *prometheus.Desc
+}
+
+func newCollector(stats StatsSource, watcher WatcherStatus) *collector {
+	appDesc := func(name, help string) *prometheus.Desc {
+		return prometheus.NewDesc(prometheus.BuildFQName(namespace, "", name), help, []string{"app_id"}, nil)
+	}
+
+	return &collector{
+		stats:   stats,
+		watcher: watcher,
+
+		linesRead:       appDesc("lines_read_total", "Log lines read."),
+		bytesRead:       appDesc("bytes_read_total", "Bytes of log files read."),
+		messagesEmitted: appDesc("messages_emitted_total", "Log messages emitted."),
+		messagesDropped: appDesc("messages_dropped_total", "Log messages that were read but not emitted."),
+		openFiles: prometheus.NewDesc(prometheus.BuildFQName(namespace, "", "open_files"),
+			"Log files being read.", nil, nil),
+		watcherErrors: prometheus.NewDesc(prometheus.BuildFQName(namespace, "", "watcher_errors_total"),
+			"Errors reported by the log directory watcher.", nil, nil),
+	}
+}
+
+func (c *collector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.linesRead
+	ch <- c.bytesRead
+	ch <- c.messagesEmitted
+	ch <- c.messagesDropped
+	ch <- c.openFiles
+	ch <- c.watcherErrors
+}
+
+func (c *collector) Collect(ch chan<- prometheus.Metric) {
+	openFiles := 0
+	for appID, stats := range c.stats.AppStats() {
+		ch <- prometheus.MustNewConstMetric(c.linesRead, prometheus.CounterValue, float64(stats.LinesRead), appID)
+		ch <- prometheus.MustNewConstMetric(c.bytesRead, prometheus.CounterValue, float64(stats.BytesRead), appID)
+		ch <- prometheus.MustNewConstMetric(c.messagesEmitted, prometheus.CounterValue, float64(stats.MessagesEmitted), appID)
+		ch <- prometheus.MustNewConstMetric(c.messagesDropped, prometheus.CounterValue, float64(stats.Dropped+stats.EmitFailures+stats.Throttled+stats.Filtered), appID)
+		openFiles += stats.ActiveReaders
+	}
+
+	ch <- prometheus.MustNewConstMetric(c.openFiles, prometheus.GaugeValue, float64(openFiles))
+	ch <- prometheus.MustNewConstMetric(c.watcherErrors, prometheus.CounterValue, float64(c.watcher.Errors()))
+}
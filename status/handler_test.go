@@ -0,0 +1,99 @@
+package status_test
+
+import (
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+
+	"code.cloudfoundry.org/lager/lagertest"
+	"github.com/cf-furnace/loggingAgent/proxy"
+	"github.com/cf-furnace/loggingAgent/retriever"
+	"github.com/cf-furnace/loggingAgent/status"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Handler", func() {
+	var (
+		stats   fakeStats
+		watcher *fakeWatcher
+		handler http.Handler
+	)
+
+	BeforeEach(func() {
+		stats = fakeStats{
+			"app-1": {
+				Stats:           retriever.Stats{LinesRead: 3, BytesRead: 120, Dropped: 2},
+				MessagesEmitted: 2,
+				EmitFailures:    1,
+				ActiveReaders:   2,
+			},
+			"app-2": {ActiveReaders: 1},
+		}
+		watcher = &fakeWatcher{errors: 4}
+	})
+
+	JustBeforeEach(func() {
+		handler = status.NewHandler(lagertest.NewTestLogger("status"), stats, watcher)
+	})
+
+	get := func(path string) (int, string) {
+		recorder := httptest.NewRecorder()
+		handler.ServeHTTP(recorder, httptest.NewRequest("GET", path, nil))
+		body, err := ioutil.ReadAll(recorder.Body)
+		Expect(err).NotTo(HaveOccurred())
+		return recorder.Code, string(body)
+	}
+
+	Describe("/metrics", func() {
+		It("serves the per-app counters", func() {
+			code, body := get("/metrics")
+			Expect(code).To(Equal(http.StatusOK))
+			Expect(body).To(ContainSubstring(`loggingagent_lines_read_total{app_id="app-1"} 3`))
+			Expect(body).To(ContainSubstring(`loggingagent_bytes_read_total{app_id="app-1"} 120`))
+			Expect(body).To(ContainSubstring(`loggingagent_messages_emitted_total{app_id="app-1"} 2`))
+			Expect(body).To(ContainSubstring(`loggingagent_messages_dropped_total{app_id="app-1"} 3`))
+		})
+
+		It("serves the open files and watcher errors", func() {
+			_, body := get("/metrics")
+			Expect(body).To(ContainSubstring("loggingagent_open_files 3"))
+			Expect(body).To(ContainSubstring("loggingagent_watcher_errors_total 4"))
+		})
+	})
+
+	Describe("/healthz", func() {
+		It("succeeds while the watcher runs", func() {
+			code, _ := get("/healthz")
+			Expect(code).To(Equal(http.StatusOK))
+		})
+
+		Context("when the watcher has stopped", func() {
+			BeforeEach(func() {
+				watcher.err = errors.New("boom")
+			})
+
+			It("fails", func() {
+				code, body := get("/healthz")
+				Expect(code).To(Equal(http.StatusServiceUnavailable))
+				Expect(body).To(ContainSubstring("boom"))
+			})
+		})
+	})
+})
+
+type fakeStats map[string]proxy.Stats
+
+func (f fakeStats) AppStats() map[string]proxy.Stats {
+	return f
+}
+
+type fakeWatcher struct {
+	errors uint64
+	err    error
+}
+
+func (f *fakeWatcher) Errors() uint64 { return f.errors }
+func (f *fakeWatcher) Err() error     { return f.err }
@@ -0,0 +1,13 @@
+package watcher
+
+import "github.com/cf-furnace/loggingAgent/notify"
+
+// SetNewNotifyWatcher replaces the function creating file system watchers
+// and returns a function restoring it.
+func SetNewNotifyWatcher(f func(notify.Options) (notify.Watcher, error)) func() {
+	old := newNotifyWatcher
+	newNotifyWatcher = f
+	return func() {
+		newNotifyWatcher = old
+	}
+}
@@ -1,30 +1,229 @@
 package watcher
 
 import (
+	"errors"
 	"os"
 	"path"
 	"path/filepath"
 	"regexp"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	"code.cloudfoundry.org/lager"
-	"github.com/fsnotify/fsnotify"
+	"github.com/cf-furnace/loggingAgent/notify"
 )
 
 type Event struct {
+	// Root is the directory of the watch root the log was found in.
+	Root string
+
 	Pod       string
 	Namespace string
 	Container string
-	Path      string
+	// ContainerID is the ID of the container when the name of the log
+	// carries it.
+	ContainerID string
+	// Fields holds every field the name pattern captured, including those
+	// above, by the names of their groups.
+	Fields map[string]string
+	// Path is the name of the log file in the watched directory.
+	Path string
+	// RealPath is Path with symlinks resolved.
+	RealPath string
 
 	Info os.FileInfo
 }
 
-var kubeTagRegexp = regexp.MustCompile(`([^_]+)_([^_]+)_(.+)`)
+// DefaultPattern matches the logs of the kubelet's log directory.
+const DefaultPattern = "*.log"
+
+// The names of the fields read from the name of a log into the fields of an
+// Event.
+const (
+	PodField         = "pod"
+	NamespaceField   = "namespace"
+	ContainerField   = "container"
+	ContainerIDField = "container_id"
+)
+
+var (
+	// DefaultNamePattern reads the names of the kubelet's logs, such as
+	// <pod>_<namespace>_<container>-<container ID>.log. The container ID
+	// is optional.
+	DefaultNamePattern = regexp.MustCompile(`^(?P<pod>[^_]+)_(?P<namespace>[^_]+)_(?P<container>.+?)(?:-(?P<container_id>[0-9a-f]{64}))?$`)
+	// PlainNamePattern uses the whole name as the container, for logs that
+	// do not belong to a pod.
+	PlainNamePattern = regexp.MustCompile(`^(?P<container>.+)$`)
+)
+
+// Options control how the log directory is watched.
+type Options struct {
+	// Pattern is a shell pattern, as used by filepath.Match, that the names
+	// of logs match. DefaultPattern is used when it is empty.
+	Pattern string
+	// NamePattern reads the fields of an Event from the name of a log,
+	// without its extension, through named capturing groups. Logs whose
+	// names it does not match are ignored. DefaultNamePattern is used when
+	// it is nil.
+	NamePattern *regexp.Regexp
+	// Recursive watches every directory below the log directory.
+	Recursive bool
+	// FollowSymlinks resolves symlinked logs and watches the directories
+	// they point into.
+	FollowSymlinks bool
+	// Notify selects how changes to the directories are detected.
+	Notify notify.Options
+}
+
+// Root is a directory watched for logs.
+type Root struct {
+	Dir string
+	Options
+}
+
+// A Watcher sends an Event on Events for every log found in the watched
+// directories.
+type Watcher struct {
+	Events <-chan *Event
+
+	events   chan *Event
+	errors   uint64
+	done     chan struct{}
+	stopOnce sync.Once
+	err      error
+
+	closing   chan struct{}
+	closeOnce sync.Once
+	running   sync.WaitGroup
+}
+
+// Errors returns the number of errors the file system watcher has reported.
+func (w *Watcher) Errors() uint64 {
+	return atomic.LoadUint64(&w.errors)
+}
+
+// Done is closed when the watcher stops.
+func (w *Watcher) Done() <-chan struct{} {
+	return w.done
+}
+
+// Err returns the error that stopped the watcher, or nil while it is
+// running.
+func (w *Watcher) Err() error {
+	select {
+	case <-w.done:
+		return w.err
+	default:
+		return nil
+	}
+}
+
+// Close stops watching the directories and closes Events once no more
+// events are sent on it. Done is closed as well; Err keeps the error that
+// stopped the watcher before, if any.
+func (w *Watcher) Close() {
+	w.closeOnce.Do(func() {
+		close(w.closing)
+		w.running.Wait()
+		close(w.events)
+		w.stop(nil)
+	})
+}
+
+func (w *Watcher) stop(err error) {
+	w.stopOnce.Do(func() {
+		w.err = err
+		close(w.done)
+	})
+}
+
+var (
+	// RestartInterval is how long the watcher waits before recreating a
+	// failed file system watcher. It doubles with each consecutive failure.
+	RestartInterval = 1 * time.Second
+	// MaxRestarts is how many consecutive failures the watcher recovers
+	// from before it stops.
+	MaxRestarts = 5
+)
+
+var newNotifyWatcher = notify.New
+
+// errClosed stops a restart when the Watcher is closed.
+var errClosed = errors.New("watcher closed")
+
+type dirWatcher struct {
+	logger  lager.Logger
+	logDir  string
+	opts    Options
+	watcher notify.Watcher
+	events  chan<- *Event
+	closing <-chan struct{}
+
+	// dirs are the watched directories below (and including) logDir.
+	dirs map[string]struct{}
+	// links maps a symlinked log to the file it resolves to.
+	links map[string]string
+	// targets maps a watched symlink target directory to the links that
+	// resolve into it.
+	targets map[string]map[string]struct{}
+}
 
-func Watch(logger lager.Logger, logDir string) (<-chan *Event, error) {
-	logger = logger.Session("Watcher", lager.Data{"logDir": logDir})
-	watcher, err := fsnotify.NewWatcher()
+// Watch reports the logs in logDir. When the file system watcher fails it
+// is recreated and the directory is scanned again, up to MaxRestarts times in
+// a row; after that the Watcher stops and Err returns the last failure.
+func Watch(logger lager.Logger, logDir string, opts Options) (*Watcher, error) {
+	return WatchRoots(logger, []Root{{Dir: logDir, Options: opts}})
+}
+
+// WatchRoots reports the logs in each root on the same Events channel. Each
+// root recovers from failures as Watch describes, and the Watcher stops when
+// one of them cannot.
+func WatchRoots(logger lager.Logger, roots []Root) (*Watcher, error) {
+	newFiles := make(chan *Event, 10)
+	closing := make(chan struct{})
+
+	var dirWatchers []*dirWatcher
+	for _, root := range roots {
+		watcher, err := newWatcher(root.Dir, root.Notify)
+		if err != nil {
+			for _, w := range dirWatchers {
+				w.watcher.Close()
+			}
+			return nil, err
+		}
+
+		dirWatchers = append(dirWatchers, &dirWatcher{
+			logger:  logger.Session("Watcher", lager.Data{"logDir": root.Dir}),
+			logDir:  root.Dir,
+			opts:    root.Options,
+			watcher: watcher,
+			events:  newFiles,
+			closing: closing,
+			dirs:    map[string]struct{}{root.Dir: {}},
+			links:   map[string]string{},
+			targets: map[string]map[string]struct{}{},
+		})
+	}
+
+	status := &Watcher{
+		Events:  newFiles,
+		events:  newFiles,
+		done:    make(chan struct{}),
+		closing: closing,
+	}
+
+	for _, w := range dirWatchers {
+		status.running.Add(1)
+		go w.run(status)
+	}
+
+	return status, nil
+}
+
+func newWatcher(logDir string, opts notify.Options) (notify.Watcher, error) {
+	watcher, err := newNotifyWatcher(opts)
 	if err != nil {
 		return nil, err
 	}
@@ -34,71 +233,275 @@ func Watch(logger lager.Logger, logDir string) (<-chan *Event, error) {
 		watcher.Close()
 		return nil, err
 	}
+	return watcher, nil
+}
 
-	newFiles := make(chan *Event, 10)
+func (w *dirWatcher) run(status *Watcher) {
+	defer status.running.Done()
 
-	go func() {
-		currentLogs(logger, logDir, newFiles)
+	w.currentLogs(w.logDir, true)
 
-		for {
-			select {
-			case event := <-watcher.Events:
-				if event.Op&fsnotify.Create == fsnotify.Create {
-					if evt := toEvent(event.Name); evt != nil {
-						newFiles <- evt
-					}
-				}
-			case err := <-watcher.Errors:
-				logger.Error("watcher failed", err)
+	failures := 0
+	for {
+		select {
+		case <-w.closing:
+			w.watcher.Close()
+			return
+		case event := <-w.watcher.Events():
+			failures = 0
+			if event.Op&notify.Create == notify.Create {
+				w.created(event.Name)
+			} else if event.Op&(notify.Remove|notify.Rename) != 0 {
+				w.removed(event.Name)
+			}
+		case err := <-w.watcher.Errors():
+			w.logger.Error("watcher failed", err)
+			atomic.AddUint64(&status.errors, 1)
+			w.watcher.Close()
+
+			failures++
+			err = w.restart(&failures, err)
+			if err == errClosed {
+				return
+			}
+			if err != nil {
+				w.logger.Error("watcher-stopped", err, lager.Data{"failures": failures})
+				status.stop(err)
 				return
 			}
 		}
-	}()
+	}
+}
 
-	return newFiles, nil
+// restart recreates the file system watcher, waiting longer after each
+// consecutive failure, and scans the log directory again so that logs
+// created while nothing was watching are not missed. It returns the last
+// error once there have been more than MaxRestarts failures.
+func (w *dirWatcher) restart(failures *int, err error) error {
+	for *failures <= MaxRestarts {
+		backoff := RestartInterval << uint(*failures-1)
+		w.logger.Info("restarting-watcher", lager.Data{"failures": *failures, "backoff": backoff.String()})
+		select {
+		case <-time.After(backoff):
+		case <-w.closing:
+			return errClosed
+		}
+
+		var watcher notify.Watcher
+		watcher, err = newWatcher(w.logDir, w.opts.Notify)
+		if err != nil {
+			w.logger.Error("restart-failed", err)
+			*failures++
+			continue
+		}
+
+		w.watcher = watcher
+		w.dirs = map[string]struct{}{w.logDir: {}}
+		w.links = map[string]string{}
+		w.targets = map[string]map[string]struct{}{}
+		w.currentLogs(w.logDir, false)
+		return nil
+	}
+	return err
 }
 
-func currentLogs(logger lager.Logger, logDir string, newFiles chan<- *Event) {
-	d, err := os.Open(logDir)
+// currentLogs sends an event for every log in dir. existing marks the events
+// as files that were present before they were discovered.
+func (w *dirWatcher) currentLogs(dir string, existing bool) {
+	d, err := os.Open(dir)
 	if err != nil {
-		logger.Error("currentLogs-open", err)
+		w.logger.Error("currentLogs-open", err)
 		return
 	}
+	defer d.Close()
 
 	files, err := d.Readdir(0)
 	if err != nil {
-		logger.Error("currentLogs-readdir", err)
+		w.logger.Error("currentLogs-readdir", err)
 		return
 	}
 
 	for _, f := range files {
+		pth := filepath.Join(dir, f.Name())
 		if f.IsDir() {
+			if w.opts.Recursive {
+				w.addDir(pth, existing)
+			}
 			continue
 		}
 
-		if evt := toEvent(filepath.Join(logDir, f.Name())); evt != nil {
-			evt.Info = f
-			newFiles <- evt
+		if evt := w.toEvent(pth); evt != nil {
+			if existing {
+				evt.Info = f
+				if fi, err := os.Stat(evt.RealPath); err == nil {
+					evt.Info = fi
+				}
+			}
+			w.send(evt)
 		}
 	}
 }
 
-func toEvent(pth string) *Event {
-	if !strings.HasSuffix(pth, ".log") {
-		return nil
+// send passes evt on unless the Watcher is closed.
+func (w *dirWatcher) send(evt *Event) {
+	select {
+	case w.events <- evt:
+	case <-w.closing:
+	}
+}
+
+func (w *dirWatcher) addDir(dir string, existing bool) {
+	if _, ok := w.dirs[dir]; ok {
+		return
+	}
+
+	err := w.watcher.Add(dir)
+	if err != nil {
+		w.logger.Error("add-dir-failed", err, lager.Data{"dir": dir})
+		return
+	}
+	w.dirs[dir] = struct{}{}
+
+	w.currentLogs(dir, existing)
+}
+
+func (w *dirWatcher) created(pth string) {
+	dir := filepath.Dir(pth)
+
+	if _, ok := w.dirs[dir]; ok {
+		fi, err := os.Lstat(pth)
+		if err != nil {
+			return
+		}
+
+		if fi.IsDir() {
+			if w.opts.Recursive {
+				w.addDir(pth, false)
+			}
+		} else if evt := w.toEvent(pth); evt != nil {
+			w.send(evt)
+		}
+	}
+
+	// a file was (re)created in a directory that symlinked logs point into
+	for link := range w.targets[dir] {
+		if realPath, err := filepath.EvalSymlinks(link); err == nil && realPath == pth {
+			if evt := w.opts.toEvent(w.logDir, link); evt != nil {
+				evt.RealPath = realPath
+				w.send(evt)
+			}
+		}
+	}
+}
+
+func (w *dirWatcher) removed(pth string) {
+	if _, ok := w.dirs[pth]; ok && pth != w.logDir {
+		w.watcher.Remove(pth)
+		delete(w.dirs, pth)
+	}
+
+	if target, ok := w.links[pth]; ok {
+		w.unlink(pth, target)
+	}
+}
+
+// toEvent converts a log path into an event, resolving and tracking it when
+// it is a symlink.
+func (w *dirWatcher) toEvent(pth string) *Event {
+	evt := w.opts.toEvent(w.logDir, pth)
+	if evt == nil || !w.opts.FollowSymlinks {
+		return evt
+	}
+
+	fi, err := os.Lstat(pth)
+	if err != nil || fi.Mode()&os.ModeSymlink == 0 {
+		return evt
+	}
+
+	realPath, err := filepath.EvalSymlinks(pth)
+	if err != nil {
+		w.logger.Error("resolve-symlink-failed", err, lager.Data{"path": pth})
+		return evt
+	}
+	evt.RealPath = realPath
+
+	if target, ok := w.links[pth]; ok {
+		w.unlink(pth, target)
+	}
+	w.link(pth, realPath)
+
+	return evt
+}
+
+func (w *dirWatcher) link(link, realPath string) {
+	dir := filepath.Dir(realPath)
+	if _, ok := w.targets[dir]; !ok {
+		err := w.watcher.Add(dir)
+		if err != nil {
+			w.logger.Error("add-target-dir-failed", err, lager.Data{"dir": dir})
+			return
+		}
+		w.targets[dir] = map[string]struct{}{}
+	}
+
+	w.targets[dir][link] = struct{}{}
+	w.links[link] = realPath
+}
+
+func (w *dirWatcher) unlink(link, realPath string) {
+	delete(w.links, link)
+
+	dir := filepath.Dir(realPath)
+	delete(w.targets[dir], link)
+	if len(w.targets[dir]) == 0 {
+		delete(w.targets, dir)
+		if _, ok := w.dirs[dir]; !ok {
+			w.watcher.Remove(dir)
+		}
+	}
+}
+
+// toEvent converts the path of a log found below root into an event. It
+// returns nil for files that are not logs.
+func (opts Options) toEvent(root, pth string) *Event {
+	pattern := opts.Pattern
+	if pattern == "" {
+		pattern = DefaultPattern
 	}
 
 	name := path.Base(pth)
-	name = name[:strings.LastIndex(name, ".")]
-	tags := kubeTagRegexp.FindStringSubmatch(name)
-	if len(tags) != 4 {
+	if ok, _ := filepath.Match(pattern, name); !ok {
 		return nil
 	}
+	if i := strings.LastIndex(name, "."); i > 0 {
+		name = name[:i]
+	}
+
+	namePattern := opts.NamePattern
+	if namePattern == nil {
+		namePattern = DefaultNamePattern
+	}
+
+	match := namePattern.FindStringSubmatch(name)
+	if match == nil {
+		return nil
+	}
+
+	fields := map[string]string{}
+	for i, field := range namePattern.SubexpNames() {
+		if field != "" && match[i] != "" {
+			fields[field] = match[i]
+		}
+	}
 
 	return &Event{
-		Pod:       tags[1],
-		Namespace: tags[2],
-		Container: tags[3],
-		Path:      pth,
+		Root:        root,
+		Pod:         fields[PodField],
+		Namespace:   fields[NamespaceField],
+		Container:   fields[ContainerField],
+		ContainerID: fields[ContainerIDField],
+		Fields:      fields,
+		Path:        pth,
+		RealPath:    pth,
 	}
 }
@@ -1,29 +1,39 @@
 package watcher_test
 
 import (
+	"errors"
 	"io/ioutil"
 	"os"
 	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
 
 	"code.cloudfoundry.org/lager/lagertest"
 
+	"github.com/cf-furnace/loggingAgent/notify"
 	"github.com/cf-furnace/loggingAgent/watcher"
 
 	. "github.com/onsi/ginkgo"
 	. "github.com/onsi/gomega"
+	. "github.com/onsi/gomega/gstruct"
 )
 
 var _ = Describe("Watcher", func() {
 	var tmpDir string
 
+	var logWatcher *watcher.Watcher
 	var createdChan <-chan *watcher.Event
 	var existingName string
 	var existingFile *os.File
+	var opts watcher.Options
 
 	BeforeEach(func() {
 		var err error
 		tmpDir, err = ioutil.TempDir("", "watcher")
 		Expect(err).NotTo(HaveOccurred())
+		opts = watcher.Options{}
 
 		existingName = "existing_namespace_cnr.log"
 		existingFile, err = os.OpenFile(path.Join(tmpDir, existingName), os.O_WRONLY|os.O_TRUNC|os.O_CREATE, 0666)
@@ -34,21 +44,32 @@ var _ = Describe("Watcher", func() {
 		logger := lagertest.NewTestLogger("watcher")
 
 		var err error
-		createdChan, err = watcher.Watch(logger, tmpDir)
+		logWatcher, err = watcher.Watch(logger, tmpDir, opts)
 		Expect(err).NotTo(HaveOccurred())
+		createdChan = logWatcher.Events
 	})
 
 	AfterEach(func() {
+		logWatcher.Close()
 		os.RemoveAll(tmpDir)
 	})
 
+	Context("when it is closed", func() {
+		It("closes Events", func() {
+			logWatcher.Close()
+			Eventually(createdChan).Should(BeClosed())
+			Expect(logWatcher.Done()).To(BeClosed())
+			Expect(logWatcher.Err()).NotTo(HaveOccurred())
+		})
+	})
+
 	Context("when a log file exists", func() {
 		It("fires an event", func() {
 			var event *watcher.Event
 			Eventually(createdChan).Should(Receive(&event))
 			fi := event.Info
 			event.Info = nil
-			Expect(event).To(Equal(&watcher.Event{Pod: "existing", Namespace: "namespace", Container: "cnr", Path: existingFile.Name()}))
+			Expect(event).To(Equal(&watcher.Event{Root: tmpDir, Pod: "existing", Namespace: "namespace", Container: "cnr", Fields: map[string]string{"pod": "existing", "namespace": "namespace", "container": "cnr"}, Path: existingFile.Name(), RealPath: existingFile.Name()}))
 			Expect(fi).NotTo(BeNil())
 		})
 
@@ -70,7 +91,7 @@ var _ = Describe("Watcher", func() {
 			It("fires an event for the new file", func() {
 				var event *watcher.Event
 				Eventually(createdChan).Should(Receive(&event))
-				Expect(event).To(Equal(&watcher.Event{Pod: "existing", Namespace: "namespace", Container: "cnr", Path: existingFile.Name()}))
+				Expect(event).To(Equal(&watcher.Event{Root: tmpDir, Pod: "existing", Namespace: "namespace", Container: "cnr", Fields: map[string]string{"pod": "existing", "namespace": "namespace", "container": "cnr"}, Path: existingFile.Name(), RealPath: existingFile.Name()}))
 				f, err := os.Open(event.Path)
 				Expect(err).NotTo(HaveOccurred())
 				s, err := f.Stat()
@@ -99,7 +120,7 @@ var _ = Describe("Watcher", func() {
 		It("fires an event", func() {
 			var event *watcher.Event
 			Eventually(createdChan).Should(Receive(&event))
-			Expect(event).To(Equal(&watcher.Event{Pod: "pod", Namespace: "namespace", Container: "cnr", Path: newFile.Name()}))
+			Expect(event).To(Equal(&watcher.Event{Root: tmpDir, Pod: "pod", Namespace: "namespace", Container: "cnr", Fields: map[string]string{"pod": "pod", "namespace": "namespace", "container": "cnr"}, Path: newFile.Name(), RealPath: newFile.Name()}))
 		})
 	})
 
@@ -116,4 +137,328 @@ var _ = Describe("Watcher", func() {
 			Consistently(createdChan).ShouldNot(Receive())
 		})
 	})
+
+	Context("when a log file is a symlink", func() {
+		var targetDir string
+		var target string
+
+		BeforeEach(func() {
+			var err error
+			targetDir, err = ioutil.TempDir("", "target")
+			Expect(err).NotTo(HaveOccurred())
+			targetDir, err = filepath.EvalSymlinks(targetDir)
+			Expect(err).NotTo(HaveOccurred())
+
+			target = filepath.Join(targetDir, "0.log")
+			Expect(ioutil.WriteFile(target, nil, 0666)).To(Succeed())
+			Expect(os.Remove(existingFile.Name())).To(Succeed())
+			Expect(os.Symlink(target, path.Join(tmpDir, "link_namespace_cnr.log"))).To(Succeed())
+
+			opts.FollowSymlinks = true
+		})
+
+		AfterEach(func() {
+			os.RemoveAll(targetDir)
+		})
+
+		It("fires an event with the resolved path", func() {
+			var event *watcher.Event
+			Eventually(createdChan).Should(Receive(&event))
+			Expect(event.Path).To(Equal(path.Join(tmpDir, "link_namespace_cnr.log")))
+			Expect(event.RealPath).To(Equal(target))
+			Expect(event.Pod).To(Equal("link"))
+		})
+
+		Context("when the target is rotated", func() {
+			JustBeforeEach(func() {
+				Eventually(createdChan).Should(Receive())
+
+				Expect(os.Rename(target, target+".1")).To(Succeed())
+				Expect(ioutil.WriteFile(target, nil, 0666)).To(Succeed())
+			})
+
+			It("fires an event for the new target", func() {
+				var event *watcher.Event
+				Eventually(createdChan).Should(Receive(&event))
+				Expect(event.Path).To(Equal(path.Join(tmpDir, "link_namespace_cnr.log")))
+				Expect(event.RealPath).To(Equal(target))
+			})
+		})
+
+		Context("when symlinks are not followed", func() {
+			BeforeEach(func() {
+				opts.FollowSymlinks = false
+			})
+
+			It("reports the link path as the real path", func() {
+				var event *watcher.Event
+				Eventually(createdChan).Should(Receive(&event))
+				Expect(event.RealPath).To(Equal(event.Path))
+			})
+		})
+	})
+
+	Context("when watching recursively", func() {
+		var subDir string
+
+		BeforeEach(func() {
+			subDir = path.Join(tmpDir, "sub")
+			Expect(os.Mkdir(subDir, 0777)).To(Succeed())
+			Expect(ioutil.WriteFile(path.Join(subDir, "nested_namespace_cnr.log"), nil, 0666)).To(Succeed())
+
+			opts.Recursive = true
+		})
+
+		It("fires events for logs in subdirectories", func() {
+			Eventually(createdChan).Should(Receive(PointTo(MatchFields(IgnoreExtras, Fields{
+				"Pod":  Equal("nested"),
+				"Path": Equal(path.Join(subDir, "nested_namespace_cnr.log")),
+			}))))
+		})
+
+		Context("when a log is created in a new subdirectory", func() {
+			JustBeforeEach(func() {
+				Eventually(createdChan).Should(Receive())
+				Eventually(createdChan).Should(Receive())
+
+				newDir := path.Join(tmpDir, "new")
+				Expect(os.Mkdir(newDir, 0777)).To(Succeed())
+				Eventually(func() error {
+					return ioutil.WriteFile(path.Join(newDir, "created_namespace_cnr.log"), nil, 0666)
+				}).Should(Succeed())
+			})
+
+			It("fires an event", func() {
+				var event *watcher.Event
+				Eventually(createdChan).Should(Receive(&event))
+				Expect(event.Pod).To(Equal("created"))
+				Expect(event.Info).To(BeNil())
+			})
+		})
+	})
+
+	Context("when a log is named with its container ID", func() {
+		var containerID string
+
+		JustBeforeEach(func() {
+			Eventually(createdChan).Should(Receive())
+
+			containerID = strings.Repeat("0123456789abcdef", 4)
+			_, err := os.Create(path.Join(tmpDir, "pod_namespace_application-web-"+containerID+".log"))
+			Expect(err).NotTo(HaveOccurred())
+		})
+
+		It("separates the container ID from the container", func() {
+			var event *watcher.Event
+			Eventually(createdChan).Should(Receive(&event))
+			Expect(event.Container).To(Equal("application-web"))
+			Expect(event.ContainerID).To(Equal(containerID))
+			Expect(event.Fields).To(HaveKeyWithValue("container_id", containerID))
+		})
+	})
+
+	Context("with a name pattern", func() {
+		BeforeEach(func() {
+			opts.NamePattern = regexp.MustCompile(`^(?P<namespace>[^.]+)\.(?P<pod>[^.]+)\.(?P<container>[^.]+)\.(?P<restart>\d+)$`)
+		})
+
+		It("reads every field it captures", func() {
+			_, err := os.Create(path.Join(tmpDir, "namespace.pod.cnr.3.log"))
+			Expect(err).NotTo(HaveOccurred())
+
+			var event *watcher.Event
+			Eventually(createdChan).Should(Receive(&event))
+			Expect(event.Pod).To(Equal("pod"))
+			Expect(event.Namespace).To(Equal("namespace"))
+			Expect(event.Container).To(Equal("cnr"))
+			Expect(event.Fields).To(Equal(map[string]string{"namespace": "namespace", "pod": "pod", "container": "cnr", "restart": "3"}))
+		})
+	})
+
+	Context("with plain names", func() {
+		BeforeEach(func() {
+			opts.Pattern = "*.txt"
+			opts.NamePattern = watcher.PlainNamePattern
+		})
+
+		It("only reports the logs matching the pattern, named by their container", func() {
+			_, err := os.Create(path.Join(tmpDir, "kubelet.txt"))
+			Expect(err).NotTo(HaveOccurred())
+
+			var event *watcher.Event
+			Eventually(createdChan).Should(Receive(&event))
+			Expect(event.Container).To(Equal("kubelet"))
+			Expect(event.Pod).To(BeEmpty())
+		})
+	})
+
+	Context("when polling for changes", func() {
+		BeforeEach(func() {
+			opts.Notify = notify.Options{Backend: notify.BackendPoll, PollInterval: 10 * time.Millisecond}
+		})
+
+		It("fires an event when a log file is created", func() {
+			Eventually(createdChan).Should(Receive())
+
+			_, err := os.Create(path.Join(tmpDir, "polled_namespace_cnr.log"))
+			Expect(err).NotTo(HaveOccurred())
+
+			var event *watcher.Event
+			Eventually(createdChan).Should(Receive(&event))
+			Expect(event.Pod).To(Equal("polled"))
+		})
+	})
+
+	Context("when the file system watcher fails", func() {
+		var (
+			fsWatchers  chan *failingWatcher
+			failRestart bool
+			created     int
+			restore     func()
+
+			restartInterval time.Duration
+			maxRestarts     int
+		)
+
+		BeforeEach(func() {
+			restartInterval, maxRestarts = watcher.RestartInterval, watcher.MaxRestarts
+			watcher.RestartInterval = 10 * time.Millisecond
+			watcher.MaxRestarts = 2
+
+			fsWatchers = make(chan *failingWatcher, 10)
+			failRestart = false
+			created = 0
+			restore = watcher.SetNewNotifyWatcher(func(opts notify.Options) (notify.Watcher, error) {
+				if failRestart && created > 0 {
+					return nil, errors.New("too many watchers")
+				}
+				created++
+				w, err := notify.New(opts)
+				if err != nil {
+					return nil, err
+				}
+				fw := &failingWatcher{Watcher: w, errors: make(chan error)}
+				fsWatchers <- fw
+				return fw, nil
+			})
+		})
+
+		AfterEach(func() {
+			logWatcher.Close()
+			restore()
+			watcher.RestartInterval, watcher.MaxRestarts = restartInterval, maxRestarts
+		})
+
+		JustBeforeEach(func() {
+			Eventually(createdChan).Should(Receive())
+
+			var fsWatcher *failingWatcher
+			Eventually(fsWatchers).Should(Receive(&fsWatcher))
+			fsWatcher.errors <- errors.New("queue overflow")
+		})
+
+		It("rescans the directory for logs created in the meantime", func() {
+			_, err := os.Create(path.Join(tmpDir, "missed_namespace_cnr.log"))
+			Expect(err).NotTo(HaveOccurred())
+
+			var event *watcher.Event
+			Eventually(createdChan).Should(Receive(&event))
+			if event.Pod == "existing" {
+				Eventually(createdChan).Should(Receive(&event))
+			}
+			Expect(event.Pod).To(Equal("missed"))
+			Expect(logWatcher.Errors()).To(Equal(uint64(1)))
+			Expect(logWatcher.Err()).NotTo(HaveOccurred())
+		})
+
+		Context("when it is closed while waiting to restart", func() {
+			BeforeEach(func() {
+				watcher.RestartInterval = time.Hour
+			})
+
+			It("stops waiting", func() {
+				closed := make(chan struct{})
+				go func(logWatcher *watcher.Watcher, closed chan struct{}) {
+					logWatcher.Close()
+					close(closed)
+				}(logWatcher, closed)
+
+				Eventually(closed).Should(BeClosed())
+				Eventually(createdChan).Should(BeClosed())
+			})
+		})
+
+		Context("when it cannot be recreated", func() {
+			BeforeEach(func() {
+				failRestart = true
+			})
+
+			It("stops with an error", func() {
+				Eventually(logWatcher.Done()).Should(BeClosed())
+				Expect(logWatcher.Err()).To(MatchError("too many watchers"))
+			})
+		})
+	})
+})
+
+var _ = Describe("WatchRoots", func() {
+	var podsDir, nodeDir string
+
+	BeforeEach(func() {
+		var err error
+		podsDir, err = ioutil.TempDir("", "pods")
+		Expect(err).NotTo(HaveOccurred())
+		nodeDir, err = ioutil.TempDir("", "node")
+		Expect(err).NotTo(HaveOccurred())
+
+		_, err = os.Create(filepath.Join(podsDir, "pod_namespace_cnr.log"))
+		Expect(err).NotTo(HaveOccurred())
+		_, err = os.Create(filepath.Join(nodeDir, "kubelet.log"))
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	AfterEach(func() {
+		os.RemoveAll(podsDir)
+		os.RemoveAll(nodeDir)
+	})
+
+	It("reports the logs of every root on one channel", func() {
+		logWatcher, err := watcher.WatchRoots(lagertest.NewTestLogger("watcher"), []watcher.Root{
+			{Dir: podsDir},
+			{Dir: nodeDir, Options: watcher.Options{NamePattern: watcher.PlainNamePattern}},
+		})
+		Expect(err).NotTo(HaveOccurred())
+		defer logWatcher.Close()
+
+		var events []*watcher.Event
+		for len(events) < 2 {
+			var event *watcher.Event
+			Eventually(logWatcher.Events).Should(Receive(&event))
+			event.Info = nil
+			events = append(events, event)
+		}
+		Expect(events).To(ConsistOf(
+			&watcher.Event{Root: podsDir, Pod: "pod", Namespace: "namespace", Container: "cnr", Fields: map[string]string{"pod": "pod", "namespace": "namespace", "container": "cnr"}, Path: filepath.Join(podsDir, "pod_namespace_cnr.log"), RealPath: filepath.Join(podsDir, "pod_namespace_cnr.log")},
+			&watcher.Event{Root: nodeDir, Container: "kubelet", Fields: map[string]string{"container": "kubelet"}, Path: filepath.Join(nodeDir, "kubelet.log"), RealPath: filepath.Join(nodeDir, "kubelet.log")},
+		))
+	})
+
+	It("fails when a root cannot be watched", func() {
+		_, err := watcher.WatchRoots(lagertest.NewTestLogger("watcher"), []watcher.Root{
+			{Dir: podsDir},
+			{Dir: filepath.Join(nodeDir, "missing")},
+		})
+		Expect(err).To(HaveOccurred())
+	})
 })
+
+// failingWatcher reports the errors sent on its errors channel instead of
+// those of the watcher it wraps.
+type failingWatcher struct {
+	notify.Watcher
+	errors chan error
+}
+
+func (f *failingWatcher) Errors() <-chan error {
+	return f.errors
+}